@@ -3,14 +3,20 @@ package cmd
 import (
 	"context"
 	"fmt"
+	iofs "io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 
 	"chainguard.dev/apko/pkg/apk/fs"
 	cbev1 "github.com/Snakdy/container-build-engine/pkg/api/v1"
 	"github.com/Snakdy/container-build-engine/pkg/builder"
 	"github.com/Snakdy/container-build-engine/pkg/containers"
+	"github.com/Snakdy/container-build-engine/pkg/containers/cache"
+	"github.com/Snakdy/container-build-engine/pkg/exporters"
+	"github.com/Snakdy/container-build-engine/pkg/fetch"
 	"github.com/Snakdy/container-build-engine/pkg/pipelines"
 	"github.com/go-logr/logr"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -27,36 +33,96 @@ var buildCmd = &cobra.Command{
 const (
 	flagConfig = "config"
 
-	flagSave  = "save"
-	flagImage = "image"
-	flagTag   = "tag"
+	flagSave       = "save"
+	flagSaveFormat = "save-format"
+	flagImage      = "image"
+	flagTag        = "tag"
+	flagOutput     = "output"
 
 	flagPlatform = "platform"
+
+	flagCompression      = "compression"
+	flagCompressionLevel = "compression-level"
+	flagRecompressBase   = "recompress-base"
+	flagDedupe           = "dedupe"
+	flagSquash           = "squash"
+	flagNormalise        = "normalise"
+	flagKeepLayers       = "keep-layers"
+	flagOffline          = "offline"
+	flagFetchRetries     = "fetch-retries"
+	flagFetchTimeout     = "fetch-timeout"
+	flagFetchConfig      = "fetch-config"
+	flagAllowHTTPHost    = "allow-http-host"
+	flagSkipVerifyHost   = "insecure-skip-verify-host"
+
+	flagEstargz           = "estargz"
+	flagEstargzPrioritise = "estargz-prioritise"
 )
 
 func init() {
 	buildCmd.Flags().StringP(flagConfig, "c", "", "path to an image configuration file")
 
 	buildCmd.Flags().String(flagSave, "", "path to save the image as a tar archive")
+	buildCmd.Flags().String(flagSaveFormat, saveFormatTarball, "format to save the image in (tarball, oci). OCI layouts are written to a directory unless the path ends in .tar")
 	buildCmd.Flags().String(flagImage, "", "oci image path (without tag) to push the image")
-	buildCmd.Flags().StringArrayP(flagTag, "t", nil, "tags to push")
+	buildCmd.Flags().StringArrayP(flagTag, "t", nil, "tags to push (or record when saving as an OCI layout)")
+	buildCmd.Flags().StringArrayP(flagOutput, "o", nil, "output destination (format: type=registry|oci|tarball|rootfs,dest=<path or reference>). May be repeated")
 
 	buildCmd.Flags().String(flagPlatform, "", "build platform")
 
+	buildCmd.Flags().String(flagCompression, string(containers.CompressionGzip), "layer compression (gzip, zstd, none)")
+	buildCmd.Flags().Int(flagCompressionLevel, 0, "compression level. If not set, a sensible default is chosen for the compression algorithm")
+	buildCmd.Flags().Bool(flagRecompressBase, false, "recompress the base image layers to match the --compression flag")
+	buildCmd.Flags().Bool(flagDedupe, false, "leave files out of the generated layer if they're identical to those in the base image")
+	buildCmd.Flags().String(flagSquash, "", "merge layers of the final image into one (all, new). 'new' only merges the layers added on top of the base image")
+	buildCmd.Flags().Lookup(flagSquash).NoOptDefVal = string(builder.SquashAll)
+	buildCmd.Flags().String(flagNormalise, string(containers.NormaliseOCI), "how to convert the base image (oci, annotate, none). 'annotate' records Docker specific config fields as annotations and 'none' keeps the base image as-is")
+	buildCmd.Flags().Bool(flagKeepLayers, false, "keep the layers of the base image as-is so that they can be shared with the base image and the image can be rebased")
+	buildCmd.Flags().Bool(flagEstargz, false, "generate an eStargz layer so that the image can be lazily pulled")
+	buildCmd.Flags().StringArray(flagEstargzPrioritise, nil, "files to place at the start of the eStargz layer so that they are prefetched. May be repeated")
+
+	buildCmd.Flags().Bool(flagOffline, false, "fail instead of downloading files that aren't in the download cache. Defaults to $"+fetch.EnvOffline)
+	buildCmd.Flags().Int(flagFetchRetries, 0, "number of times to retry downloads after a temporary failure (-1 disables retries). Defaults to $"+fetch.EnvRetries+" or 3")
+	buildCmd.Flags().Duration(flagFetchTimeout, 0, "maximum duration of each download request (e.g., 10m). Defaults to $"+fetch.EnvTimeout)
+	buildCmd.Flags().String(flagFetchConfig, "", "path to a file that configures TLS and proxies for each host that files are downloaded from. Defaults to $"+fetch.EnvConfig)
+	buildCmd.Flags().StringArray(flagAllowHTTPHost, nil, "host (e.g., artifacts.internal:8080) that files can be downloaded from over plain HTTP. May be repeated")
+	buildCmd.Flags().StringArray(flagSkipVerifyHost, nil, "host whose TLS certificate isn't verified when downloading files. May be repeated")
+	buildCmd.Flags().StringArray(flagCacheFrom, nil, "registry repository (e.g., registry.example.com/cache:main) to import cached layers from. May be repeated")
+	buildCmd.Flags().String(flagCacheTo, "", "registry repository to export the cached layers used by this build to")
+	buildCmd.Flags().String(flagCacheMaxSize, "", "prune the layer and download caches to this size after the build (e.g., 10Gi). Defaults to $"+cache.EnvMaxSize)
+	buildCmd.Flags().String(flagCacheMaxAge, "", "evict cached layers and downloads that haven't been used within this duration after the build (e.g., 7d). Defaults to $"+cache.EnvMaxAge)
+
 	_ = buildCmd.MarkFlagRequired(flagConfig)
 	_ = buildCmd.MarkFlagFilename(flagConfig, ".yaml", ".yml")
-
-	buildCmd.MarkFlagsMutuallyExclusive(flagSave, flagImage)
-	buildCmd.MarkFlagsRequiredTogether(flagImage, flagTag)
 }
 
+const (
+	saveFormatTarball = "tarball"
+	saveFormatOCI     = "oci"
+)
+
 func build(cmd *cobra.Command, _ []string) error {
 	log := logr.FromContextOrDiscard(cmd.Context())
 
 	configPath, _ := cmd.Flags().GetString(flagConfig)
-	localPath, _ := cmd.Flags().GetString(flagSave)
-	ociPath, _ := cmd.Flags().GetString(flagImage)
-	tags, _ := cmd.Flags().GetStringArray(flagTag)
+
+	outputs, err := getExporters(cmd)
+	if err != nil {
+		return err
+	}
+	cacheLimits, err := getCacheLimits(cmd, flagCacheMaxSize, flagCacheMaxAge)
+	if err != nil {
+		return err
+	}
+	ctx, cacheTo, err := withRegistryCache(cmd)
+	if err != nil {
+		return err
+	}
+	fetchOptions, err := getFetchOptions(cmd)
+	if err != nil {
+		return err
+	}
+	ctx = fetch.WithOptions(ctx, fetchOptions)
 
 	// if the platform value exists, then
 	// we should treat it like a multi-arch build
@@ -83,32 +149,177 @@ func build(cmd *cobra.Command, _ []string) error {
 		return err
 	}
 
-	b, err := newBuilder(cmd.Context(), cfg, nil, wd, !platformUnset)
+	compression, _ := cmd.Flags().GetString(flagCompression)
+	layerCompression, err := containers.ParseCompression(compression)
+	if err != nil {
+		return err
+	}
+	compressionLevel, _ := cmd.Flags().GetInt(flagCompressionLevel)
+	recompressBase, _ := cmd.Flags().GetBool(flagRecompressBase)
+	dedupe, _ := cmd.Flags().GetBool(flagDedupe)
+	squashFlag, _ := cmd.Flags().GetString(flagSquash)
+	squash, err := builder.ParseSquash(squashFlag)
 	if err != nil {
 		return err
 	}
-	img, err := b.Build(cmd.Context(), imgPlatform)
+	normaliseFlag, _ := cmd.Flags().GetString(flagNormalise)
+	normalise, err := containers.ParseNormaliseMode(normaliseFlag)
 	if err != nil {
 		return err
 	}
+	keepLayers, _ := cmd.Flags().GetBool(flagKeepLayers)
+	useEstargz, _ := cmd.Flags().GetBool(flagEstargz)
+	prioritisedFiles, _ := cmd.Flags().GetStringArray(flagEstargzPrioritise)
 
-	if localPath != "" {
-		image, ok := img.(v1.Image)
-		if !ok {
-			return fmt.Errorf("cannot save %T to a local file", img)
+	b, err := newBuilder(ctx, cfg, nil, wd, !platformUnset, containers.LayerOptions{
+		Compression:      layerCompression,
+		CompressionLevel: compressionLevel,
+		Estargz:          useEstargz,
+		PrioritisedFiles: prioritisedFiles,
+	}, baseOptions{
+		recompress: recompressBase,
+		dedupe:     dedupe,
+		squash:     squash,
+		normalise:  normalise,
+		keepLayers: keepLayers,
+	})
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	img, err := b.Build(ctx, imgPlatform)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range outputs {
+		// make sure we export the filesystem for the
+		// platform that we just built
+		if r, ok := e.(*exporters.Rootfs); ok && r.Platform == nil {
+			r.Platform = imgPlatform
+		}
+		log.V(1).Info("exporting image", "type", e.Type())
+		if err := e.Export(ctx, img); err != nil {
+			return fmt.Errorf("exporting to %s: %w", e.Type(), err)
 		}
-		return containers.Save(cmd.Context(), image, "image", localPath)
 	}
-	// push all tags
-	for _, t := range tags {
-		if err := containers.Push(cmd.Context(), img, fmt.Sprintf("%s:%s", ociPath, t)); err != nil {
-			return err
+
+	if cacheTo != nil {
+		if err := cacheTo.Export(ctx); err != nil {
+			return fmt.Errorf("exporting cache: %w", err)
+		}
+	}
+
+	// keep the cache under control, but don't
+	// fail the build if we can't
+	if !cacheLimits.IsZero() {
+		if _, err := cache.Prune(cmd.Context(), cache.Dir(), cacheLimits); err != nil {
+			log.Error(err, "failed to prune cache")
+		}
+		if _, err := fetch.PruneDownloads(cmd.Context(), fetchOptions.GetCacheDir(), cacheLimits); err != nil {
+			log.Error(err, "failed to prune download cache")
 		}
 	}
 
 	return nil
 }
 
+// getFetchOptions reads the download options from
+// the environment, allowing flags to override them.
+func getFetchOptions(cmd *cobra.Command) (fetch.Options, error) {
+	opts, err := fetch.OptionsFromEnv()
+	if err != nil {
+		return fetch.Options{}, err
+	}
+	if cmd.Flags().Changed(flagOffline) {
+		opts.Offline, _ = cmd.Flags().GetBool(flagOffline)
+	}
+	if cmd.Flags().Changed(flagFetchRetries) {
+		opts.Retries, _ = cmd.Flags().GetInt(flagFetchRetries)
+	}
+	if cmd.Flags().Changed(flagFetchTimeout) {
+		opts.Timeout, _ = cmd.Flags().GetDuration(flagFetchTimeout)
+	}
+	if v, _ := cmd.Flags().GetString(flagFetchConfig); v != "" {
+		config, err := fetch.ReadConfig(v)
+		if err != nil {
+			return fetch.Options{}, fmt.Errorf("parsing --%s: %w", flagFetchConfig, err)
+		}
+		opts.Hosts = config.Hosts
+	}
+	httpHosts, _ := cmd.Flags().GetStringArray(flagAllowHTTPHost)
+	for _, host := range httpHosts {
+		if opts.Hosts == nil {
+			opts.Hosts = map[string]fetch.HostConfig{}
+		}
+		h := opts.Hosts[host]
+		h.AllowHTTP = true
+		opts.Hosts[host] = h
+	}
+	skipVerifyHosts, _ := cmd.Flags().GetStringArray(flagSkipVerifyHost)
+	for _, host := range skipVerifyHosts {
+		if opts.Hosts == nil {
+			opts.Hosts = map[string]fetch.HostConfig{}
+		}
+		h := opts.Hosts[host]
+		h.InsecureSkipVerify = true
+		opts.Hosts[host] = h
+	}
+	return opts, nil
+}
+
+// getExporters collects the requested outputs from the
+// --output flag as well as the older --save and --image flags.
+func getExporters(cmd *cobra.Command) ([]exporters.Exporter, error) {
+	localPath, _ := cmd.Flags().GetString(flagSave)
+	saveFormat, _ := cmd.Flags().GetString(flagSaveFormat)
+	ociPath, _ := cmd.Flags().GetString(flagImage)
+	tags, _ := cmd.Flags().GetStringArray(flagTag)
+	outputs, _ := cmd.Flags().GetStringArray(flagOutput)
+
+	out, err := parseOutputs(outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	if localPath != "" {
+		switch saveFormat {
+		case saveFormatTarball:
+			out = append(out, &exporters.Tarball{Path: localPath})
+		case saveFormatOCI:
+			out = append(out, &exporters.OCI{Path: localPath, Tags: tags})
+		default:
+			return nil, fmt.Errorf("unsupported save format: %s", saveFormat)
+		}
+	}
+
+	if ociPath != "" {
+		if len(tags) == 0 {
+			return nil, fmt.Errorf("--%s requires at least one --%s", flagImage, flagTag)
+		}
+		refs := make([]string, len(tags))
+		for i, t := range tags {
+			refs[i] = fmt.Sprintf("%s:%s", ociPath, t)
+		}
+		out = append(out, &exporters.Registry{Refs: refs})
+	}
+	return out, nil
+}
+
+// parseOutputs converts the values of the
+// --output flag into exporters.
+func parseOutputs(outputs []string) ([]exporters.Exporter, error) {
+	var out []exporters.Exporter
+	for _, o := range outputs {
+		e, err := exporters.Parse(o)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
 func readConfig(s string) (cbev1.Pipeline, error) {
 	f, err := os.Open(filepath.Clean(s))
 	if err != nil {
@@ -122,9 +333,19 @@ func readConfig(s string) (cbev1.Pipeline, error) {
 	return config, nil
 }
 
+// baseOptions controls how the base
+// image and its layers are handled.
+type baseOptions struct {
+	recompress bool
+	dedupe     bool
+	squash     builder.Squash
+	normalise  containers.NormaliseMode
+	keepLayers bool
+}
+
 // newBuilder converts our cbev1.Pipeline into the underlying pipeline
 // resources.
-func newBuilder(ctx context.Context, pipeline cbev1.Pipeline, statementFinder pipelines.StatementFinder, workingDir string, useIndex bool) (*builder.Builder, error) {
+func newBuilder(ctx context.Context, pipeline cbev1.Pipeline, statementFinder pipelines.StatementFinder, workingDir string, useIndex bool, layerOptions containers.LayerOptions, base baseOptions) (*builder.Builder, error) {
 	// if the user didn't specify a statement finder, we
 	// need to use the default one
 	if statementFinder == nil {
@@ -144,6 +365,14 @@ func newBuilder(ctx context.Context, pipeline cbev1.Pipeline, statementFinder pi
 		}
 	}
 
+	for _, r := range pipeline.Ownership {
+		rule, err := toOwnershipRule(r)
+		if err != nil {
+			return nil, err
+		}
+		layerOptions.Ownership = append(layerOptions.Ownership, rule)
+	}
+
 	return builder.NewBuilder(ctx, pipeline.Base, orderedStatements, builder.Options{
 		WorkingDir:      workingDir,
 		Entrypoint:      pipeline.Config.Entrypoint,
@@ -151,5 +380,36 @@ func newBuilder(ctx context.Context, pipeline cbev1.Pipeline, statementFinder pi
 		ForceEntrypoint: pipeline.Config.OverwriteEntrypoint,
 		FS:              fs.NewMemFS(),
 		GenerateIndex:   useIndex,
+		Layer:           layerOptions,
+		RecompressBase:  base.recompress,
+		Dedupe:          base.dedupe,
+		Squash:          base.squash,
+		Normalise:       base.normalise,
+		KeepLayers:      base.keepLayers,
 	})
 }
+
+// toOwnershipRule converts the pipeline representation of
+// an ownership rule into the one used by the layer writer.
+func toOwnershipRule(r cbev1.OwnershipRule) (containers.OwnershipRule, error) {
+	if r.Path == "" {
+		return containers.OwnershipRule{}, fmt.Errorf("ownership rule is missing a path")
+	}
+	if _, err := path.Match(r.Path, ""); err != nil {
+		return containers.OwnershipRule{}, fmt.Errorf("invalid ownership path '%s': %w", r.Path, err)
+	}
+	rule := containers.OwnershipRule{
+		Pattern: r.Path,
+		Uid:     r.Owner,
+		Gid:     r.Group,
+	}
+	if r.Mode != "" {
+		mode, err := strconv.ParseUint(r.Mode, 8, 32)
+		if err != nil {
+			return containers.OwnershipRule{}, fmt.Errorf("invalid mode '%s' for '%s': %w", r.Mode, r.Path, err)
+		}
+		m := iofs.FileMode(mode) & iofs.ModePerm
+		rule.Mode = &m
+	}
+	return rule, nil
+}
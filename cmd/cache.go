@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers/cache"
+	"github.com/Snakdy/container-build-engine/pkg/fetch"
+	"github.com/Snakdy/container-build-engine/pkg/oci/auth"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "manage the layer and download caches",
+}
+
+var cacheLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list the cached layers and downloads",
+	Args:  cobra.NoArgs,
+	RunE:  cacheLs,
+}
+
+var cacheDuCmd = &cobra.Command{
+	Use:   "du",
+	Short: "show how much space the cache is using",
+	Args:  cobra.NoArgs,
+	RunE:  cacheDu,
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "evict layers and downloads from the cache",
+	Args:  cobra.NoArgs,
+	RunE:  cachePrune,
+}
+
+var cacheVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "check that the cached layers can be read",
+	Args:  cobra.NoArgs,
+	RunE:  cacheVerify,
+}
+
+const (
+	flagCacheFrom    = "cache-from"
+	flagCacheTo      = "cache-to"
+	flagCacheMaxSize = "cache-max-size"
+	flagCacheMaxAge  = "cache-max-age"
+	flagMaxSize      = "max-size"
+	flagMaxAge       = "max-age"
+
+	flagAll    = "all"
+	flagDelete = "delete"
+)
+
+func init() {
+	cachePruneCmd.Flags().String(flagMaxSize, "", "maximum size of each cache (e.g., 10Gi). Defaults to $"+cache.EnvMaxSize)
+	cachePruneCmd.Flags().String(flagMaxAge, "", "evict layers and downloads that haven't been used within this duration (e.g., 7d). Defaults to $"+cache.EnvMaxAge)
+	cachePruneCmd.Flags().Bool(flagAll, false, "evict every layer and download")
+
+	cacheVerifyCmd.Flags().Bool(flagDelete, false, "delete layers that can't be read")
+
+	cacheCmd.AddCommand(cacheLsCmd, cacheDuCmd, cachePruneCmd, cacheVerifyCmd)
+}
+
+// getCacheLimits reads the cache limits from the
+// environment, allowing flags to override them.
+func getCacheLimits(cmd *cobra.Command, sizeFlag, ageFlag string) (cache.Limits, error) {
+	limits, err := cache.LimitsFromEnv()
+	if err != nil {
+		return cache.Limits{}, err
+	}
+	if v, _ := cmd.Flags().GetString(sizeFlag); v != "" {
+		limits.MaxSize, err = cache.ParseSize(v)
+		if err != nil {
+			return cache.Limits{}, fmt.Errorf("parsing --%s: %w", sizeFlag, err)
+		}
+	}
+	if v, _ := cmd.Flags().GetString(ageFlag); v != "" {
+		limits.MaxAge, err = cache.ParseAge(v)
+		if err != nil {
+			return cache.Limits{}, fmt.Errorf("parsing --%s: %w", ageFlag, err)
+		}
+	}
+	return limits, nil
+}
+
+// withRegistryCache configures the layer cache to import from
+// and export to the registries given by the --cache-from and
+// --cache-to flags. The returned RegistryCache must be
+// exported once the build has finished.
+func withRegistryCache(cmd *cobra.Command) (context.Context, *cache.RegistryCache, error) {
+	ctx := cmd.Context()
+	cacheFrom, _ := cmd.Flags().GetStringArray(flagCacheFrom)
+	cacheTo, _ := cmd.Flags().GetString(flagCacheTo)
+	if len(cacheFrom) == 0 && cacheTo == "" {
+		return ctx, nil, nil
+	}
+
+	caches := map[string]*cache.RegistryCache{}
+	getCache := func(ref string) (*cache.RegistryCache, error) {
+		if c, ok := caches[ref]; ok {
+			return c, nil
+		}
+		c, err := cache.NewRegistryCache(ctx, ref, remote.WithAuthFromKeychain(auth.KeyChain(auth.Auth{})))
+		if err != nil {
+			return nil, err
+		}
+		caches[ref] = c
+		return c, nil
+	}
+
+	var from, to []cache.Cache
+	for _, ref := range cacheFrom {
+		c, err := getCache(ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("importing cache: %w", err)
+		}
+		from = append(from, c)
+	}
+	var exporter *cache.RegistryCache
+	if cacheTo != "" {
+		c, err := getCache(cacheTo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("preparing cache export: %w", err)
+		}
+		to = append(to, c)
+		exporter = c
+	}
+	return cache.WithCache(ctx, cache.NewTieredCache(cache.NewFilesystemCache(cache.Dir()), from, to)), exporter, nil
+}
+
+func cacheLs(cmd *cobra.Command, _ []string) error {
+	layers, err := cache.List(cache.Dir())
+	if err != nil {
+		return err
+	}
+	downloads, err := fetch.ListDownloads(cache.DownloadDir())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TYPE\tKEY\tSIZE\tLAST USED")
+	for _, e := range layers {
+		_, _ = fmt.Fprintf(w, "layer\t%s\t%s\t%s\n", e.Key, formatSize(e.Size), e.LastUsed.Format(time.RFC3339))
+	}
+	for _, e := range downloads {
+		_, _ = fmt.Fprintf(w, "download\t%s\t%s\t%s\n", e.Key, formatSize(e.Size), e.LastUsed.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func cacheDu(cmd *cobra.Command, _ []string) error {
+	dir := cache.Dir()
+	layers, err := cache.List(dir)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "%s\t%d layers\t%s\n", formatSize(totalSize(layers)), len(layers), dir)
+
+	dir = cache.DownloadDir()
+	downloads, err := fetch.ListDownloads(dir)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(cmd.OutOrStdout(), "%s\t%d downloads\t%s\n", formatSize(totalSize(downloads)), len(downloads), dir)
+	return err
+}
+
+func cachePrune(cmd *cobra.Command, _ []string) error {
+	limits, err := getCacheLimits(cmd, flagMaxSize, flagMaxAge)
+	if err != nil {
+		return err
+	}
+	all, _ := cmd.Flags().GetBool(flagAll)
+	if !all && limits.IsZero() {
+		return fmt.Errorf("no limits set: use --%s, --%s or --%s", flagMaxSize, flagMaxAge, flagAll)
+	}
+	var layers, downloads []cache.Entry
+	if all {
+		layers, err = cache.Clear(cmd.Context(), cache.Dir())
+	} else {
+		layers, err = cache.Prune(cmd.Context(), cache.Dir(), limits)
+	}
+	if err != nil {
+		return err
+	}
+	if all {
+		downloads, err = fetch.ClearDownloads(cmd.Context(), cache.DownloadDir())
+	} else {
+		downloads, err = fetch.PruneDownloads(cmd.Context(), cache.DownloadDir(), limits)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(cmd.OutOrStdout(), "evicted %d layers (%s) and %d downloads (%s)\n", len(layers), formatSize(totalSize(layers)), len(downloads), formatSize(totalSize(downloads)))
+	return err
+}
+
+// totalSize adds up the size of the entries.
+func totalSize(entries []cache.Entry) int64 {
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	return total
+}
+
+func cacheVerify(cmd *cobra.Command, _ []string) error {
+	results, err := cache.Verify(cmd.Context(), cache.Dir())
+	if err != nil {
+		return err
+	}
+	del, _ := cmd.Flags().GetBool(flagDelete)
+	var corrupt int
+	for _, r := range results {
+		if r.Err == nil {
+			continue
+		}
+		corrupt++
+		_, _ = fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", r.Key, r.Err)
+		if del {
+			if err := cache.NewFilesystemCache(cache.Dir()).Delete(r.Key); err != nil {
+				return fmt.Errorf("deleting %s: %w", r.Key, err)
+			}
+		}
+	}
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "checked %d layers, %d corrupt\n", len(results), corrupt)
+	if corrupt > 0 && !del {
+		return fmt.Errorf("found %d corrupt layers: use --%s to remove them", corrupt, flagDelete)
+	}
+	return nil
+}
+
+// formatSize converts a number of bytes into
+// a human-readable string.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers"
+	"github.com/Snakdy/container-build-engine/pkg/exporters"
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+)
+
+var rebaseCmd = &cobra.Command{
+	Use:   "rebase",
+	Short: "replace the base image of a built image without re-running the pipeline",
+	RunE:  rebase,
+}
+
+const (
+	flagBase    = "base"
+	flagOldBase = "old-base"
+)
+
+func init() {
+	rebaseCmd.Flags().String(flagImage, "", "image to rebase")
+	rebaseCmd.Flags().String(flagBase, "", "new base image")
+	rebaseCmd.Flags().String(flagOldBase, "", "base image that the image was built on. If not set, it's read from the image annotations")
+	rebaseCmd.Flags().String(flagPlatform, "", "platform to select if the image is an index. Only the selected image is rebased and exported")
+	rebaseCmd.Flags().StringArrayP(flagOutput, "o", nil, "output destination (format: type=registry|oci|tarball|rootfs,dest=<path or reference>). May be repeated")
+
+	_ = rebaseCmd.MarkFlagRequired(flagImage)
+	_ = rebaseCmd.MarkFlagRequired(flagBase)
+	_ = rebaseCmd.MarkFlagRequired(flagOutput)
+}
+
+func rebase(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+	log := logr.FromContextOrDiscard(ctx)
+
+	imageRef, _ := cmd.Flags().GetString(flagImage)
+	newBaseRef, _ := cmd.Flags().GetString(flagBase)
+	oldBaseRef, _ := cmd.Flags().GetString(flagOldBase)
+
+	outputFlags, _ := cmd.Flags().GetStringArray(flagOutput)
+	outputs, err := parseOutputs(outputFlags)
+	if err != nil {
+		return err
+	}
+
+	img, imgPlatform, err := getRebaseImage(cmd, imageRef)
+	if err != nil {
+		return err
+	}
+	if oldBaseRef == "" {
+		oldBaseRef, err = containers.BaseImageRef(img)
+		if err != nil {
+			return fmt.Errorf("%w: use --%s to set it", err, flagOldBase)
+		}
+		log.Info("detected old base image", "ref", oldBaseRef)
+	}
+	oldBase, err := containers.GetImage(ctx, oldBaseRef, imgPlatform)
+	if err != nil {
+		return fmt.Errorf("getting old base image: %w", err)
+	}
+	newBase, err := containers.GetImage(ctx, newBaseRef, imgPlatform)
+	if err != nil {
+		return fmt.Errorf("getting new base image: %w", err)
+	}
+	newBaseDigest, err := containers.SourceDigest(newBase)
+	if err != nil {
+		return err
+	}
+
+	rebased, err := containers.RebaseImage(ctx, img, oldBase, newBase)
+	if err != nil {
+		return err
+	}
+	rebased, err = containers.SetBaseAnnotations(rebased, newBaseRef, newBaseDigest)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range outputs {
+		if r, ok := e.(*exporters.Rootfs); ok && r.Platform == nil {
+			r.Platform = imgPlatform
+		}
+		log.V(1).Info("exporting image", "type", e.Type())
+		if err := e.Export(ctx, rebased); err != nil {
+			return fmt.Errorf("exporting to %s: %w", e.Type(), err)
+		}
+	}
+	return nil
+}
+
+// getRebaseImage reads the image to rebase and returns it along
+// with the platform used to select the base images.
+//
+// Only single images can be rebased, so an index must be
+// narrowed down using the platform flag rather than quietly
+// dropping the other platforms.
+func getRebaseImage(cmd *cobra.Command, ref string) (v1.Image, *v1.Platform, error) {
+	ctx := cmd.Context()
+
+	platform, _ := cmd.Flags().GetString(flagPlatform)
+	if platform != "" {
+		imgPlatform, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing platform: %w", err)
+		}
+		img, err := containers.GetImage(ctx, ref, imgPlatform)
+		if err != nil {
+			return nil, nil, err
+		}
+		return img, imgPlatform, nil
+	}
+
+	res, err := containers.Get(ctx, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, ok := res.(v1.Image)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is an index, which can't be rebased: use --%s to rebase one of its images", ref, flagPlatform)
+	}
+	// select the base images that
+	// match the image's platform
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p := cfg.Platform(); p != nil && p.OS != "" && p.Architecture != "" {
+		return img, p, nil
+	}
+	return img, &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, nil
+}
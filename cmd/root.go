@@ -28,6 +28,8 @@ const flagLogLevel = "v"
 func init() {
 	command.PersistentFlags().Int(flagLogLevel, 0, "log level. Higher is more")
 	command.AddCommand(buildCmd)
+	command.AddCommand(rebaseCmd)
+	command.AddCommand(cacheCmd)
 }
 
 func Execute(version string) {
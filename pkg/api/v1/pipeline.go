@@ -6,6 +6,20 @@ type Pipeline struct {
 	Base       string      `json:"base"`
 	Statements []Statement `json:"statements"`
 	Config     Config      `json:"config"`
+	// Ownership overrides the ownership and permissions
+	// of files in the generated layer. Rules are applied
+	// in order, so later rules take precedence.
+	Ownership []OwnershipRule `json:"ownership"`
+}
+
+type OwnershipRule struct {
+	// Path is a glob pattern (e.g. /app/**) that
+	// selects which files the rule applies to.
+	Path  string `json:"path"`
+	Owner *int   `json:"owner,omitempty"`
+	Group *int   `json:"group,omitempty"`
+	// Mode is an octal string (e.g. "0755").
+	Mode string `json:"mode,omitempty"`
 }
 
 type Config struct {
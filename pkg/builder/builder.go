@@ -3,6 +3,7 @@ package builder
 import (
 	"context"
 	"fmt"
+	"os"
 	"path/filepath"
 	"slices"
 	"strings"
@@ -11,10 +12,12 @@ import (
 	cbev1 "github.com/Snakdy/container-build-engine/pkg/api/v1"
 	"github.com/Snakdy/container-build-engine/pkg/containers"
 	"github.com/Snakdy/container-build-engine/pkg/envs"
+	"github.com/Snakdy/container-build-engine/pkg/oci/empty"
 	"github.com/Snakdy/container-build-engine/pkg/pipelines"
 	"github.com/Snakdy/container-build-engine/pkg/pipelines/stategraph"
 	"github.com/Snakdy/container-build-engine/pkg/pipelines/utils"
 	"github.com/Snakdy/container-build-engine/pkg/useradd"
+	"github.com/Snakdy/container-build-engine/pkg/vfs"
 	"github.com/go-logr/logr"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
@@ -63,6 +66,10 @@ func (b *Builder) Build(ctx context.Context, platform *v1.Platform) (containers.
 	var baseImage containers.Result
 	var err error
 
+	if b.options.Normalise != "" {
+		ctx = containers.WithNormaliseMode(ctx, b.options.Normalise)
+	}
+
 	// standard behaviour to ignore multi-arch
 	// and build a single image for the current
 	// platform
@@ -97,12 +104,12 @@ func (b *Builder) buildSingle(ctx context.Context, platform *v1.Platform) (v1.Im
 	// if we've already got the base
 	// image, then we can avoid pulling it again
 	if b.options.BaseImage == nil {
-		baseImage, err = containers.GetImage(ctx, b.baseRef)
-		if err != nil {
-			return nil, err
-		}
+		baseImage, err = containers.GetImage(ctx, b.baseRef, platform)
 	} else {
-		baseImage = b.options.BaseImage.(v1.Image)
+		baseImage, err = containers.ImageForPlatform(ctx, b.options.BaseImage, platform)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return b.buildOne(ctx, baseImage, platform)
 }
@@ -111,57 +118,72 @@ func (b *Builder) buildAll(ctx context.Context, baseIndex v1.ImageIndex, platfor
 	log := logr.FromContextOrDiscard(ctx)
 	log.Info("building index", "platform", platform)
 
-	// vaguely based on the Ko platformMatcher
-	// logic, but not as in-depth since we don't care
-	// about Windows
-	//
-	// https://github.com/ko-build/ko/blob/main/pkg/build/gobuild.go#L1468
-	simplePlatform := v1.Platform{
-		Architecture: platform.Architecture,
-		OS:           platform.OS,
-		OSVersion:    platform.OSVersion,
-		Variant:      platform.Variant,
+	match, err := containers.MatchPlatform(ctx, baseIndex, platform)
+	if err != nil {
+		return nil, err
 	}
 
 	im, err := baseIndex.IndexManifest()
 	if err != nil {
 		return nil, err
 	}
-	var match *v1.Descriptor
+
+	// rebuild the index from scratch so that we
+	// output an OCI index, even if the base was a
+	// Docker manifest list (unless we've been asked
+	// not to normalise it)
+	var adds []mutate.IndexAddendum
 	for _, desc := range im.Manifests {
-		log.V(6).Info("checking descriptor", "platform", desc.Platform, "mediaType", desc.MediaType)
-		if desc.Platform.Satisfies(simplePlatform) {
-			log.V(3).Info("found matching platform", "platform", desc.Platform)
-			match = &desc
-			break
+		if !isPlatformImage(desc) {
+			log.V(3).Info("skipping non-image index entry", "digest", desc.Digest, "platform", desc.Platform, "mediaType", desc.MediaType)
+			continue
+		}
+		baseImage, err := baseIndex.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("extracting image from index: %w", err)
+		}
+		baseImage, err = containers.NormaliseImage(ctx, baseImage)
+		if err != nil {
+			return nil, fmt.Errorf("normalising %s: %w", desc.Platform, err)
 		}
-	}
-	if match == nil {
-		return nil, fmt.Errorf("could not locate index manifest for platform: %s", platform)
-	}
 
-	baseImage, err := baseIndex.Image(match.Digest)
-	if err != nil {
-		return nil, fmt.Errorf("extracting image from index: %w", err)
-	}
+		// build the image as normal
+		if desc.Digest == match.Digest {
+			baseImage, err = b.buildOne(ctx, baseImage, platform)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	// build the image as normal
-	image, err := b.buildOne(ctx, baseImage, platform)
-	if err != nil {
-		return nil, err
+		adds = append(adds, mutate.IndexAddendum{
+			Add: baseImage,
+			Descriptor: v1.Descriptor{
+				URLs:        desc.URLs,
+				Annotations: desc.Annotations,
+				Platform:    desc.Platform,
+			},
+		})
 	}
 
-	add := mutate.IndexAddendum{
-		Add: image,
-		Descriptor: v1.Descriptor{
-			MediaType:   match.MediaType,
-			URLs:        match.URLs,
-			Annotations: match.Annotations,
-			Platform:    match.Platform,
-		},
+	idx := mutate.Annotations(empty.Index, im.Annotations).(v1.ImageIndex)
+	if containers.NormaliseModeFromContext(ctx) == containers.NormaliseNone && im.MediaType != "" {
+		idx = mutate.IndexMediaType(idx, im.MediaType)
 	}
+	return mutate.AppendManifests(idx, adds...), nil
+}
 
-	return mutate.AppendManifests(baseIndex, add), nil
+// isPlatformImage returns true if the descriptor
+// points at an image that is built for a real platform.
+// Attestations and other metadata (e.g. as generated by buildx)
+// use the "unknown/unknown" platform.
+func isPlatformImage(desc v1.Descriptor) bool {
+	if !desc.MediaType.IsImage() {
+		return false
+	}
+	if desc.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+		return false
+	}
+	return desc.Platform != nil && desc.Platform.OS != "unknown" && desc.Platform.Architecture != "unknown"
 }
 
 func (b *Builder) buildOne(ctx context.Context, baseImage v1.Image, platform *v1.Platform) (v1.Image, error) {
@@ -177,12 +199,23 @@ func (b *Builder) buildOne(ctx context.Context, baseImage v1.Image, platform *v1
 		return nil, fmt.Errorf("extracting config: %w", err)
 	}
 	cfg = cfg.DeepCopy()
+	// record the base image so that we can rebase later
+	baseDigest, err := containers.SourceDigest(baseImage)
+	if err != nil {
+		return nil, fmt.Errorf("getting base image digest: %w", err)
+	}
+	// mutate.Canonical rewrites the base image layers,
+	// so the image can only be rebased if we keep them
+	recordBase := b.keepLayers() && b.baseRef != "" && b.baseRef != containers.MagicImageScratch && len(cfg.RootFS.DiffIDs) > 0
 
 	filesystem := b.options.FS
 	if filesystem == nil {
 		filesystem = fs.NewMemFS()
 		log.V(3).Info("creating in-memory virtual filesystem - this may cause memory issues with large builds")
 	}
+	// the apko filesystems don't tell us which files
+	// are hard links, so we need to keep track of them
+	filesystem = vfs.TrackLinks(filesystem)
 
 	buildContext := &pipelines.BuildContext{
 		Context:          ctx,
@@ -210,14 +243,48 @@ func (b *Builder) buildOne(ctx context.Context, baseImage v1.Image, platform *v1
 		return nil, err
 	}
 
-	layer, err := containers.NewLayer(ctx, buildContext.FS, b.options.GetUsername(), b.options.GetUid(), platform)
+	tempDir, err := b.getTempDir()
+	if err != nil {
+		return nil, err
+	}
+	layerOptions := b.options.Layer
+	layerOptions.TempDir = tempDir
+	if b.options.Dedupe {
+		layerOptions.Base, err = containers.IndexImage(ctx, baseImage)
+		if err != nil {
+			return nil, fmt.Errorf("indexing base image: %w", err)
+		}
+	}
+	layer, err := containers.NewLayerWithOptions(ctx, buildContext.FS, b.options.GetUsername(), b.options.GetUid(), platform, layerOptions)
 	if err != nil {
 		return nil, fmt.Errorf("creating layer: %w", err)
 	}
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting layer media type: %w", err)
+	}
+
+	if b.options.RecompressBase {
+		baseImage, err = containers.RecompressImage(ctx, baseImage, layerOptions)
+		if err != nil {
+			return nil, fmt.Errorf("recompressing base image: %w", err)
+		}
+	}
 
 	// convert the base image to OCI format
 	if mt, err := baseImage.MediaType(); err == nil {
 		log.V(1).Info("detected base image media type", "mediaType", mt)
+		// the base wasn't normalised, so our
+		// layer needs to match it
+		if mt == types.DockerManifestSchema2 && containers.NormaliseModeFromContext(ctx) == containers.NormaliseNone {
+			if b.options.Squash == SquashNew {
+				return nil, fmt.Errorf("squashing new layers isn't supported when a Docker base image isn't normalised")
+			}
+			mediaType, err = containers.DockerLayerMediaType(mediaType)
+			if err != nil {
+				return nil, fmt.Errorf("appending to Docker base image: %w", err)
+			}
+		}
 	}
 	// write the config file into the base image so that
 	// appending works later on
@@ -229,7 +296,7 @@ func (b *Builder) buildOne(ctx context.Context, baseImage v1.Image, platform *v1
 	// append our layer
 	log.V(3).Info("appending layer")
 	withData, err := mutate.Append(mutatedBase, mutate.Addendum{
-		MediaType: types.OCILayer,
+		MediaType: mediaType,
 		Layer:     layer,
 		History: v1.History{
 			Author:    b.options.Metadata.Author,
@@ -253,15 +320,114 @@ func (b *Builder) buildOne(ctx context.Context, baseImage v1.Image, platform *v1
 	if err != nil {
 		return nil, fmt.Errorf("mutating config: %w", err)
 	}
+	img, err = b.squash(ctx, img, mutatedBase, layerOptions)
+	if err != nil {
+		return nil, err
+	}
 	// remove any randomness in the build
 	// so that we can reproduce it
-	canonicalImage, err := mutate.Canonical(img)
+	var canonicalImage v1.Image
+	if b.keepLayers() {
+		canonicalImage, err = canonical(img)
+	} else {
+		canonicalImage, err = mutate.Canonical(img)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("generating canonical image: %w", err)
 	}
+	// squashing everything means that
+	// there's nothing left to rebase
+	if recordBase && b.options.Squash != SquashAll {
+		canonicalImage, err = containers.SetBaseAnnotations(canonicalImage, b.baseRef, baseDigest)
+		if err != nil {
+			return nil, fmt.Errorf("annotating base image: %w", err)
+		}
+	}
 	return canonicalImage, nil
 }
 
+// squash merges the layers of the image
+// according to the Squash option.
+func (b *Builder) squash(ctx context.Context, img, baseImage v1.Image, layerOptions containers.LayerOptions) (v1.Image, error) {
+	var from int
+	switch b.options.Squash {
+	case SquashNone:
+		return img, nil
+	case SquashAll:
+		from = 0
+	case SquashNew:
+		layers, err := baseImage.Layers()
+		if err != nil {
+			return nil, fmt.Errorf("getting base image layers: %w", err)
+		}
+		from = len(layers)
+	default:
+		return nil, fmt.Errorf("unsupported squash mode: %s", b.options.Squash)
+	}
+	img, err := containers.SquashImage(ctx, img, from, layerOptions)
+	if err != nil {
+		return nil, fmt.Errorf("squashing image: %w", err)
+	}
+	return img, nil
+}
+
+// keepLayers returns true if the layers of the image must be
+// kept as-is. mutate.Canonical rewrites every layer as a gzipped
+// Docker layer, which loses their media types, compression and
+// annotations, and means that the base layers can't be shared.
+func (b *Builder) keepLayers() bool {
+	return b.options.KeepLayers ||
+		b.options.GenerateIndex ||
+		b.options.RecompressBase ||
+		b.options.Layer.Estargz ||
+		b.options.Layer.GetCompression() != containers.CompressionGzip ||
+		b.options.Normalise == containers.NormaliseNone
+}
+
+// canonical removes timestamps and host-dependent values
+// from the image config. Unlike mutate.Canonical, it doesn't
+// rewrite the layers, so we keep their media types and the
+// base image layers remain shareable.
+func canonical(img v1.Image) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Created = v1.Time{}
+	for i := range cfg.History {
+		cfg.History[i].Created = v1.Time{}
+	}
+	cfg.Container = ""
+	cfg.Config.Hostname = ""
+	cfg.DockerVersion = "" //nolint:staticcheck
+	return mutate.ConfigFile(img, cfg)
+}
+
+// Close removes any temporary files created by the build.
+// It must only be called once the result of Build is no
+// longer needed (e.g., after it has been pushed).
+func (b *Builder) Close() error {
+	if b.tempDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(b.tempDir)
+	b.tempDir = ""
+	return err
+}
+
+func (b *Builder) getTempDir() (string, error) {
+	if b.tempDir != "" {
+		return b.tempDir, nil
+	}
+	dir, err := os.MkdirTemp("", "container-build-engine-layers-*")
+	if err != nil {
+		return "", fmt.Errorf("creating layer directory: %w", err)
+	}
+	b.tempDir = dir
+	return dir, nil
+}
+
 // applyPath sets the PATH environment variable.
 // If the variable already exists, it appends to it
 func (b *Builder) applyPath(cfg *v1.ConfigFile) {
@@ -2,14 +2,20 @@ package builder
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"testing"
 
+	"github.com/Snakdy/container-build-engine/pkg/containers"
 	"github.com/Snakdy/container-build-engine/pkg/pipelines"
 	"github.com/Snakdy/container-build-engine/pkg/vfs"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/logr/testr"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -49,6 +55,246 @@ func TestBuilder_Build(t *testing.T) {
 	}
 }
 
+func TestBuilder_BuildManifestList(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	// assemble a Docker manifest list containing
+	// an attestation like buildx generates
+	var adds []mutate.IndexAddendum
+	for _, p := range []string{"linux/amd64", "linux/arm64", "unknown/unknown"} {
+		img, err := random.Image(64, 1)
+		require.NoError(t, err)
+		platform, err := v1.ParsePlatform(p)
+		require.NoError(t, err)
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: platform},
+		})
+	}
+	baseIndex := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.DockerManifestList), adds...)
+
+	platform, err := v1.ParsePlatform("linux/arm64")
+	require.NoError(t, err)
+
+	builder, err := NewBuilder(ctx, "", nil, Options{
+		WorkingDir:    wd,
+		GenerateIndex: true,
+		BaseImage:     baseIndex,
+		FS:            vfs.NewVFS(t.TempDir()),
+	})
+	require.NoError(t, err)
+	defer builder.Close()
+
+	img, err := builder.Build(ctx, platform)
+	require.NoError(t, err)
+
+	idx, ok := img.(v1.ImageIndex)
+	require.True(t, ok)
+
+	mt, err := idx.MediaType()
+	require.NoError(t, err)
+	assert.EqualValues(t, types.OCIImageIndex, mt)
+
+	im, err := idx.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, im.Manifests, 2)
+	for _, desc := range im.Manifests {
+		assert.EqualValues(t, types.OCIManifestSchema1, desc.MediaType, desc.Platform.String())
+		assert.NotEqual(t, "unknown", desc.Platform.OS)
+	}
+}
+
+func TestBuilder_BuildBaseAnnotations(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	base, err := random.Image(64, 2)
+	require.NoError(t, err)
+	baseDigest, err := base.Digest()
+	require.NoError(t, err)
+
+	platform, err := v1.ParsePlatform("linux/amd64")
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name       string
+		squash     Squash
+		keepLayers bool
+		expected   bool
+	}{
+		{"default", SquashNone, true, true},
+		{"squash new", SquashNew, true, true},
+		{"squash all", SquashAll, true, false},
+		// mutate.Canonical rewrites the base layers
+		{"canonical", SquashNone, false, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := NewBuilder(ctx, "example.com/base:v1", nil, Options{
+				WorkingDir: wd,
+				BaseImage:  base,
+				FS:         vfs.NewVFS(t.TempDir()),
+				Squash:     tt.squash,
+				KeepLayers: tt.keepLayers,
+			})
+			require.NoError(t, err)
+			defer builder.Close()
+
+			img, err := builder.Build(ctx, platform)
+			require.NoError(t, err)
+
+			m, err := img.(v1.Image).Manifest()
+			require.NoError(t, err)
+			if !tt.expected {
+				assert.NotContains(t, m.Annotations, containers.AnnotationBaseImageDigest)
+				return
+			}
+			// the base image layers are left untouched
+			baseManifest, err := base.Manifest()
+			require.NoError(t, err)
+			require.Greater(t, len(m.Layers), len(baseManifest.Layers))
+			for i, l := range baseManifest.Layers {
+				assert.Equal(t, l.Digest, m.Layers[i].Digest)
+			}
+			assert.Equal(t, "example.com/base:v1", m.Annotations[containers.AnnotationBaseImageName])
+			assert.Equal(t, baseDigest.String(), m.Annotations[containers.AnnotationBaseImageDigest])
+		})
+	}
+}
+
+func TestBuilder_BuildCanonical(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	base, err := random.Image(64, 2)
+	require.NoError(t, err)
+	baseManifest, err := base.Manifest()
+	require.NoError(t, err)
+
+	platform, err := v1.ParsePlatform("linux/amd64")
+	require.NoError(t, err)
+
+	for _, keepLayers := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep layers %v", keepLayers), func(t *testing.T) {
+			builder, err := NewBuilder(ctx, "example.com/base:v1", nil, Options{
+				WorkingDir: wd,
+				BaseImage:  base,
+				FS:         vfs.NewVFS(t.TempDir()),
+				Layer:      containers.LayerOptions{Compression: containers.CompressionGzip},
+				KeepLayers: keepLayers,
+			})
+			require.NoError(t, err)
+			defer builder.Close()
+
+			img, err := builder.Build(ctx, platform)
+			require.NoError(t, err)
+
+			cfg, err := img.(v1.Image).ConfigFile()
+			require.NoError(t, err)
+			assert.True(t, cfg.Created.IsZero())
+
+			// by default, the image goes through mutate.Canonical
+			// which rewrites every layer
+			expected, err := mutate.Canonical(base)
+			require.NoError(t, err)
+			if keepLayers {
+				expected = base
+			}
+			expectedManifest, err := expected.Manifest()
+			require.NoError(t, err)
+
+			m, err := img.(v1.Image).Manifest()
+			require.NoError(t, err)
+			require.Len(t, m.Layers, len(baseManifest.Layers)+1)
+			for i, l := range expectedManifest.Layers {
+				assert.Equal(t, l.Digest, m.Layers[i].Digest)
+			}
+		})
+	}
+}
+
+func TestBuilder_BuildNormaliseNone(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	base, err := random.Image(64, 2)
+	require.NoError(t, err)
+	baseType, err := base.MediaType()
+	require.NoError(t, err)
+	require.EqualValues(t, types.DockerManifestSchema2, baseType)
+
+	platform, err := v1.ParsePlatform("linux/amd64")
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name        string
+		compression containers.Compression
+		expected    types.MediaType
+	}{
+		{"gzip", containers.CompressionGzip, types.DockerLayer},
+		{"none", containers.CompressionNone, types.DockerUncompressedLayer},
+		{"zstd", containers.CompressionZstd, ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := NewBuilder(ctx, "example.com/base:v1", nil, Options{
+				WorkingDir: wd,
+				BaseImage:  base,
+				FS:         vfs.NewVFS(t.TempDir()),
+				Layer:      containers.LayerOptions{Compression: tt.compression},
+				Normalise:  containers.NormaliseNone,
+			})
+			require.NoError(t, err)
+			defer builder.Close()
+
+			img, err := builder.Build(ctx, platform)
+			if tt.expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			m, err := img.(v1.Image).Manifest()
+			require.NoError(t, err)
+			assert.EqualValues(t, types.DockerManifestSchema2, m.MediaType)
+			require.Len(t, m.Layers, 3)
+			for _, l := range m.Layers[:2] {
+				assert.EqualValues(t, types.DockerLayer, l.MediaType)
+			}
+			assert.EqualValues(t, tt.expected, m.Layers[2].MediaType)
+		})
+	}
+
+	// squashing only our layers would mix Docker and OCI
+	t.Run("squash new", func(t *testing.T) {
+		builder, err := NewBuilder(ctx, "example.com/base:v1", nil, Options{
+			WorkingDir: wd,
+			BaseImage:  base,
+			FS:         vfs.NewVFS(t.TempDir()),
+			Normalise:  containers.NormaliseNone,
+			Squash:     SquashNew,
+		})
+		require.NoError(t, err)
+		defer builder.Close()
+
+		_, err = builder.Build(ctx, platform)
+		assert.Error(t, err)
+	})
+}
+
 func TestNewBuilderFromStatements(t *testing.T) {
 	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
 
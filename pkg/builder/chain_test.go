@@ -37,8 +37,9 @@ func TestDataChaining(t *testing.T) {
 			DependsOn: []string{"generate-fake-data"},
 		},
 	}, Options{WorkingDir: wd, FS: vfs.NewVFS(t.TempDir())})
-	assert.NoError(t, err)
+	require.NoError(t, err)
 	assert.NotNil(t, builder)
+	defer builder.Close()
 
 	img, err := builder.Build(ctx, platform)
 	assert.NoError(t, err)
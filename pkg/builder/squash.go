@@ -0,0 +1,31 @@
+package builder
+
+import "fmt"
+
+// Squash controls which layers of the
+// final image are merged together.
+type Squash string
+
+const (
+	// SquashNone keeps every layer.
+	SquashNone Squash = ""
+	// SquashAll merges the base image layers and
+	// the generated layer into a single layer.
+	SquashAll Squash = "all"
+	// SquashNew merges only the layers that
+	// were added on top of the base image.
+	SquashNew Squash = "new"
+)
+
+// ParseSquash converts a string into a Squash
+// and returns an error if it's not supported.
+func ParseSquash(s string) (Squash, error) {
+	switch v := Squash(s); v {
+	case SquashNone, SquashAll, SquashNew:
+		return v, nil
+	case "none":
+		return SquashNone, nil
+	default:
+		return "", fmt.Errorf("unsupported squash mode: %s", s)
+	}
+}
@@ -10,6 +10,9 @@ type Builder struct {
 	baseRef    string
 	options    Options
 	statements []pipelines.PipelineStatement
+	// tempDir holds the layers that we've generated.
+	// It's removed by Close.
+	tempDir string
 }
 
 type Options struct {
@@ -34,6 +37,30 @@ type Options struct {
 	// a multi-arch index instead of a standalone
 	// image.
 	GenerateIndex bool
+	// Layer controls how the generated layer is
+	// compressed.
+	Layer containers.LayerOptions
+	// RecompressBase instructs the builder to recompress
+	// the layers of the base image so that they match
+	// the compression of the generated layer.
+	RecompressBase bool
+	// Dedupe instructs the builder to leave files
+	// out of the generated layer if they're
+	// identical to those in the base image.
+	Dedupe bool
+	// Squash merges the layers of the final image
+	// into a single layer.
+	Squash Squash
+	// Normalise controls how the base image is
+	// converted to OCI format. If a Docker base isn't
+	// normalised, the image is built as a Docker image.
+	Normalise containers.NormaliseMode
+	// KeepLayers removes timestamps from the image without
+	// rewriting its layers, so that the base image layers
+	// are shared with the base image and the image can be
+	// rebased. Index builds, eStargz layers and options that
+	// change the media types of the layers imply it.
+	KeepLayers bool
 }
 
 type MetadataOptions struct {
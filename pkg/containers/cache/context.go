@@ -0,0 +1,20 @@
+package cache
+
+import "context"
+
+type contextKey struct{}
+
+// WithCache returns a context that
+// carries the given Cache.
+func WithCache(ctx context.Context, c Cache) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the Cache in the context, or
+// the filesystem cache in Dir if there isn't one.
+func FromContext(ctx context.Context) Cache {
+	if c, ok := ctx.Value(contextKey{}).(Cache); ok {
+		return c
+	}
+	return NewFilesystemCache(Dir())
+}
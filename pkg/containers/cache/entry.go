@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+)
+
+var ErrCorrupt = errors.New("cache entry is corrupt")
+
+const (
+	// tempPrefix is used for layers that are
+	// still being written.
+	tempPrefix = ".tmp-"
+	// lockDir holds the lock files used
+	// to serialise writers.
+	lockDir = ".locks"
+	// metadataSuffix is appended to the
+	// path of a layer to get its metadata.
+	metadataSuffix = ".json"
+)
+
+// metadata is stored alongside each layer so
+// that we can tell whether it has been corrupted.
+type metadata struct {
+	// Digest is the sha256 of the file,
+	// which may be compressed.
+	Digest v1.Hash `json:"digest"`
+	Size   int64   `json:"size"`
+}
+
+// writeMetadata atomically writes the metadata
+// for the layer at the given path.
+func writeMetadata(path string, m metadata) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path+metadataSuffix)
+}
+
+// readMetadata reads the metadata for the
+// layer at the given path.
+func readMetadata(path string) (metadata, error) {
+	var m metadata
+	data, err := os.ReadFile(path + metadataSuffix)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("%w: reading metadata: %w", ErrCorrupt, err)
+	}
+	return m, nil
+}
+
+// checkFile checks that the layer at the given path has
+// the size that was recorded when it was written. This is
+// cheap enough to do whenever the layer is read, and catches
+// layers that were truncated. Use verifyFile to check the
+// content as well.
+func checkFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	m, err := readMetadata(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() != m.Size {
+		return fmt.Errorf("%w: expected %d bytes but got %d", ErrCorrupt, m.Size, info.Size())
+	}
+	return nil
+}
+
+// verifyFile checks that the layer at the given path
+// matches the digest that was recorded when it was
+// written. Layers written by older versions don't
+// have any metadata, so they can't be checked.
+func verifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, err := readMetadata(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	digest, size, err := v1.SHA256(f)
+	if err != nil {
+		return err
+	}
+	if size != m.Size {
+		return fmt.Errorf("%w: expected %d bytes but got %d", ErrCorrupt, m.Size, size)
+	}
+	if digest != m.Digest {
+		return fmt.Errorf("%w: expected digest %s but got %s", ErrCorrupt, m.Digest, digest)
+	}
+	return nil
+}
+
+// removeEntry deletes a layer and its metadata.
+func removeEntry(path string) error {
+	err := os.Remove(path)
+	_ = os.Remove(path + metadataSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache.ErrNotFound
+	}
+	return err
+}
+
+// lock takes an exclusive lock for the given key
+// and returns a function that releases it.
+func lock(path string, key v1.Hash) (func(), error) {
+	return Lock(path, filepath.Base(cachepath(path, key)))
+}
+
+// Lock takes an exclusive lock on the named entry in the
+// cache directory and returns a function that releases it.
+// It blocks until any other process holding the lock
+// releases it.
+func Lock(dir, name string) (func(), error) {
+	dir = filepath.Join(dir, lockDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name+".lock")
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		// lock files are removed when they aren't in
+		// use, so make sure that nobody removed this
+		// one while we were waiting for it
+		if sameFile(f, path) {
+			// closing the file releases the lock
+			return func() {
+				_ = f.Close()
+			}, nil
+		}
+		_ = f.Close()
+	}
+}
+
+// sameFile returns true if the open file is
+// still the one at the given path.
+func sameFile(f *os.File, path string) bool {
+	a, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(a, b)
+}
+
+// removeLocks deletes the lock files in the cache
+// directory that aren't held by anybody.
+func removeLocks(ctx context.Context, dir string) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	dir = filepath.Join(dir, lockDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".lock") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		lf, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		// a lock file can only be removed while we
+		// hold it, otherwise another process could be
+		// left holding a lock that nobody else can see
+		if ok, err := tryLockFile(lf); err == nil && ok && sameFile(lf, path) {
+			log.V(3).Info("removing unused lock file", "name", f.Name())
+			_ = os.Remove(path)
+		}
+		_ = lf.Close()
+	}
+}
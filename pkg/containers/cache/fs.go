@@ -1,14 +1,17 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/cache"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
 )
 
 // fscache is a modification of the Crane cache
@@ -27,9 +30,31 @@ func NewFilesystemCache(path string) Cache {
 	}
 }
 
+// Put writes the layer into the cache.
+//
+// The layer is written to a temporary file and then renamed
+// so that a build that is killed part way through never
+// leaves a truncated layer behind. Writers of the same key
+// are serialised using a lock file so that concurrent builds
+// don't do the same work twice.
 func (fs *fscache) Put(key v1.Hash, layer v1.Layer, compressed bool) (v1.Layer, error) {
+	if err := os.MkdirAll(fs.path, 0700); err != nil {
+		return nil, fmt.Errorf("preparing fs: %w", err)
+	}
+	unlock, err := lock(fs.path, key)
+	if err != nil {
+		return nil, fmt.Errorf("locking cache entry: %w", err)
+	}
+	defer unlock()
+
+	// another build may have written the
+	// layer while we were waiting
+	path := cachepath(fs.path, key)
+	if _, err := os.Stat(path); err == nil {
+		return layer, nil
+	}
+
 	var rc io.ReadCloser
-	var err error
 	if compressed {
 		rc, err = layer.Compressed()
 	} else {
@@ -38,55 +63,115 @@ func (fs *fscache) Put(key v1.Hash, layer v1.Layer, compressed bool) (v1.Layer,
 	if err != nil {
 		return nil, fmt.Errorf("reading layer: %w", err)
 	}
-	// create the file
-	w, err := create(fs.path, key)
+	defer rc.Close()
+
+	// copy the layer into a temporary file,
+	// recording its digest as we go
+	f, err := os.CreateTemp(fs.path, tempPrefix+"*")
 	if err != nil {
 		return nil, fmt.Errorf("preparing fs: %w", err)
 	}
-	defer w.Close()
-	// copy the layer into the file
-	_, err = io.Copy(w, rc)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), rc)
 	if err != nil {
 		return nil, fmt.Errorf("writing layer: %w", err)
 	}
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("writing layer: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("writing layer: %w", err)
+	}
+
+	// the metadata is written first so that
+	// the layer is never visible without it
+	if err := writeMetadata(path, metadata{
+		Digest: v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))},
+		Size:   size,
+	}); err != nil {
+		return nil, fmt.Errorf("writing metadata: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, fmt.Errorf("committing layer: %w", err)
+	}
 	return layer, nil
 }
 
+// Get reads a layer from the cache. The size of the layer is
+// checked against the size that was recorded when it was
+// written straight away. The content is checked against the
+// digest as the layer is read, since hashing it up front
+// would mean reading large layers twice. Corrupt layers fail
+// to read and are evicted so that they're fetched again.
 func (fs *fscache) Get(hash v1.Hash) (v1.Layer, error) {
 	path := cachepath(fs.path, hash)
+	// make sure that the layer hasn't been
+	// truncated since we wrote it
+	if err := checkFile(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, cache.ErrNotFound
+		}
+		if errors.Is(err, ErrCorrupt) {
+			if err := fs.Delete(hash); err != nil {
+				return nil, err
+			}
+			return nil, cache.ErrNotFound
+		}
+		return nil, err
+	}
 	// try to read the layer from a file
-	l, err := tarball.LayerFromFile(path)
+	l, err := layerFromFile(path, func() {
+		_ = fs.Delete(hash)
+	})
 	if os.IsNotExist(err) {
 		return nil, cache.ErrNotFound
 	}
 	// if it's somehow corrupt, delete it
 	// so we can fix it next time around
-	if errors.Is(err, io.ErrUnexpectedEOF) {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrCorrupt) {
 		if err := fs.Delete(hash); err != nil {
 			return nil, err
 		}
 		return nil, cache.ErrNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
+	// record that we've used the layer so that
+	// it's the last to be evicted
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
 	return l, nil
 }
 
 func (fs *fscache) Delete(hash v1.Hash) error {
-	if err := os.Remove(cachepath(fs.path, hash)); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return cache.ErrNotFound
-		}
-		return err
-	}
-	return nil
+	return removeEntry(cachepath(fs.path, hash))
 }
 
-const layerDir = "cbe"
+const (
+	layerDir    = "cbe"
+	downloadDir = "cbe-downloads"
+)
 
 // Dir attempts to find a directory that we can store the
 // cached layers in.
 // It will try the XDG_CACHE_HOME first, followed by ~/.cache
 // and finally TMPDIR or /tmp
 func Dir() string {
+	return cacheDir(layerDir)
+}
+
+// DownloadDir returns the directory that downloaded
+// files are cached in. It sits next to Dir.
+func DownloadDir() string {
+	return cacheDir(downloadDir)
+}
+
+func cacheDir(name string) string {
 	cacheHome := os.Getenv("XDG_CACHE_HOME")
 	if cacheHome == "" {
 		home, err := os.UserHomeDir()
@@ -95,7 +180,7 @@ func Dir() string {
 		}
 		cacheHome = filepath.Join(home, ".cache")
 	}
-	cacheHome = filepath.Join(cacheHome, layerDir)
+	cacheHome = filepath.Join(cacheHome, name)
 	_ = os.MkdirAll(cacheHome, 0750)
 	return cacheHome
 }
@@ -0,0 +1,336 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tempFiles returns the names of any
+// temporary files left in the directory.
+func tempFiles(t *testing.T, dir string) []string {
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var out []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), tempPrefix) {
+			out = append(out, f.Name())
+		}
+	}
+	return out
+}
+
+func TestFscache_Put(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	layer, err := random.Layer(1024, types.OCILayer)
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+
+	_, err = c.Put(diffID, layer, true)
+	require.NoError(t, err)
+
+	m, err := readMetadata(cachepath(dir, diffID))
+	require.NoError(t, err)
+	digest, err := layer.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, digest, m.Digest)
+	assert.Empty(t, tempFiles(t, dir))
+
+	l, err := c.Get(diffID)
+	require.NoError(t, err)
+	actual, err := l.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, digest, actual)
+}
+
+func TestFscache_PutConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	layer, err := random.Layer(1<<20, types.OCILayer)
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = c.Put(diffID, layer, true)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, tempFiles(t, dir))
+
+	l, err := c.Get(diffID)
+	require.NoError(t, err)
+	actual, err := l.DiffID()
+	require.NoError(t, err)
+	assert.Equal(t, diffID, actual)
+}
+
+// failingLayer is a layer that can't be read
+// all the way through (e.g., the network dropped).
+type failingLayer struct {
+	v1.Layer
+}
+
+func (l *failingLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(io.LimitReader(rc, 100), &errReader{}), rc}, nil
+}
+
+type errReader struct{}
+
+func (*errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestFscache_PutFailed(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	layer, err := random.Layer(1024, types.OCILayer)
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+
+	_, err = c.Put(diffID, &failingLayer{Layer: layer}, true)
+	assert.Error(t, err)
+
+	// nothing is left behind
+	assert.Empty(t, tempFiles(t, dir))
+	_, err = c.Get(diffID)
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+}
+
+func TestFscache_GetCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	layer, err := random.Layer(1024, types.OCILayer)
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+	_, err = c.Put(diffID, layer, true)
+	require.NoError(t, err)
+
+	// truncate the layer
+	path := cachepath(dir, diffID)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()/2))
+
+	_, err = c.Get(diffID)
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+
+	// the corrupt entry has been evicted
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(path + metadataSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFscache_GetCorruptContent(t *testing.T) {
+	var cases = []struct {
+		name       string
+		compressed bool
+		mediaType  types.MediaType
+		read       func(l v1.Layer) (io.ReadCloser, error)
+	}{
+		{
+			"compressed",
+			true,
+			types.OCILayer,
+			v1.Layer.Compressed,
+		},
+		{
+			"decompressed",
+			true,
+			types.OCILayer,
+			v1.Layer.Uncompressed,
+		},
+		{
+			"uncompressed",
+			false,
+			types.OCIUncompressedLayer,
+			v1.Layer.Uncompressed,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := NewFilesystemCache(dir)
+
+			layer, err := random.Layer(1024, tt.mediaType)
+			require.NoError(t, err)
+			diffID, err := layer.DiffID()
+			require.NoError(t, err)
+			_, err = c.Put(diffID, layer, tt.compressed)
+			require.NoError(t, err)
+
+			// flip a byte without changing the size
+			path := cachepath(dir, diffID)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			data[len(data)/2] ^= 0xff
+			require.NoError(t, os.WriteFile(path, data, 0600))
+
+			l, err := c.Get(diffID)
+			require.NoError(t, err)
+
+			// the corruption is noticed when
+			// the layer is read...
+			rc, err := tt.read(l)
+			require.NoError(t, err)
+			_, err = io.Copy(io.Discard, rc)
+			assert.Error(t, err)
+			_ = rc.Close()
+
+			// ...and the entry is evicted
+			_, err = os.Stat(path)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+			_, err = c.Get(diffID)
+			assert.ErrorIs(t, err, cache.ErrNotFound)
+		})
+	}
+}
+
+func TestFscache_GetVerified(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	layer, err := random.Layer(1024, types.OCILayer)
+	require.NoError(t, err)
+	digest, err := layer.Digest()
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+	_, err = c.Put(diffID, layer, true)
+	require.NoError(t, err)
+
+	l, err := c.Get(diffID)
+	require.NoError(t, err)
+	rc, err := l.Compressed()
+	require.NoError(t, err)
+	actual, _, err := v1.SHA256(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, digest, actual)
+
+	actualDiffID, err := l.DiffID()
+	require.NoError(t, err)
+	assert.Equal(t, diffID, actualDiffID)
+}
+
+func TestFscache_GetUncompressed(t *testing.T) {
+	layer, err := random.Layer(1024, types.OCIUncompressedLayer)
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+
+	t.Run("valid", func(t *testing.T) {
+		dir := t.TempDir()
+		c := NewFilesystemCache(dir)
+		_, err := c.Put(diffID, layer, false)
+		require.NoError(t, err)
+
+		l, err := c.Get(diffID)
+		require.NoError(t, err)
+		actual, err := l.DiffID()
+		require.NoError(t, err)
+		assert.Equal(t, diffID, actual)
+	})
+
+	var cases = []struct {
+		name     string
+		content  []byte
+		metadata bool
+	}{
+		{
+			"empty",
+			nil,
+			false,
+		},
+		{
+			"truncated header",
+			[]byte("not a tar"),
+			false,
+		},
+		{
+			"same size",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := NewFilesystemCache(dir)
+			_, err := c.Put(diffID, layer, false)
+			require.NoError(t, err)
+
+			path := cachepath(dir, diffID)
+			content := tt.content
+			if tt.metadata {
+				// overwrite the layer with garbage that
+				// passes the size check
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				content = []byte(strings.Repeat("x", int(info.Size())))
+			} else {
+				require.NoError(t, os.Remove(path+metadataSuffix))
+			}
+			require.NoError(t, os.WriteFile(path, content, 0600))
+
+			_, err = c.Get(diffID)
+			assert.ErrorIs(t, err, cache.ErrNotFound)
+
+			// the corrupt entry has been evicted
+			_, err = os.Stat(path)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func TestFscache_GetWithoutMetadata(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	layer, err := random.Layer(1024, types.OCILayer)
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+	_, err = c.Put(diffID, layer, true)
+	require.NoError(t, err)
+
+	// layers written by older versions
+	// can still be read
+	require.NoError(t, os.Remove(cachepath(dir, diffID)+metadataSuffix))
+	_, err = c.Get(diffID)
+	assert.NoError(t, err)
+}
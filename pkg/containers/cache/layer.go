@@ -1,21 +1,25 @@
 package cache
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/google/go-containerregistry/pkg/compression"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 )
 
-func create(path string, h v1.Hash) (io.WriteCloser, error) {
-	if err := os.MkdirAll(path, 0700); err != nil {
-		return nil, err
-	}
-	return os.Create(cachepath(path, h))
-}
-
 func cachepath(path string, h v1.Hash) string {
 	file := h.String()
 	if runtime.GOOS == "windows" {
@@ -23,3 +27,286 @@ func cachepath(path string, h v1.Hash) string {
 	}
 	return filepath.Join(path, file)
 }
+
+// tarBlockSize is the size of a tar header.
+const tarBlockSize = 512
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// layerFromFile reads a cached layer and sets the
+// OCI media type based on how the file is compressed.
+//
+// The digest and size are taken from the metadata, and
+// the content is checked against them as it's read. If
+// it doesn't match, reading fails and onCorrupt (if set)
+// is called so that the entry can be evicted.
+func layerFromFile(path string, onCorrupt func()) (v1.Layer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(f, header)
+	_ = f.Close()
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	header = header[:n]
+
+	// anything that isn't compressed must be a tar, otherwise
+	// it's probably an empty or truncated file
+	if !bytes.HasPrefix(header, gzipMagic) && !bytes.HasPrefix(header, zstdMagic) {
+		if err := checkTar(path); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := readMetadata(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// layers written by older versions
+		// need to be hashed up front
+		switch {
+		case bytes.HasPrefix(header, gzipMagic):
+			return tarball.LayerFromFile(path, tarball.WithMediaType(types.OCILayer))
+		case bytes.HasPrefix(header, zstdMagic):
+			return tarball.LayerFromFile(path, tarball.WithMediaType(types.OCILayerZStd), tarball.WithCompression(compression.ZStd))
+		default:
+			return newUncompressedLayer(path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return newCompressedLayer(path, m, types.OCILayer, onCorrupt)
+	case bytes.HasPrefix(header, zstdMagic):
+		return newCompressedLayer(path, m, types.OCILayerZStd, onCorrupt)
+	default:
+		return &uncompressedLayer{
+			path:      path,
+			digest:    m.Digest,
+			size:      m.Size,
+			verify:    true,
+			onCorrupt: onCorrupt,
+		}, nil
+	}
+}
+
+// checkTar makes sure that the file starts with
+// a valid tar header.
+func checkTar(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	block := make([]byte, tarBlockSize)
+	if _, err := io.ReadFull(f, block); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: not a tar archive", ErrCorrupt)
+		}
+		return err
+	}
+	// an empty archive starts with a zero block
+	if bytes.Equal(block, make([]byte, tarBlockSize)) {
+		return nil
+	}
+	if _, err := tar.NewReader(bytes.NewReader(block)).Next(); err != nil {
+		return fmt.Errorf("%w: not a tar archive: %w", ErrCorrupt, err)
+	}
+	return nil
+}
+
+// compressedLayer is a v1.Layer that is stored with
+// gzip or zstd compression.
+type compressedLayer struct {
+	path      string
+	digest    v1.Hash
+	size      int64
+	mediaType types.MediaType
+	diffID    func() (v1.Hash, error)
+	onCorrupt func()
+}
+
+func newCompressedLayer(path string, m metadata, mediaType types.MediaType, onCorrupt func()) (v1.Layer, error) {
+	cl := &compressedLayer{
+		path:      path,
+		digest:    m.Digest,
+		size:      m.Size,
+		mediaType: mediaType,
+		onCorrupt: onCorrupt,
+	}
+	// the partial package decompresses
+	// the layer based on its content
+	l, err := partial.CompressedToLayer(cl)
+	if err != nil {
+		return nil, err
+	}
+	cl.diffID = sync.OnceValues(func() (v1.Hash, error) {
+		rc, err := l.Uncompressed()
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		defer rc.Close()
+		h, _, err := v1.SHA256(rc)
+		return h, err
+	})
+	return l, nil
+}
+
+func (l *compressedLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *compressedLayer) DiffID() (v1.Hash, error) {
+	return l.diffID()
+}
+
+func (l *compressedLayer) Compressed() (io.ReadCloser, error) {
+	return openVerified(l.path, l.digest, l.size, l.onCorrupt)
+}
+
+func (l *compressedLayer) Size() (int64, error) {
+	return l.size, nil
+}
+
+func (l *compressedLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+// uncompressedLayer is a v1.Layer that is stored
+// without any compression. We can't use the tarball
+// package as it will always compress the data.
+type uncompressedLayer struct {
+	path   string
+	digest v1.Hash
+	size   int64
+	// verify is set if the digest came from the
+	// metadata rather than hashing the file
+	verify    bool
+	onCorrupt func()
+}
+
+func newUncompressedLayer(path string) (*uncompressedLayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	digest, size, err := v1.SHA256(f)
+	if err != nil {
+		return nil, err
+	}
+	return &uncompressedLayer{
+		path:   path,
+		digest: digest,
+		size:   size,
+	}, nil
+}
+
+func (l *uncompressedLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *uncompressedLayer) DiffID() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *uncompressedLayer) Compressed() (io.ReadCloser, error) {
+	return l.open()
+}
+
+func (l *uncompressedLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.open()
+}
+
+func (l *uncompressedLayer) open() (io.ReadCloser, error) {
+	if !l.verify {
+		return os.Open(l.path)
+	}
+	return openVerified(l.path, l.digest, l.size, l.onCorrupt)
+}
+
+func (l *uncompressedLayer) Size() (int64, error) {
+	return l.size, nil
+}
+
+func (l *uncompressedLayer) MediaType() (types.MediaType, error) {
+	return types.OCIUncompressedLayer, nil
+}
+
+// openVerified opens the file and checks that its content
+// matches the digest and size as it's read.
+func openVerified(path string, digest v1.Hash, size int64, onCorrupt func()) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{
+		f:         f,
+		h:         sha256.New(),
+		digest:    digest,
+		size:      size,
+		onCorrupt: onCorrupt,
+	}, nil
+}
+
+// verifyingReader hashes the file as it's read and fails
+// once it has read as many bytes as the file should have
+// if the digest doesn't match. Checking when the size is
+// reached, rather than at EOF, means that readers that
+// don't read past the end of their data are covered.
+type verifyingReader struct {
+	f         *os.File
+	h         hash.Hash
+	digest    v1.Hash
+	size      int64
+	n         int64
+	onCorrupt func()
+	err       error
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.f.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	switch {
+	case r.n > r.size:
+		r.fail(fmt.Errorf("%w: expected %d bytes but got more", ErrCorrupt, r.size))
+	case r.n == r.size && n > 0:
+		if actual := hex.EncodeToString(r.h.Sum(nil)); actual != r.digest.Hex {
+			r.fail(fmt.Errorf("%w: expected digest %s but got sha256:%s", ErrCorrupt, r.digest, actual))
+		}
+	case errors.Is(err, io.EOF) && r.n < r.size:
+		r.fail(fmt.Errorf("%w: expected %d bytes but got %d", ErrCorrupt, r.size, r.n))
+	}
+	if r.err != nil {
+		return n, r.err
+	}
+	return n, err
+}
+
+func (r *verifyingReader) fail(err error) {
+	r.err = err
+	if r.onCorrupt != nil {
+		r.onCorrupt()
+	}
+}
+
+// Close checks the rest of the file if it wasn't read to
+// the end, so that corruption which made the caller stop
+// early (e.g., a decompression error) still evicts it.
+func (r *verifyingReader) Close() error {
+	if r.err == nil && r.n < r.size {
+		_, _ = io.Copy(io.Discard, r)
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package cache
+
+import "os"
+
+// lockFile is not supported on this platform, so
+// concurrent writers rely on the atomic rename alone.
+func lockFile(*os.File) error {
+	return nil
+}
+
+// tryLockFile is not supported on this platform, so
+// the lock is always available.
+func tryLockFile(*os.File) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,276 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Environment variables used to configure
+// the cache limits.
+const (
+	EnvMaxSize = "CBE_CACHE_MAX_SIZE"
+	EnvMaxAge  = "CBE_CACHE_MAX_AGE"
+)
+
+// Entry describes a layer in the cache.
+type Entry struct {
+	Key  v1.Hash
+	Path string
+	Size int64
+	// LastUsed is the last time that the
+	// layer was written or read.
+	LastUsed time.Time
+}
+
+// Limits controls which entries are evicted
+// when the cache is pruned.
+type Limits struct {
+	// MaxSize is the maximum total size of the cache
+	// in bytes. The least recently used entries are
+	// evicted first. Zero means that there is no limit.
+	MaxSize int64
+	// MaxAge evicts entries that haven't been used
+	// within the duration. Zero means that there is
+	// no limit.
+	MaxAge time.Duration
+}
+
+// IsZero returns true if there are no limits.
+func (l Limits) IsZero() bool {
+	return l.MaxSize <= 0 && l.MaxAge <= 0
+}
+
+// LimitsFromEnv reads the cache limits from
+// the environment.
+func LimitsFromEnv() (Limits, error) {
+	var limits Limits
+	var err error
+	if v := os.Getenv(EnvMaxSize); v != "" {
+		limits.MaxSize, err = ParseSize(v)
+		if err != nil {
+			return Limits{}, fmt.Errorf("parsing %s: %w", EnvMaxSize, err)
+		}
+	}
+	if v := os.Getenv(EnvMaxAge); v != "" {
+		limits.MaxAge, err = ParseAge(v)
+		if err != nil {
+			return Limits{}, fmt.Errorf("parsing %s: %w", EnvMaxAge, err)
+		}
+	}
+	return limits, nil
+}
+
+// ParseSize converts a size (e.g., "10Gi" or "500M")
+// into bytes.
+func ParseSize(s string) (int64, error) {
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0, err
+	}
+	return q.Value(), nil
+}
+
+// ParseAge converts a duration into a time.Duration.
+// In addition to the units supported by time.ParseDuration,
+// it accepts a number of days (e.g., "7d").
+func ParseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// List returns the layers in the cache directory, with
+// the most recently used first.
+func List(dir string) ([]Entry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []Entry
+	for _, f := range files {
+		if !f.Type().IsRegular() {
+			continue
+		}
+		key, ok := parseCachePath(f.Name())
+		if !ok {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			// it was probably removed by
+			// another process
+			continue
+		}
+		entries = append(entries, Entry{
+			Key:      key,
+			Path:     filepath.Join(dir, f.Name()),
+			Size:     info.Size(),
+			LastUsed: info.ModTime(),
+		})
+	}
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return b.LastUsed.Compare(a.LastUsed)
+	})
+	return entries, nil
+}
+
+// parseCachePath is the inverse of cachepath.
+func parseCachePath(name string) (v1.Hash, bool) {
+	if runtime.GOOS == "windows" {
+		name = strings.Replace(name, "-", ":", 1)
+	}
+	h, err := v1.NewHash(name)
+	if err != nil {
+		return v1.Hash{}, false
+	}
+	return h, true
+}
+
+// Prune evicts entries from the cache until it
+// satisfies the limits, and returns the evicted entries.
+func Prune(ctx context.Context, dir string, limits Limits) ([]Entry, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("dir", dir)
+
+	entries, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var evicted []Entry
+	var total int64
+	now := time.Now()
+	for _, e := range entries {
+		// entries are sorted by when they were last
+		// used, so we keep the newest until we hit
+		// the limit
+		expired := limits.MaxAge > 0 && now.Sub(e.LastUsed) > limits.MaxAge
+		tooBig := limits.MaxSize > 0 && total+e.Size > limits.MaxSize
+		if !expired && !tooBig {
+			total += e.Size
+			continue
+		}
+		log.V(3).Info("evicting cache entry", "key", e.Key, "size", e.Size, "lastUsed", e.LastUsed, "expired", expired)
+		if err := removeEntry(e.Path); err != nil && !errors.Is(err, cache.ErrNotFound) {
+			return evicted, fmt.Errorf("removing %s: %w", e.Key, err)
+		}
+		evicted = append(evicted, e)
+	}
+	RemoveStaleFiles(ctx, dir)
+	log.V(1).Info("pruned cache", "evicted", len(evicted), "remaining", len(entries)-len(evicted), "size", total)
+	return evicted, nil
+}
+
+// staleAge is how long a temporary file can exist before we
+// assume that the build writing it was killed.
+const staleAge = time.Hour
+
+// RemoveStaleFiles deletes temporary files that were left
+// behind by builds that didn't finish, and lock files that
+// aren't in use.
+func RemoveStaleFiles(ctx context.Context, dir string) {
+	log := logr.FromContextOrDiscard(ctx)
+	now := time.Now()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), tempPrefix) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil || now.Sub(info.ModTime()) < staleAge {
+			continue
+		}
+		log.V(3).Info("removing stale temporary file", "name", f.Name())
+		_ = os.Remove(filepath.Join(dir, f.Name()))
+	}
+	removeLocks(ctx, dir)
+}
+
+// Clear evicts every entry from the cache.
+func Clear(ctx context.Context, dir string) ([]Entry, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("dir", dir)
+
+	entries, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if err := removeEntry(e.Path); err != nil && !errors.Is(err, cache.ErrNotFound) {
+			return entries[:i], fmt.Errorf("removing %s: %w", e.Key, err)
+		}
+	}
+	RemoveStaleFiles(ctx, dir)
+	log.V(1).Info("cleared cache", "evicted", len(entries))
+	return entries, nil
+}
+
+// VerifyResult is the result of checking a single cache entry.
+type VerifyResult struct {
+	Entry
+	// Err is set if the entry could not be read.
+	Err error
+}
+
+// Verify reads every layer in the cache to make sure
+// that it matches the digest recorded when it was
+// written and that it can be decompressed.
+func Verify(ctx context.Context, dir string) ([]VerifyResult, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("dir", dir)
+
+	entries, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]VerifyResult, len(entries))
+	for i, e := range entries {
+		results[i] = VerifyResult{Entry: e, Err: verifyEntry(e)}
+		if results[i].Err != nil {
+			log.V(1).Info("found corrupt cache entry", "key", e.Key, "error", results[i].Err)
+		}
+	}
+	return results, nil
+}
+
+func verifyEntry(e Entry) error {
+	if err := verifyFile(e.Path); err != nil {
+		return err
+	}
+	layer, err := layerFromFile(e.Path, nil)
+	if err != nil {
+		return err
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return err
+	}
+	return nil
+}
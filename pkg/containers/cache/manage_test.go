@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putTestLayer adds a random layer to the cache and
+// pretends that it was last used some time ago.
+func putTestLayer(t *testing.T, c Cache, dir string, age time.Duration) v1.Hash {
+	layer, err := random.Layer(1024, types.OCILayer)
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+	_, err = c.Put(diffID, layer, true)
+	require.NoError(t, err)
+
+	lastUsed := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(cachepath(dir, diffID), lastUsed, lastUsed))
+	return diffID
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	older := putTestLayer(t, c, dir, time.Hour)
+	newer := putTestLayer(t, c, dir, time.Minute)
+	// files that aren't layers are ignored
+	require.NoError(t, os.WriteFile(dir+"/README", []byte("hello"), 0600))
+
+	entries, err := List(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, newer, entries[0].Key)
+	assert.Equal(t, older, entries[1].Key)
+	assert.NotZero(t, entries[0].Size)
+
+	// reading the older layer makes it the most recent
+	_, err = c.Get(older)
+	require.NoError(t, err)
+	entries, err = List(dir)
+	require.NoError(t, err)
+	assert.Equal(t, older, entries[0].Key)
+
+	entries, err = List(dir + "/missing")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPrune(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	t.Run("max age", func(t *testing.T) {
+		dir := t.TempDir()
+		c := NewFilesystemCache(dir)
+		old := putTestLayer(t, c, dir, 48*time.Hour)
+		recent := putTestLayer(t, c, dir, time.Hour)
+
+		evicted, err := Prune(ctx, dir, Limits{MaxAge: 24 * time.Hour})
+		require.NoError(t, err)
+		require.Len(t, evicted, 1)
+		assert.Equal(t, old, evicted[0].Key)
+
+		_, err = c.Get(recent)
+		assert.NoError(t, err)
+	})
+	t.Run("max size", func(t *testing.T) {
+		dir := t.TempDir()
+		c := NewFilesystemCache(dir)
+		oldest := putTestLayer(t, c, dir, 3*time.Hour)
+		middle := putTestLayer(t, c, dir, 2*time.Hour)
+		newest := putTestLayer(t, c, dir, time.Hour)
+
+		entries, err := List(dir)
+		require.NoError(t, err)
+		// leave enough room for two layers
+		limit := entries[0].Size + entries[1].Size
+
+		evicted, err := Prune(ctx, dir, Limits{MaxSize: limit})
+		require.NoError(t, err)
+		require.Len(t, evicted, 1)
+		assert.Equal(t, oldest, evicted[0].Key)
+
+		entries, err = List(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, newest, entries[0].Key)
+		assert.Equal(t, middle, entries[1].Key)
+	})
+	t.Run("clear", func(t *testing.T) {
+		dir := t.TempDir()
+		c := NewFilesystemCache(dir)
+		putTestLayer(t, c, dir, time.Hour)
+		putTestLayer(t, c, dir, time.Minute)
+
+		evicted, err := Clear(ctx, dir)
+		require.NoError(t, err)
+		assert.Len(t, evicted, 2)
+
+		entries, err := List(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+
+		// the lock files are removed as well
+		locks, err := os.ReadDir(filepath.Join(dir, lockDir))
+		require.NoError(t, err)
+		assert.Empty(t, locks)
+	})
+}
+
+func TestRemoveStaleFiles(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	dir := t.TempDir()
+	unlock, err := Lock(dir, "held")
+	require.NoError(t, err)
+	release, err := Lock(dir, "released")
+	require.NoError(t, err)
+	release()
+
+	RemoveStaleFiles(ctx, dir)
+
+	// locks that are in use must be kept, otherwise
+	// two builds could end up holding the same lock
+	assert.FileExists(t, filepath.Join(dir, lockDir, "held.lock"))
+	assert.NoFileExists(t, filepath.Join(dir, lockDir, "released.lock"))
+
+	unlock()
+	RemoveStaleFiles(ctx, dir)
+	assert.NoFileExists(t, filepath.Join(dir, lockDir, "held.lock"))
+
+	// taking the lock again recreates the file
+	unlock, err = Lock(dir, "held")
+	require.NoError(t, err)
+	defer unlock()
+	assert.FileExists(t, filepath.Join(dir, lockDir, "held.lock"))
+}
+
+func TestVerify(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+	good := putTestLayer(t, c, dir, time.Minute)
+	bad := putTestLayer(t, c, dir, time.Hour)
+
+	// truncate the layer to simulate a build
+	// that was killed part way through
+	info, err := os.Stat(cachepath(dir, bad))
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(cachepath(dir, bad), info.Size()/2))
+
+	results, err := Verify(ctx, dir)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	errs := map[v1.Hash]error{}
+	for _, r := range results {
+		errs[r.Key] = r.Err
+	}
+	assert.NoError(t, errs[good])
+	assert.Error(t, errs[bad])
+}
+
+func TestParseAge(t *testing.T) {
+	var cases = []struct {
+		in       string
+		expected time.Duration
+		ok       bool
+	}{
+		{"7d", 7 * 24 * time.Hour, true},
+		{"36h", 36 * time.Hour, true},
+		{"xd", 0, false},
+		{"later", 0, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := ParseAge(tt.in)
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestLimitsFromEnv(t *testing.T) {
+	t.Setenv(EnvMaxSize, "10Gi")
+	t.Setenv(EnvMaxAge, "30d")
+
+	limits, err := LimitsFromEnv()
+	require.NoError(t, err)
+	assert.EqualValues(t, 10<<30, limits.MaxSize)
+	assert.Equal(t, 30*24*time.Hour, limits.MaxAge)
+	assert.False(t, limits.IsZero())
+
+	t.Setenv(EnvMaxSize, "lots")
+	_, err = LimitsFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// ArtifactTypeCache identifies the manifest
+	// that indexes the cache entries.
+	ArtifactTypeCache = "application/vnd.snakdy.cbe.cache.v1+json"
+	// AnnotationCacheKey records the key of
+	// each entry in the cache manifest.
+	AnnotationCacheKey = "dev.snakdy.cbe.cache.key"
+
+	mediaTypeEmpty types.MediaType = "application/vnd.oci.empty.v1+json"
+)
+
+// RegistryCache stores layers in an OCI registry
+// repository so that they can be shared between runners.
+//
+// Entries are indexed by a cache manifest, which is an OCI
+// image manifest where each layer is annotated with its key.
+// Put only records the layer; nothing is uploaded until
+// Export is called.
+type RegistryCache struct {
+	ref     name.Reference
+	options []remote.Option
+
+	mu      sync.Mutex
+	entries map[v1.Hash]v1.Descriptor
+	pending map[v1.Hash]v1.Layer
+}
+
+// NewRegistryCache reads the cache manifest at the given
+// reference. If the manifest doesn't exist yet, the
+// cache starts out empty.
+func NewRegistryCache(ctx context.Context, ref string, options ...remote.Option) (*RegistryCache, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("ref", ref)
+
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("parsing name %s: %w", ref, err)
+	}
+	c := &RegistryCache{
+		ref:     r,
+		options: append([]remote.Option{remote.WithContext(ctx)}, options...),
+		entries: map[v1.Hash]v1.Descriptor{},
+		pending: map[v1.Hash]v1.Layer{},
+	}
+
+	desc, err := remote.Get(r, c.options...)
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			log.V(1).Info("cache manifest does not exist yet")
+			return c, nil
+		}
+		return nil, fmt.Errorf("getting cache manifest %s: %w", ref, err)
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return nil, fmt.Errorf("parsing cache manifest %s: %w", ref, err)
+	}
+	if m.ArtifactType != ArtifactTypeCache {
+		return nil, fmt.Errorf("%s is not a cache manifest", ref)
+	}
+	for _, l := range m.Layers {
+		key, err := v1.NewHash(l.Annotations[AnnotationCacheKey])
+		if err != nil {
+			log.V(1).Info("skipping cache entry with an invalid key", "digest", l.Digest, "error", err)
+			continue
+		}
+		c.entries[key] = l
+	}
+	log.V(1).Info("read cache manifest", "entries", len(c.entries))
+	return c, nil
+}
+
+// Put records the layer so that it's uploaded by Export.
+func (c *RegistryCache) Put(key v1.Hash, layer v1.Layer, compressed bool) (v1.Layer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return layer, nil
+	}
+	if compressed {
+		c.pending[key] = layer
+	} else {
+		c.pending[key] = &uncompressedBlob{Layer: layer}
+	}
+	return layer, nil
+}
+
+// Get returns a layer that is lazily
+// downloaded from the registry.
+func (c *RegistryCache) Get(key v1.Hash) (v1.Layer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.pending[key]; ok {
+		return l, nil
+	}
+	desc, ok := c.entries[key]
+	if !ok {
+		return nil, cache.ErrNotFound
+	}
+	l, err := remote.Layer(c.ref.Context().Digest(desc.Digest.String()), c.options...)
+	if err != nil {
+		return nil, err
+	}
+	return &describedLayer{Layer: l, desc: desc}, nil
+}
+
+// Delete removes the entry from the cache manifest. The
+// blob is left in the registry since other manifests may
+// refer to it.
+func (c *RegistryCache) Delete(key v1.Hash) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, inEntries := c.entries[key]
+	_, inPending := c.pending[key]
+	if !inEntries && !inPending {
+		return cache.ErrNotFound
+	}
+	delete(c.entries, key)
+	delete(c.pending, key)
+	return nil
+}
+
+// Export uploads the layers recorded by Put
+// and then writes the cache manifest.
+func (c *RegistryCache) Export(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("ref", c.ref.String())
+	log.Info("exporting cache")
+	start := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo := c.ref.Context()
+	for key, l := range c.pending {
+		desc, err := describe(l)
+		if err != nil {
+			return fmt.Errorf("describing %s: %w", key, err)
+		}
+		log.V(2).Info("uploading cache entry", "key", key, "digest", desc.Digest, "size", desc.Size)
+		// this is a no-op if the blob already exists
+		if err := remote.WriteLayer(repo, l, c.options...); err != nil {
+			return fmt.Errorf("uploading %s: %w", key, err)
+		}
+		c.entries[key] = *desc
+	}
+	clear(c.pending)
+
+	config := static.NewLayer([]byte("{}"), mediaTypeEmpty)
+	if err := remote.WriteLayer(repo, config, c.options...); err != nil {
+		return fmt.Errorf("uploading config: %w", err)
+	}
+	raw, err := c.manifest(config)
+	if err != nil {
+		return err
+	}
+	if err := remote.Put(c.ref, raw, c.options...); err != nil {
+		return fmt.Errorf("writing cache manifest: %w", err)
+	}
+	log.Info("exported cache", "entries", len(c.entries), "duration", time.Since(start))
+	return nil
+}
+
+// manifest generates the cache manifest. Entries are sorted
+// by key so that the digest only changes when they do.
+func (c *RegistryCache) manifest(config v1.Layer) (*rawManifest, error) {
+	configDesc, err := describe(config)
+	if err != nil {
+		return nil, err
+	}
+	keys := slices.SortedFunc(maps.Keys(c.entries), func(a, b v1.Hash) int {
+		return bytes.Compare([]byte(a.String()), []byte(b.String()))
+	})
+	layers := make([]v1.Descriptor, len(keys))
+	for i, key := range keys {
+		layers[i] = c.entries[key]
+		layers[i].Annotations = map[string]string{
+			AnnotationCacheKey: key.String(),
+		}
+	}
+	data, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  ArtifactTypeCache,
+		Config:        *configDesc,
+		Layers:        layers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rawManifest{data: data}, nil
+}
+
+func describe(l v1.Layer) (*v1.Descriptor, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := l.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      size,
+	}, nil
+}
+
+// rawManifest allows us to upload a manifest
+// that we've generated ourselves.
+type rawManifest struct {
+	data []byte
+}
+
+func (m *rawManifest) RawManifest() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *rawManifest) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+// describedLayer overrides the media type of
+// a remote layer using the cache manifest.
+type describedLayer struct {
+	v1.Layer
+	desc v1.Descriptor
+}
+
+func (l *describedLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// uncompressedBlob uploads the uncompressed
+// contents of a layer.
+type uncompressedBlob struct {
+	v1.Layer
+}
+
+func (l *uncompressedBlob) Digest() (v1.Hash, error) {
+	return l.DiffID()
+}
+
+func (l *uncompressedBlob) Compressed() (io.ReadCloser, error) {
+	return l.Uncompressed()
+}
+
+func (l *uncompressedBlob) Size() (int64, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(io.Discard, rc)
+}
+
+func (l *uncompressedBlob) MediaType() (types.MediaType, error) {
+	return types.OCIUncompressedLayer, nil
+}
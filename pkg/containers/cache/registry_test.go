@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRegistry(t *testing.T) string {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	return u.Host
+}
+
+func TestRegistryCache(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	ref := newTestRegistry(t) + "/cache:main"
+
+	// an empty cache is fine
+	c, err := NewRegistryCache(ctx, ref)
+	require.NoError(t, err)
+	_, err = c.Get(v1.Hash{Algorithm: "sha256", Hex: "6e9f67fa63b0323e9a1e587fd71c561ba48a034504fb804fd26fd8800039835d"})
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+
+	compressed, err := random.Layer(1024, types.OCILayer)
+	require.NoError(t, err)
+	compressedKey, err := compressed.DiffID()
+	require.NoError(t, err)
+	uncompressed, err := random.Layer(1024, types.OCIUncompressedLayer)
+	require.NoError(t, err)
+	uncompressedKey, err := uncompressed.DiffID()
+	require.NoError(t, err)
+
+	_, err = c.Put(compressedKey, compressed, true)
+	require.NoError(t, err)
+	_, err = c.Put(uncompressedKey, uncompressed, false)
+	require.NoError(t, err)
+	require.NoError(t, c.Export(ctx))
+
+	// another runner can read the entries
+	c, err = NewRegistryCache(ctx, ref)
+	require.NoError(t, err)
+
+	l, err := c.Get(compressedKey)
+	require.NoError(t, err)
+	digest, err := l.Digest()
+	require.NoError(t, err)
+	expected, err := compressed.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expected, digest)
+
+	l, err = c.Get(uncompressedKey)
+	require.NoError(t, err)
+	mt, err := l.MediaType()
+	require.NoError(t, err)
+	assert.Equal(t, types.OCIUncompressedLayer, mt)
+	rc, err := l.Compressed()
+	require.NoError(t, err)
+	digest, _, err = v1.SHA256(rc)
+	require.NoError(t, err)
+	_ = rc.Close()
+	assert.Equal(t, uncompressedKey, digest)
+}
+
+func TestRegistryCache_NotACache(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	host := newTestRegistry(t)
+
+	// push something that isn't a cache manifest
+	c, err := NewRegistryCache(ctx, host+"/cache:main")
+	require.NoError(t, err)
+	require.NoError(t, c.Export(ctx))
+	img, err := random.Image(64, 1)
+	require.NoError(t, err)
+	require.NoError(t, pushTestImage(host+"/cache:main", img))
+
+	_, err = NewRegistryCache(ctx, host+"/cache:main")
+	assert.Error(t, err)
+}
+
+func TestTieredCache(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	ref := newTestRegistry(t) + "/cache:main"
+
+	layer, err := random.Layer(1024, types.OCILayer)
+	require.NoError(t, err)
+	key, err := layer.DiffID()
+	require.NoError(t, err)
+
+	// the first runner normalises the layer
+	// and exports it
+	first, err := NewRegistryCache(ctx, ref)
+	require.NoError(t, err)
+	c := NewTieredCache(NewFilesystemCache(t.TempDir()), nil, []Cache{first})
+	_, err = c.Put(key, layer, true)
+	require.NoError(t, err)
+	require.NoError(t, first.Export(ctx))
+
+	// the second runner has an empty local cache,
+	// so it imports the layer from the registry
+	second, err := NewRegistryCache(ctx, ref)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	c = NewTieredCache(NewFilesystemCache(dir), []Cache{second}, nil)
+	l, err := c.Get(key)
+	require.NoError(t, err)
+	rc, err := l.Uncompressed()
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+	_ = rc.Close()
+
+	// and it's now in the local cache
+	entries, err := List(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, key, entries[0].Key)
+
+	_, err = c.Get(v1.Hash{Algorithm: "sha256", Hex: "6e9f67fa63b0323e9a1e587fd71c561ba48a034504fb804fd26fd8800039835d"})
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+}
+
+func pushTestImage(ref string, img v1.Image) error {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	return remote.Write(r, img)
+}
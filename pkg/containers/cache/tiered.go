@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"errors"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+)
+
+// tiered combines the local cache with caches
+// that are shared between runners (e.g., a RegistryCache).
+type tiered struct {
+	local Cache
+	// from are checked when the local cache misses.
+	from []Cache
+	// to are given every layer that
+	// is used so that they can be shared.
+	to []Cache
+}
+
+// NewTieredCache returns a Cache that reads from the local
+// cache first, falling back to each of the caches in from.
+// Layers found in from are copied into the local cache.
+//
+// Every layer that is read or written is also recorded in
+// the caches in to.
+func NewTieredCache(local Cache, from, to []Cache) Cache {
+	return &tiered{
+		local: local,
+		from:  from,
+		to:    to,
+	}
+}
+
+func (t *tiered) Put(key v1.Hash, layer v1.Layer, compressed bool) (v1.Layer, error) {
+	out, err := t.local.Put(key, layer, compressed)
+	if err != nil {
+		return nil, err
+	}
+	// prefer the copy on disk so that we share
+	// exactly what we've stored
+	if l, err := t.local.Get(key); err == nil {
+		t.record(key, l, true)
+	} else {
+		t.record(key, layer, compressed)
+	}
+	return out, nil
+}
+
+func (t *tiered) Get(key v1.Hash) (v1.Layer, error) {
+	if l, err := t.local.Get(key); err == nil {
+		t.record(key, l, true)
+		return l, nil
+	}
+	for _, c := range t.from {
+		l, err := c.Get(key)
+		if err != nil {
+			continue
+		}
+		// copy it into the local cache so that we
+		// don't need to download it again
+		if _, err := t.local.Put(key, l, true); err == nil {
+			if ll, err := t.local.Get(key); err == nil {
+				l = ll
+			}
+		}
+		t.record(key, l, true)
+		return l, nil
+	}
+	return nil, cache.ErrNotFound
+}
+
+func (t *tiered) Delete(key v1.Hash) error {
+	err := t.local.Delete(key)
+	for _, c := range t.to {
+		if err := c.Delete(key); err != nil && !errors.Is(err, cache.ErrNotFound) {
+			return err
+		}
+	}
+	return err
+}
+
+func (t *tiered) record(key v1.Hash, layer v1.Layer, compressed bool) {
+	for _, c := range t.to {
+		_, _ = c.Put(key, layer, compressed)
+	}
+}
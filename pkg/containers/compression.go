@@ -0,0 +1,117 @@
+package containers
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	CompressionNone Compression = "none"
+)
+
+// pgzipBlockSize is the amount of data that each
+// goroutine compresses. Layers smaller than this
+// are compressed by a single goroutine.
+const pgzipBlockSize = 1 << 20
+
+// ParseCompression converts a string into a Compression
+// and returns an error if it's not supported.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case CompressionGzip, CompressionZstd, CompressionNone:
+		return c, nil
+	case "":
+		return CompressionGzip, nil
+	default:
+		return "", fmt.Errorf("unsupported compression: %s", s)
+	}
+}
+
+// MediaType returns the OCI layer media type that
+// matches the compression.
+func (c Compression) MediaType() types.MediaType {
+	switch c {
+	case CompressionZstd:
+		return types.OCILayerZStd
+	case CompressionNone:
+		return types.OCIUncompressedLayer
+	default:
+		return types.OCILayer
+	}
+}
+
+func (c Compression) extension() string {
+	switch c {
+	case CompressionZstd:
+		return ".tar.zst"
+	case CompressionNone:
+		return ".tar"
+	default:
+		return ".tar.gz"
+	}
+}
+
+// newCompressor wraps the writer so that anything written to it
+// is compressed using the configured algorithm.
+func newCompressor(w io.Writer, opts LayerOptions) (io.WriteCloser, error) {
+	switch opts.GetCompression() {
+	case CompressionGzip:
+		level := opts.CompressionLevel
+		if level == 0 {
+			level = gzip.BestSpeed
+		}
+		zw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		if err := zw.SetConcurrency(pgzipBlockSize, opts.GetConcurrency()); err != nil {
+			return nil, err
+		}
+		return zw, nil
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if opts.CompressionLevel != 0 {
+			level = zstd.EncoderLevelFromZstd(opts.CompressionLevel)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(opts.GetConcurrency()))
+	case CompressionNone:
+		return nopWriteCloser{Writer: w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", opts.Compression)
+	}
+}
+
+// newDecompressor is the inverse of newCompressor.
+func newDecompressor(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", c)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,133 @@
+package containers
+
+import (
+	"context"
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/fs"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCompression(t *testing.T) {
+	var cases = []struct {
+		in  string
+		out Compression
+		ok  bool
+	}{
+		{"", CompressionGzip, true},
+		{"gzip", CompressionGzip, true},
+		{"zstd", CompressionZstd, true},
+		{"none", CompressionNone, true},
+		{"bzip2", "", false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := ParseCompression(tt.in)
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.EqualValues(t, tt.out, out)
+		})
+	}
+}
+
+func TestNewLayer_Compression(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	rootfs := fs.NewMemFS()
+	require.NoError(t, rootfs.MkdirAll("/etc", 0755))
+	require.NoError(t, rootfs.WriteFile("/etc/hello.txt", []byte("hello world"), 0644))
+
+	var cases = []struct {
+		compression Compression
+		level       int
+		mediaType   types.MediaType
+	}{
+		{CompressionGzip, 9, types.OCILayer},
+		{CompressionZstd, 0, types.OCILayerZStd},
+		{CompressionZstd, 19, types.OCILayerZStd},
+		{CompressionNone, 0, types.OCIUncompressedLayer},
+	}
+	var diffID v1.Hash
+	for _, tt := range cases {
+		t.Run(string(tt.compression), func(t *testing.T) {
+			layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{
+				TempDir:          t.TempDir(),
+				Compression:      tt.compression,
+				CompressionLevel: tt.level,
+				Concurrency:      2,
+			})
+			require.NoError(t, err)
+
+			mediaType, err := layer.MediaType()
+			require.NoError(t, err)
+			assert.EqualValues(t, tt.mediaType, mediaType)
+
+			// the uncompressed content should be the
+			// same regardless of compression
+			rc, err := layer.Uncompressed()
+			require.NoError(t, err)
+			defer rc.Close()
+			expected, _, err := v1.SHA256(rc)
+			require.NoError(t, err)
+
+			actual, err := layer.DiffID()
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual)
+			if diffID.Hex != "" {
+				assert.Equal(t, diffID, actual)
+			}
+			diffID = actual
+		})
+	}
+}
+
+func TestRecompressImage(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	img, err = NormaliseImage(ctx, img)
+	require.NoError(t, err)
+
+	for _, c := range []Compression{CompressionZstd, CompressionNone} {
+		t.Run(string(c), func(t *testing.T) {
+			out, err := RecompressImage(ctx, img, LayerOptions{TempDir: t.TempDir(), Compression: c})
+			require.NoError(t, err)
+
+			layers, err := out.Layers()
+			require.NoError(t, err)
+			require.Len(t, layers, 2)
+			for _, l := range layers {
+				mediaType, err := l.MediaType()
+				require.NoError(t, err)
+				assert.EqualValues(t, c.MediaType(), mediaType)
+			}
+
+			// recompressing mustn't change the filesystem
+			expected, err := img.ConfigFile()
+			require.NoError(t, err)
+			actual, err := out.ConfigFile()
+			require.NoError(t, err)
+			assert.Equal(t, expected.RootFS.DiffIDs, actual.RootFS.DiffIDs)
+
+			// running it again should use the cache
+			again, err := RecompressImage(ctx, img, LayerOptions{TempDir: t.TempDir(), Compression: c})
+			require.NoError(t, err)
+			expectedDigest, err := out.Digest()
+			require.NoError(t, err)
+			actualDigest, err := again.Digest()
+			require.NoError(t, err)
+			assert.Equal(t, expectedDigest, actualDigest)
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package containers
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	fullfs "chainguard.dev/apko/pkg/apk/fs"
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// BaseFile describes a file in the flattened
+// filesystem of the base image.
+type BaseFile struct {
+	Typeflag byte
+	Size     int64
+	Mode     int64
+	Uid      int
+	Gid      int
+	// Linkname is the target of a symbolic link.
+	Linkname string
+	// Xattrs holds the extended attributes of
+	// the file as PAX records.
+	Xattrs map[string]string
+	// layer is the index of the
+	// layer that the file is in
+	layer int
+}
+
+// BaseIndex records the files in the base image so that
+// NewLayer can skip files that haven't changed.
+//
+// Only the tar headers are read when the index is created.
+// The contents of a layer are hashed the first time that
+// the new layer has a file with the same path and size as
+// one of its files.
+type BaseIndex struct {
+	// Files maps the absolute path of each
+	// file in the base image to its metadata.
+	Files  map[string]BaseFile
+	layers []v1.Layer
+
+	mu sync.Mutex
+	// digests holds the sha256 of the files
+	// in each layer that has been hashed
+	digests map[int]map[string]v1.Hash
+}
+
+// IndexImage flattens the image and records the metadata of
+// every regular file and symbolic link.
+func IndexImage(ctx context.Context, img v1.Image) (*BaseIndex, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	log.V(2).Info("indexing base image files")
+	start := time.Now()
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	idx := &BaseIndex{
+		Files:   map[string]BaseFile{},
+		layers:  layers,
+		digests: map[int]map[string]v1.Hash{},
+	}
+	// layers are read from the top down, the same
+	// way as squashLayers, so the first time we see
+	// a path is the version in the flattened image
+	seen := map[string]bool{}
+	opaque := map[string]bool{}
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := idx.indexLayer(i, seen, opaque); err != nil {
+			return nil, fmt.Errorf("reading layer %d: %w", i, err)
+		}
+		for dir := range opaque {
+			seen[dir] = true
+		}
+		clear(opaque)
+	}
+	log.V(2).Info("indexed base image files", "files", len(idx.Files), "duration", time.Since(start))
+	return idx, nil
+}
+
+func (idx *BaseIndex) indexLayer(i int, seen, opaque map[string]bool) error {
+	rc, err := idx.layers[i].Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + header.Name)
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+
+		if base == whiteoutOpaque {
+			if !hidden(seen, dir) {
+				opaque[dir] = true
+			}
+			continue
+		}
+		whiteout := strings.HasPrefix(base, whiteoutPrefix)
+		if whiteout {
+			name = path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+		}
+		if hidden(seen, name) {
+			continue
+		}
+		if replaced, ok := seen[name]; ok {
+			if whiteout && !replaced {
+				seen[name] = true
+			}
+			continue
+		}
+		seen[name] = whiteout || header.Typeflag != tar.TypeDir
+		if whiteout {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		f := BaseFile{
+			Typeflag: header.Typeflag,
+			Size:     header.Size,
+			Mode:     header.Mode & 0o7777,
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			Linkname: header.Linkname,
+			layer:    i,
+		}
+		for k, v := range header.PAXRecords {
+			if strings.HasPrefix(k, paxSchilyXattr) {
+				if f.Xattrs == nil {
+					f.Xattrs = map[string]string{}
+				}
+				f.Xattrs[k] = v
+			}
+		}
+		idx.Files[name] = f
+	}
+}
+
+// digest returns the sha256 of the file in the base image,
+// hashing the layer that it's in if we haven't already.
+func (idx *BaseIndex) digest(ctx context.Context, rootfs fullfs.FullFS, name string) (v1.Hash, bool, error) {
+	i := idx.Files[name].layer
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	digests, ok := idx.digests[i]
+	if !ok {
+		var err error
+		digests, err = idx.hashLayer(ctx, rootfs, i)
+		if err != nil {
+			return v1.Hash{}, false, fmt.Errorf("hashing layer %d: %w", i, err)
+		}
+		idx.digests[i] = digests
+	}
+	d, ok := digests[name]
+	return d, ok, nil
+}
+
+// hashLayer hashes the files that are in the flattened image
+// from the given layer. Files that the new filesystem doesn't
+// have a file of the same size for can't be skipped, so they
+// aren't hashed.
+func (idx *BaseIndex) hashLayer(ctx context.Context, rootfs fullfs.FullFS, i int) (map[string]v1.Hash, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("layer", i)
+	log.V(3).Info("hashing base image layer")
+	start := time.Now()
+
+	rc, err := idx.layers[i].Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	digests := map[string]v1.Hash{}
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + header.Name)
+		f, ok := idx.Files[name]
+		if !ok || f.layer != i || f.Typeflag != tar.TypeReg || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if info, err := fs.Stat(rootfs, name); err != nil || info.Size() != f.Size {
+			continue
+		}
+		digest, _, err := v1.SHA256(tr)
+		if err != nil {
+			return nil, fmt.Errorf("hashing %s: %w", name, err)
+		}
+		digests[name] = digest
+	}
+	log.V(3).Info("hashed base image layer", "files", len(digests), "duration", time.Since(start))
+	return digests, nil
+}
+
+// dedupeStats records how much we've
+// saved by skipping files.
+type dedupeStats struct {
+	files int
+	bytes int64
+}
+
+// unchangedFile returns true if the file is identical to
+// the one in the base image, so it can be left out of
+// the layer.
+func (idx *BaseIndex) unchangedFile(ctx context.Context, rootfs fullfs.FullFS, evalPath, name string, size int64, attrs fileAttributes) (bool, error) {
+	if idx == nil {
+		return false, nil
+	}
+	f, ok := idx.Files[name]
+	if !ok || f.Typeflag != tar.TypeReg {
+		return false, nil
+	}
+	if f.Size != size || f.Mode != attrs.mode || f.Uid != attrs.uid || f.Gid != attrs.gid {
+		return false, nil
+	}
+	if !maps.Equal(f.Xattrs, xattrRecords(ctx, rootfs, evalPath)) {
+		return false, nil
+	}
+	digest, ok, err := idx.digest(ctx, rootfs, name)
+	if err != nil || !ok {
+		return false, err
+	}
+	r, err := rootfs.Open(evalPath)
+	if err != nil {
+		return false, fmt.Errorf("os.Open(%q): %w", evalPath, err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return false, fmt.Errorf("hashing %s: %w", name, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)) == digest.Hex, nil
+}
+
+// unchangedLink returns true if the symbolic link is
+// identical to the one in the base image.
+func (idx *BaseIndex) unchangedLink(name, target string, attrs fileAttributes) bool {
+	if idx == nil {
+		return false
+	}
+	f, ok := idx.Files[name]
+	if !ok || f.Typeflag != tar.TypeSymlink {
+		return false
+	}
+	return f.Linkname == target && f.Uid == attrs.uid && f.Gid == attrs.gid
+}
@@ -0,0 +1,144 @@
+package containers
+
+import (
+	"archive/tar"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexImage(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := mutate.AppendLayers(empty.Image,
+		newTestLayer(t,
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/os-release", typeflag: tar.TypeReg, content: "old"},
+		),
+		newTestLayer(t,
+			testEntry{name: "etc/os-release", typeflag: tar.TypeReg, content: "new"},
+			testEntry{name: "bin/sh", typeflag: tar.TypeSymlink, linkname: "busybox"},
+		),
+	)
+	require.NoError(t, err)
+
+	idx, err := IndexImage(ctx, img)
+	require.NoError(t, err)
+
+	assert.Len(t, idx.Files, 2)
+	assert.EqualValues(t, 3, idx.Files["/etc/os-release"].Size)
+	assert.Equal(t, 1, idx.Files["/etc/os-release"].layer)
+	assert.Equal(t, "busybox", idx.Files["/bin/sh"].Linkname)
+	// nothing is hashed until it's needed
+	assert.Empty(t, idx.digests)
+
+	rootfs := apkfs.NewMemFS()
+	require.NoError(t, rootfs.MkdirAll("/etc", 0755))
+	require.NoError(t, rootfs.WriteFile("/etc/os-release", []byte("new"), 0644))
+
+	digest, ok, err := idx.digest(ctx, rootfs, "/etc/os-release")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	expected, _, err := v1.SHA256(strings.NewReader("new"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, digest)
+	// the layer below doesn't have any
+	// files in the image, so it isn't read
+	assert.Len(t, idx.digests, 1)
+	assert.Contains(t, idx.digests, 1)
+}
+
+func TestIndexImage_Whiteouts(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := mutate.AppendLayers(empty.Image,
+		newTestLayer(t,
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/deleted", typeflag: tar.TypeReg, content: "a"},
+			testEntry{name: "opt/", typeflag: tar.TypeDir},
+			testEntry{name: "opt/hidden", typeflag: tar.TypeReg, content: "b"},
+			testEntry{name: "var/kept", typeflag: tar.TypeReg, content: "c"},
+		),
+		newTestLayer(t,
+			testEntry{name: "etc/.wh.deleted", typeflag: tar.TypeReg},
+			testEntry{name: "opt/", typeflag: tar.TypeDir},
+			testEntry{name: "opt/.wh..wh..opq", typeflag: tar.TypeReg},
+			testEntry{name: "opt/visible", typeflag: tar.TypeReg, content: "d"},
+		),
+	)
+	require.NoError(t, err)
+
+	idx, err := IndexImage(ctx, img)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"/opt/visible", "/var/kept"}, slices.Collect(maps.Keys(idx.Files)))
+}
+
+func TestNewLayer_Dedupe(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := mutate.AppendLayers(empty.Image, newTestLayer(t,
+		testEntry{name: "etc/", typeflag: tar.TypeDir},
+		testEntry{name: "etc/unchanged", typeflag: tar.TypeReg, content: "same"},
+		testEntry{name: "etc/changed", typeflag: tar.TypeReg, content: "before"},
+		testEntry{name: "etc/link", typeflag: tar.TypeSymlink, linkname: "unchanged"},
+		testEntry{name: "etc/moved", typeflag: tar.TypeSymlink, linkname: "unchanged"},
+	))
+	require.NoError(t, err)
+	idx, err := IndexImage(ctx, img)
+	require.NoError(t, err)
+
+	rootfs := apkfs.NewMemFS()
+	require.NoError(t, rootfs.MkdirAll("/etc", 0755))
+	require.NoError(t, rootfs.WriteFile("/etc/unchanged", []byte("same"), 0644))
+	require.NoError(t, rootfs.WriteFile("/etc/changed", []byte("after!"), 0644))
+	require.NoError(t, rootfs.WriteFile("/etc/new", []byte("new"), 0644))
+	require.NoError(t, rootfs.Symlink("unchanged", "/etc/link"))
+	require.NoError(t, rootfs.Symlink("new", "/etc/moved"))
+
+	layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{TempDir: t.TempDir(), Base: idx})
+	require.NoError(t, err)
+
+	headers := readLayerHeaders(t, layer)
+	assert.Contains(t, headers, "/etc")
+	assert.NotContains(t, headers, "/etc/unchanged")
+	assert.NotContains(t, headers, "/etc/link")
+	assert.Contains(t, headers, "/etc/changed")
+	assert.Contains(t, headers, "/etc/new")
+	assert.Contains(t, headers, "/etc/moved")
+}
+
+func TestNewLayer_DedupeMetadata(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := mutate.AppendLayers(empty.Image, newTestLayer(t,
+		testEntry{name: "app/", typeflag: tar.TypeDir},
+		testEntry{name: "app/run.sh", typeflag: tar.TypeReg, content: "#!/bin/sh"},
+	))
+	require.NoError(t, err)
+	idx, err := IndexImage(ctx, img)
+	require.NoError(t, err)
+
+	// the content is the same, but the permissions
+	// aren't, so the file must be kept
+	rootfs := apkfs.NewMemFS()
+	require.NoError(t, rootfs.MkdirAll("/app", 0755))
+	require.NoError(t, rootfs.WriteFile("/app/run.sh", []byte("#!/bin/sh"), 0755))
+
+	layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{TempDir: t.TempDir(), Base: idx})
+	require.NoError(t, err)
+
+	headers := readLayerHeaders(t, layer)
+	assert.Contains(t, headers, "/app/run.sh")
+}
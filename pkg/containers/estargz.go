@@ -0,0 +1,357 @@
+package containers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/klauspost/compress/gzip"
+	"github.com/opencontainers/go-digest"
+)
+
+var ErrEstargzCompression = errors.New("estargz layers must use gzip compression")
+
+// newEstargzLayer writes an uncompressed tar to disk and then
+// converts it into an eStargz layer, which contains a table of
+// contents so that snapshotters can lazily pull individual files.
+//
+// https://github.com/containerd/stargz-snapshotter/blob/main/docs/estargz.md
+func newEstargzLayer(ctx context.Context, opts LayerOptions, write func(w io.Writer) error) (*fileLayer, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if opts.GetCompression() != CompressionGzip {
+		return nil, fmt.Errorf("%w: got %s", ErrEstargzCompression, opts.GetCompression())
+	}
+
+	// estargz needs to be able to seek
+	// through the uncompressed tar
+	tarFile, err := os.CreateTemp(opts.TempDir, "layer-*.tar")
+	if err != nil {
+		return nil, fmt.Errorf("creating layer file: %w", err)
+	}
+	defer func() {
+		_ = tarFile.Close()
+		_ = os.Remove(tarFile.Name())
+	}()
+	size := &countingWriter{}
+	if err := write(io.MultiWriter(tarFile, size)); err != nil {
+		return nil, err
+	}
+
+	level := opts.CompressionLevel
+	if level == 0 {
+		level = gzip.BestSpeed
+	}
+	entries, missing, err := sortEstargzEntries(io.NewSectionReader(tarFile, 0, size.n), opts.PrioritisedFiles)
+	if err != nil {
+		return nil, fmt.Errorf("building estargz layer: %w", err)
+	}
+	if len(missing) > 0 {
+		log.Info("some prioritised files could not be found in the layer", "files", missing)
+	}
+
+	f, err := os.CreateTemp(opts.TempDir, "layer-*.tar.gz")
+	if err != nil {
+		return nil, fmt.Errorf("creating layer file: %w", err)
+	}
+	digest := sha256.New()
+	compressedSize := &countingWriter{}
+	tocDigest, err := buildEstargz(ctx, io.MultiWriter(f, digest, compressedSize), level, entries)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, fmt.Errorf("writing estargz layer: %w", err)
+	}
+	log.V(4).Info("wrote estargz layer", "path", f.Name(), "tocDigest", tocDigest)
+
+	// the TOC is written by the writer, so the
+	// diffID has to be read back from the layer
+	diffID, uncompressedSize, err := estargzDiffID(f.Name())
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, fmt.Errorf("reading diff id: %w", err)
+	}
+
+	layer := &fileLayer{
+		path:        f.Name(),
+		digest:      v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", digest.Sum(nil))},
+		diffID:      diffID,
+		size:        compressedSize.n,
+		compression: CompressionGzip,
+		annotations: map[string]string{
+			estargz.TOCJSONDigestAnnotation:         tocDigest.String(),
+			estargz.StoreUncompressedSizeAnnotation: strconv.FormatInt(uncompressedSize, 10),
+		},
+	}
+	return layer.keep(opts)
+}
+
+// estargzLandmarkContents is the content of the landmark
+// file that separates the prioritised files from the rest.
+const estargzLandmarkContents = 0xf
+
+// estargzEntry is an entry of the uncompressed tar.
+type estargzEntry struct {
+	header  *tar.Header
+	payload io.Reader
+}
+
+// sortEstargzEntries reads the entries of the tar and moves the
+// prioritised files, along with their parent directories and
+// hard link targets, in front of a landmark file.
+//
+// This is what estargz.Build does, but Build compresses the
+// layer in GOMAXPROCS parts so its digest would depend on the
+// number of CPUs of the machine that built it.
+func sortEstargzEntries(r *io.SectionReader, prioritised []string) ([]estargzEntry, []string, error) {
+	var entries []estargzEntry
+	index := map[string]int{}
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading tar: %w", err)
+		}
+		name := estargzName(header.Name)
+		if name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark {
+			continue
+		}
+		// later entries replace earlier ones
+		if i, ok := index[name]; ok {
+			entries[i].header = nil
+		}
+		index[name] = len(entries)
+		entries = append(entries, estargzEntry{
+			header:  header,
+			payload: io.NewSectionReader(r, cr.n, header.Size),
+		})
+	}
+
+	picked := make([]bool, len(entries))
+	var sorted []estargzEntry
+	var move func(name string) bool
+	move = func(name string) bool {
+		name = estargzName(name)
+		i, ok := index[name]
+		if name != "" {
+			if !ok {
+				return false
+			}
+			parent := path.Dir(name)
+			if parent == "." {
+				parent = ""
+			}
+			if !move(parent) {
+				return false
+			}
+			if h := entries[i].header; h.Typeflag == tar.TypeLink && !move(h.Linkname) {
+				return false
+			}
+		}
+		if ok && !picked[i] {
+			picked[i] = true
+			sorted = append(sorted, entries[i])
+		}
+		return true
+	}
+	var missing []string
+	for _, name := range prioritised {
+		if !move(name) {
+			missing = append(missing, name)
+		}
+	}
+
+	landmark := estargz.PrefetchLandmark
+	if len(prioritised) == 0 {
+		landmark = estargz.NoPrefetchLandmark
+	}
+	sorted = append(sorted, estargzEntry{
+		header: &tar.Header{
+			Name:     landmark,
+			Typeflag: tar.TypeReg,
+			Size:     1,
+		},
+		payload: bytes.NewReader([]byte{estargzLandmarkContents}),
+	})
+	for i, e := range entries {
+		if e.header != nil && !picked[i] {
+			sorted = append(sorted, e)
+		}
+	}
+	return sorted, missing, nil
+}
+
+// estargzName returns the name of a tar entry
+// the way that estargz compares them.
+func estargzName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// buildEstargz writes the entries to w as an eStargz blob and
+// returns the digest of its TOC.
+//
+// The entries are compressed serially by a single writer, so
+// the blob doesn't depend on the number of CPUs.
+func buildEstargz(ctx context.Context, w io.Writer, level int, entries []estargzEntry) (digest.Digest, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(writeEstargzEntries(ctx, pw, entries))
+	}()
+
+	sw := estargz.NewWriterWithCompressor(w, newEstargzCompression(level))
+	if err := sw.AppendTar(pr); err != nil {
+		_ = pr.CloseWithError(err)
+		return "", err
+	}
+	return sw.Close()
+}
+
+func writeEstargzEntries(ctx context.Context, w io.Writer, entries []estargzEntry) error {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(e.header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, e.payload); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// estargzDiffID decompresses the eStargz blob at path
+// and returns its diffID and uncompressed size.
+func estargzDiffID(path string) (v1.Hash, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	defer zr.Close()
+	size := &countingWriter{}
+	diffID, _, err := v1.SHA256(io.TeeReader(zr, size))
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	return diffID, size.n, nil
+}
+
+// countingReader counts the number of
+// bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// estargzCompression is the default estargz gzip compression,
+// except that it writes the footer by hand.
+//
+// The estargz footer must be exactly 51 bytes, which relies on
+// the deflate writer emitting an empty stored block. Newer
+// versions of compress/flate emit a shorter block which causes
+// estargz.Build to panic.
+type estargzCompression struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+	level int
+}
+
+func newEstargzCompression(level int) *estargzCompression {
+	return &estargzCompression{
+		GzipCompressor:   estargz.NewGzipCompressorWithLevel(level),
+		GzipDecompressor: &estargz.GzipDecompressor{},
+		level:            level,
+	}
+}
+
+func (c *estargzCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	zw, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return "", err
+	}
+	gw := io.Writer(zw)
+	if diffHash != nil {
+		gw = io.MultiWriter(zw, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if _, err := w.Write(estargzFooter(off)); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// estargzFooter returns an empty gzip stream whose extra
+// field contains the offset of the TOC.
+//
+// https://github.com/containerd/stargz-snapshotter/blob/main/docs/estargz.md#footer
+func estargzFooter(tocOff int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
+	extra := make([]byte, 4, 4+len(subfield))
+	extra[0], extra[1] = 'S', 'G'
+	binary.LittleEndian.PutUint16(extra[2:4], uint16(len(subfield)))
+	extra = append(extra, subfield...)
+
+	buf := bytes.NewBuffer(make([]byte, 0, estargz.FooterSize))
+	// magic, deflate, FEXTRA, zero mtime, no XFL, unknown OS
+	buf.Write([]byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff})
+	_ = binary.Write(buf, binary.LittleEndian, uint16(len(extra)))
+	buf.Write(extra)
+	// final empty stored block
+	buf.Write([]byte{0x01, 0x00, 0x00, 0xff, 0xff})
+	// crc32 and size of the (empty) data
+	buf.Write(make([]byte, 8))
+	return buf.Bytes()
+}
@@ -0,0 +1,149 @@
+package containers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/fs"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLayer_Estargz(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	rootfs := fs.NewMemFS()
+	require.NoError(t, rootfs.MkdirAll("/etc", 0755))
+	require.NoError(t, rootfs.WriteFile("/etc/hello.txt", []byte("hello world"), 0644))
+	require.NoError(t, rootfs.MkdirAll("/app", 0755))
+	require.NoError(t, rootfs.WriteFile("/app/main", []byte("#!/bin/sh"), 0755))
+
+	t.Run("prioritised files", func(t *testing.T) {
+		layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{
+			TempDir:          t.TempDir(),
+			Estargz:          true,
+			PrioritisedFiles: []string{"/app/main", "/missing"},
+		})
+		require.NoError(t, err)
+
+		// the TOC digest should be recorded
+		desc, err := partial.Descriptor(layer)
+		require.NoError(t, err)
+		assert.NotEmpty(t, desc.Annotations[estargz.TOCJSONDigestAnnotation])
+		assert.NotEmpty(t, desc.Annotations[estargz.StoreUncompressedSizeAnnotation])
+
+		// the diffID should match the uncompressed content
+		rc, err := layer.Uncompressed()
+		require.NoError(t, err)
+		expected, _, err := v1.SHA256(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		diffID, err := layer.DiffID()
+		require.NoError(t, err)
+		assert.Equal(t, expected, diffID)
+
+		// the layer should be readable as
+		// an eStargz blob
+		r := openEstargz(t, layer)
+		_, ok := r.Lookup("etc/hello.txt")
+		assert.True(t, ok)
+		_, ok = r.Lookup(estargz.PrefetchLandmark)
+		assert.True(t, ok)
+
+		// prioritised files must come before
+		// the landmark, and the rest after it
+		rc, err = layer.Uncompressed()
+		require.NoError(t, err)
+		defer rc.Close()
+		var names []string
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, strings.TrimPrefix(hdr.Name, "/"))
+		}
+		landmark := slices.Index(names, estargz.PrefetchLandmark)
+		require.NotEqual(t, -1, landmark)
+		assert.Equal(t, []string{"app", "app/main"}, names[:landmark])
+		assert.Contains(t, names[landmark:], "etc/hello.txt")
+	})
+	t.Run("reproducible", func(t *testing.T) {
+		// the digest must not depend on
+		// the number of CPUs
+		var digests []v1.Hash
+		for _, procs := range []int{1, 8} {
+			prev := runtime.GOMAXPROCS(procs)
+			layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{
+				TempDir: t.TempDir(),
+				Estargz: true,
+			})
+			runtime.GOMAXPROCS(prev)
+			require.NoError(t, err)
+			digest, err := layer.Digest()
+			require.NoError(t, err)
+			digests = append(digests, digest)
+		}
+		assert.Equal(t, digests[0], digests[1])
+	})
+	t.Run("no prioritised files", func(t *testing.T) {
+		layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{
+			TempDir: t.TempDir(),
+			Estargz: true,
+		})
+		require.NoError(t, err)
+
+		r := openEstargz(t, layer)
+		_, ok := r.Lookup(estargz.NoPrefetchLandmark)
+		assert.True(t, ok)
+	})
+	t.Run("zstd", func(t *testing.T) {
+		_, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{
+			TempDir:     t.TempDir(),
+			Estargz:     true,
+			Compression: CompressionZstd,
+		})
+		assert.ErrorIs(t, err, ErrEstargzCompression)
+	})
+}
+
+func openEstargz(t *testing.T, layer v1.Layer) *estargz.Reader {
+	rc, err := layer.Compressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	f, err := os.CreateTemp(t.TempDir(), "layer-*.tar.gz")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+	n, err := io.Copy(f, rc)
+	require.NoError(t, err)
+
+	r, err := estargz.Open(io.NewSectionReader(f, 0, n))
+	require.NoError(t, err)
+	return r
+}
+
+func TestEstargzFooter(t *testing.T) {
+	footer := estargzFooter(1234)
+	require.Len(t, footer, estargz.FooterSize)
+
+	off, size, err := estargz.OpenFooter(io.NewSectionReader(bytes.NewReader(footer), 0, int64(len(footer))))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1234, off)
+	assert.EqualValues(t, estargz.FooterSize, size)
+}
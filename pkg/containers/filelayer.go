@@ -0,0 +1,175 @@
+package containers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// fileLayer is a v1.Layer backed by a compressed file on disk
+// whose digest, diffID and size have already been calculated.
+type fileLayer struct {
+	path string
+	// data holds the compressed layer instead of
+	// path when it's kept in memory
+	data        []byte
+	digest      v1.Hash
+	diffID      v1.Hash
+	size        int64
+	compression Compression
+	// annotations are added to the layer
+	// descriptor when it's added to an image.
+	annotations map[string]string
+}
+
+var _ v1.Layer = &fileLayer{}
+
+// newFileLayer creates a temporary file and passes a writer to the
+// given function. Anything written is compressed on the fly and
+// the digest and diffID are calculated as we go.
+func newFileLayer(ctx context.Context, opts LayerOptions, write func(w io.Writer) error) (*fileLayer, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	f, err := os.CreateTemp(opts.TempDir, "layer-*"+opts.GetCompression().extension())
+	if err != nil {
+		return nil, fmt.Errorf("creating layer file: %w", err)
+	}
+	log.V(4).Info("writing layer", "path", f.Name(), "compression", opts.GetCompression())
+
+	layer, err := writeFileLayer(f, opts, write)
+	_ = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	return layer.keep(opts)
+}
+
+// keep returns the layer as-is if it was written to a
+// directory owned by the caller. Otherwise, nobody would
+// remove the file, so the layer is read into memory and
+// the file is removed straight away.
+func (l *fileLayer) keep(opts LayerOptions) (*fileLayer, error) {
+	if opts.TempDir != "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(l.path)
+	_ = os.Remove(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading layer: %w", err)
+	}
+	l.path = ""
+	l.data = data
+	return l, nil
+}
+
+// open returns the compressed layer.
+func (l *fileLayer) open() (io.ReadCloser, error) {
+	if l.data != nil {
+		return io.NopCloser(bytes.NewReader(l.data)), nil
+	}
+	return os.Open(l.path)
+}
+
+func writeFileLayer(f *os.File, opts LayerOptions, write func(w io.Writer) error) (*fileLayer, error) {
+	digest := sha256.New()
+	diffID := sha256.New()
+	size := &countingWriter{}
+
+	zw, err := newCompressor(io.MultiWriter(f, digest, size), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := write(io.MultiWriter(zw, diffID)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compressing data: %w", err)
+	}
+
+	return &fileLayer{
+		path:        f.Name(),
+		digest:      v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", digest.Sum(nil))},
+		diffID:      v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", diffID.Sum(nil))},
+		size:        size.n,
+		compression: opts.GetCompression(),
+	}, nil
+}
+
+func (l *fileLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *fileLayer) DiffID() (v1.Hash, error) {
+	return l.diffID, nil
+}
+
+func (l *fileLayer) Compressed() (io.ReadCloser, error) {
+	return l.open()
+}
+
+func (l *fileLayer) Uncompressed() (io.ReadCloser, error) {
+	f, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := newDecompressor(f, l.compression)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: zr, closers: []io.Closer{zr, f}}, nil
+}
+
+func (l *fileLayer) Size() (int64, error) {
+	return l.size, nil
+}
+
+func (l *fileLayer) MediaType() (types.MediaType, error) {
+	return l.compression.MediaType(), nil
+}
+
+// Descriptor is used by partial.Descriptor so that
+// our annotations are carried into the manifest.
+func (l *fileLayer) Descriptor() (*v1.Descriptor, error) {
+	return &v1.Descriptor{
+		MediaType:   l.compression.MediaType(),
+		Size:        l.size,
+		Digest:      l.digest,
+		Annotations: l.annotations,
+	}, nil
+}
+
+// readCloser closes several io.Closers, in order.
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// countingWriter counts the number of
+// bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -3,6 +3,7 @@ package containers
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Snakdy/container-build-engine/pkg/oci/auth"
@@ -19,6 +20,15 @@ const MagicImageScratch = "scratch"
 
 // Get returns a v1.Image or a v1.ImageIndex depending
 // on what the reference points at.
+//
+// In addition to registry references, the following
+// are supported:
+//
+// 1. "scratch": an empty image
+//
+// 2. "oci-layout:///path/to/dir[:tag|@digest]": an OCI image layout on disk
+//
+// 3. "tarball:///path/to/image.tar": a tarball created by "docker save" or Save
 func Get(ctx context.Context, ref string) (Result, error) {
 	log := logr.FromContextOrDiscard(ctx).WithValues("ref", ref)
 	log.Info("pulling image")
@@ -30,30 +40,16 @@ func Get(ctx context.Context, ref string) (Result, error) {
 		return empty.Image, nil
 	}
 
-	remoteRef, err := name.ParseReference(ref)
-	if err != nil {
-		return nil, fmt.Errorf("parsing name %s: %w", ref, err)
-	}
-
-	// fetch the image without actually
-	// pulling it
-	rmt, err := remote.Get(remoteRef, remote.WithContext(ctx), remote.WithAuthFromKeychain(auth.KeyChain(auth.Auth{})))
+	base, err := resolve(ctx, ref)
 	if err != nil {
-		return nil, fmt.Errorf("getting %s: %w", ref, err)
+		return nil, err
 	}
-
-	log.Info("getting image", "mediaType", rmt.MediaType)
-	if rmt.MediaType == types.OCIImageIndex || rmt.MediaType == types.DockerManifestList {
-		idx, err := rmt.ImageIndex()
-		if err != nil {
-			return nil, fmt.Errorf("getting image as index: %w", err)
-		}
+	if idx, ok := base.(v1.ImageIndex); ok {
 		return idx, nil
 	}
-
-	img, err := rmt.Image()
-	if err != nil {
-		return nil, err
+	img, ok := base.(v1.Image)
+	if !ok {
+		return nil, fmt.Errorf("unsupported image type: %T", base)
 	}
 
 	log.Info("pulled image", "duration", time.Since(start))
@@ -67,9 +63,10 @@ func Get(ctx context.Context, ref string) (Result, error) {
 }
 
 // GetImage is functionally the same as Get but
-// returns a v1.Image
-func GetImage(ctx context.Context, ref string) (v1.Image, error) {
-	log := logr.FromContextOrDiscard(ctx).WithValues("ref", ref)
+// returns a v1.Image for the given platform. If the reference
+// points at an index, the matching child image is selected.
+func GetImage(ctx context.Context, ref string, platform *v1.Platform) (v1.Image, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("ref", ref, "platform", platform)
 	log.Info("pulling image")
 
 	start := time.Now()
@@ -79,21 +76,14 @@ func GetImage(ctx context.Context, ref string) (v1.Image, error) {
 		return empty.Image, nil
 	}
 
-	remoteRef, err := name.ParseReference(ref)
+	base, err := resolve(ctx, ref)
 	if err != nil {
-		return nil, fmt.Errorf("parsing name %s: %w", ref, err)
-	}
-
-	// fetch the image without actually
-	// pulling it
-	rmt, err := remote.Get(remoteRef, remote.WithContext(ctx), remote.WithAuthFromKeychain(auth.KeyChain(auth.Auth{})))
-	if err != nil {
-		return nil, fmt.Errorf("getting %s: %w", ref, err)
+		return nil, err
 	}
 
-	img, err := rmt.Image()
+	img, err := ImageForPlatform(ctx, base, platform)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("selecting platform from %s: %w", ref, err)
 	}
 
 	log.Info("pulled image", "duration", time.Since(start))
@@ -105,3 +95,41 @@ func GetImage(ctx context.Context, ref string) (v1.Image, error) {
 	}
 	return img, nil
 }
+
+// resolve returns the v1.Image or v1.ImageIndex that the
+// reference points at, without normalising it.
+func resolve(ctx context.Context, ref string) (Result, error) {
+	switch {
+	case strings.HasPrefix(ref, SchemeOCILayout):
+		return getLayout(ctx, strings.TrimPrefix(ref, SchemeOCILayout))
+	case strings.HasPrefix(ref, SchemeTarball):
+		return getTarball(ctx, strings.TrimPrefix(ref, SchemeTarball))
+	}
+	return getRemote(ctx, ref)
+}
+
+func getRemote(ctx context.Context, ref string) (Result, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("ref", ref)
+
+	remoteRef, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("parsing name %s: %w", ref, err)
+	}
+
+	// fetch the image without actually
+	// pulling it
+	rmt, err := remote.Get(remoteRef, remote.WithContext(ctx), remote.WithAuthFromKeychain(auth.KeyChain(auth.Auth{})))
+	if err != nil {
+		return nil, fmt.Errorf("getting %s: %w", ref, err)
+	}
+
+	log.Info("getting image", "mediaType", rmt.MediaType)
+	if rmt.MediaType == types.OCIImageIndex || rmt.MediaType == types.DockerManifestList {
+		idx, err := rmt.ImageIndex()
+		if err != nil {
+			return nil, fmt.Errorf("getting image as index: %w", err)
+		}
+		return idx, nil
+	}
+	return rmt.Image()
+}
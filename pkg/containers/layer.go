@@ -2,52 +2,146 @@ package containers
 
 import (
 	"archive/tar"
-	"bytes"
 	fullfs "chainguard.dev/apko/pkg/apk/fs"
 	"context"
 	"fmt"
 	"github.com/Snakdy/container-build-engine/pkg/files"
 	"github.com/go-logr/logr"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
-	"github.com/google/go-containerregistry/pkg/v1/types"
 	"io"
 	"io/fs"
 	"path/filepath"
-	"strings"
+	"runtime"
 )
 
 var creationTime = v1.Time{}
 
-func NewLayer(ctx context.Context, fs fullfs.FullFS, username string, uid int, platform *v1.Platform) (v1.Layer, error) {
-	layerBuf, err := tarDir(ctx, fs, username, uid, platform)
-	if err != nil {
-		return nil, fmt.Errorf("tarring data: %w", err)
+type LayerOptions struct {
+	// TempDir is the directory that the layer is written to.
+	// The layer reads from its file whenever it's used, so the
+	// caller owns the directory and must remove it once the
+	// layer is no longer needed (e.g., after it has been
+	// pushed). If not set, the layer is held in memory.
+	TempDir string
+	// Compression is the algorithm used to compress
+	// the layer. Defaults to gzip.
+	Compression Compression
+	// CompressionLevel is the algorithm-specific compression
+	// level. If not set, gzip uses BestSpeed and zstd
+	// uses its default level.
+	CompressionLevel int
+	// Concurrency is the number of goroutines used to
+	// compress large layers. Defaults to GOMAXPROCS.
+	Concurrency int
+	// Estargz instructs NewLayer to produce an eStargz layer
+	// that can be lazily pulled. It requires gzip compression.
+	Estargz bool
+	// PrioritisedFiles is a list of files that should be
+	// placed at the start of an eStargz layer so that they
+	// are prefetched by the snapshotter.
+	PrioritisedFiles []string
+	// Ownership overrides the ownership and permissions
+	// of matching files. Rules are applied in order.
+	Ownership []OwnershipRule
+	// Base is an index of the files in the base image.
+	// If set, files that are identical to the base
+	// are omitted from the layer.
+	Base *BaseIndex
+}
+
+// GetCompression returns the nominated Compression or gzip.
+func (o *LayerOptions) GetCompression() Compression {
+	if o.Compression == "" {
+		return CompressionGzip
+	}
+	return o.Compression
+}
+
+// GetConcurrency returns the nominated concurrency
+// or GOMAXPROCS.
+func (o *LayerOptions) GetConcurrency() int {
+	if o.Concurrency <= 0 {
+		return runtime.GOMAXPROCS(0)
 	}
-	layerBytes := layerBuf.Bytes()
-	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
-		return io.NopCloser(bytes.NewBuffer(layerBytes)), nil
-	}, tarball.WithCompressedCaching, tarball.WithMediaType(types.OCILayer))
+	return o.Concurrency
 }
 
-func tarDir(ctx context.Context, fs fullfs.FullFS, username string, uid int, platform *v1.Platform) (*bytes.Buffer, error) {
-	buf := bytes.NewBuffer(nil)
-	tw := tar.NewWriter(buf)
-	defer tw.Close()
+// NewLayer creates a gzip compressed layer from the contents of
+// the given filesystem, which is held in memory.
+func NewLayer(ctx context.Context, fs fullfs.FullFS, username string, uid int, platform *v1.Platform) (v1.Layer, error) {
+	return NewLayerWithOptions(ctx, fs, username, uid, platform, LayerOptions{})
+}
+
+// NewLayerWithOptions creates a layer from the contents of the
+// given filesystem.
+//
+// The tar is streamed through the compressor into a temporary file
+// in LayerOptions.TempDir so that we never need to hold the layer in
+// memory, and the digest and diffID are calculated in the same pass.
+func NewLayerWithOptions(ctx context.Context, fs fullfs.FullFS, username string, uid int, platform *v1.Platform, opts LayerOptions) (v1.Layer, error) {
+	return newLayer(ctx, opts, func(w io.Writer) error {
+		if err := tarDir(ctx, w, fs, username, uid, platform, opts); err != nil {
+			return fmt.Errorf("tarring data: %w", err)
+		}
+		return nil
+	})
+}
+
+// newLayer creates either a regular or eStargz layer
+// from the tar produced by write.
+func newLayer(ctx context.Context, opts LayerOptions, write func(w io.Writer) error) (*fileLayer, error) {
+	if opts.Estargz {
+		return newEstargzLayer(ctx, opts, write)
+	}
+	return newFileLayer(ctx, opts, write)
+}
 
-	if err := walkRecursive(ctx, fs, tw, "/", username, uid, platform); err != nil {
-		return nil, err
+func tarDir(ctx context.Context, w io.Writer, rootfs fullfs.FullFS, username string, uid int, platform *v1.Platform, opts LayerOptions) error {
+	log := logr.FromContextOrDiscard(ctx)
+	l := &layerWalker{
+		rootfs:   rootfs,
+		tw:       tar.NewWriter(w),
+		username: username,
+		uid:      uid,
+		platform: platform,
+		rules:    opts.Ownership,
+		base:     opts.Base,
+		links:    map[any]string{},
+	}
+	if err := l.walk(ctx, "/"); err != nil {
+		return err
 	}
-	return buf, nil
+	if l.base != nil {
+		log.Info("skipped files that are identical to the base image", "files", l.skipped.files, "bytes", l.skipped.bytes)
+	}
+	return l.tw.Close()
 }
 
-// walkRecursive performs a filepath.Walk of the given root directory adding it
-// to the provided tar.Writer with root -> chroot.  All symlinks are dereferenced,
+// layerWalker holds the state needed
+// to write a filesystem to a tar.
+type layerWalker struct {
+	rootfs   fullfs.FullFS
+	tw       *tar.Writer
+	username string
+	uid      int
+	platform *v1.Platform
+	rules    []OwnershipRule
+	// base is used to skip files that
+	// already exist in the base image.
+	base    *BaseIndex
+	skipped dedupeStats
+	// links tracks files that we've already written
+	// so that hard links only include the content once.
+	links map[any]string
+}
+
+// walk performs a filepath.Walk of the given root directory adding it
+// to the tar.Writer with root -> chroot.  All symlinks are dereferenced,
 // which is what leads to recursion when we encounter a directory symlink.
-func walkRecursive(ctx context.Context, rootfs fullfs.FullFS, tw *tar.Writer, root, username string, userId int, platform *v1.Platform) error {
+func (l *layerWalker) walk(ctx context.Context, root string) error {
 	log := logr.FromContextOrDiscard(ctx).WithValues("root", root)
 	log.V(2).Info("walking filesystem")
-	dirs, err := fs.ReadDir(rootfs, root)
+	dirs, err := fs.ReadDir(l.rootfs, root)
 	if err != nil {
 		return fmt.Errorf("fs.ReadDir(%q): %w", root, err)
 	}
@@ -58,89 +152,155 @@ func walkRecursive(ctx context.Context, rootfs fullfs.FullFS, tw *tar.Writer, ro
 			continue
 		}
 
-		// hacky method of setting the uid...
-		uid := 0
-		if hostPath == filepath.Join("/home", username) || strings.HasPrefix(hostPath, filepath.Join("/home", username)) {
-			log.V(4).Info("adding user owned file")
-			uid = userId
+		attrs, err := getAttributes(ctx, l.rootfs, hostPath, l.username, l.uid, l.rules)
+		if err != nil {
+			return err
 		}
 
 		// create directory shells
 		if d.IsDir() {
 			log.V(4).Info("adding directory to tar", "dir", hostPath)
 			header := &tar.Header{
-				Name:     hostPath,
-				Typeflag: tar.TypeDir,
-				Mode:     0775,
-				ModTime:  creationTime.Time,
-				Uid:      uid,
+				Name:       hostPath,
+				Typeflag:   tar.TypeDir,
+				Mode:       attrs.mode,
+				ModTime:    creationTime.Time,
+				Uid:        attrs.uid,
+				Gid:        attrs.gid,
+				PAXRecords: xattrRecords(ctx, l.rootfs, hostPath),
 			}
-			if err := tw.WriteHeader(header); err != nil {
+			if err := l.tw.WriteHeader(header); err != nil {
 				return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", hostPath, err)
 			}
 		}
 
 		evalPath := hostPath
-		ok, err := files.IsSymbolicLink(rootfs, hostPath)
+		ok, err := files.IsSymbolicLink(l.rootfs, hostPath)
 		if err != nil {
 			return fmt.Errorf("fileutil.IsSymbolicLink(%q): %w", hostPath, err)
 		}
 		if ok {
 			log.V(5).Info("expanding symbolic link")
-			evalPath, err = rootfs.Readlink(hostPath)
+			evalPath, err = l.rootfs.Readlink(hostPath)
 			if err != nil {
 				return fmt.Errorf("fs.Readlink(%q): %w", hostPath, err)
 			}
+			if l.base.unchangedLink(hostPath, evalPath, attrs) {
+				log.V(4).Info("skipping symbolic link that is identical to the base")
+				l.skipped.files++
+				continue
+			}
 			log.V(4).Info("adding symbolic link to tar")
 			header := &tar.Header{
 				Name:     hostPath,
 				Typeflag: tar.TypeSymlink,
 				Linkname: evalPath,
 				ModTime:  creationTime.Time,
-				Uid:      uid,
+				Uid:      attrs.uid,
+				Gid:      attrs.gid,
 			}
-			if err := tw.WriteHeader(header); err != nil {
+			if err := l.tw.WriteHeader(header); err != nil {
 				return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", hostPath, err)
 			}
 			continue
 		}
 
 		// Chase symlinks.
-		info, err := fs.Stat(rootfs, evalPath)
+		info, err := fs.Stat(l.rootfs, evalPath)
 		if err != nil {
 			return fmt.Errorf("fs.Stat(%q): %w", evalPath, err)
 		}
 
 		// Skip other directories.
 		if info.Mode().IsDir() && hostPath != root {
-			if err := walkRecursive(ctx, rootfs, tw, hostPath, username, userId, platform); err != nil {
+			if err := l.walk(ctx, hostPath); err != nil {
 				return err
 			}
 			continue
 		}
 
+		// Write special files (e.g. FIFOs and devices)
+		// as headers with no content.
+		if !info.Mode().IsRegular() {
+			header, err := specialFileHeader(l.rootfs, hostPath, info)
+			if err != nil {
+				return err
+			}
+			if header == nil {
+				log.Info("skipping unsupported file type", "path", hostPath, "mode", info.Mode().Type())
+				continue
+			}
+			log.V(4).Info("adding special file to tar", "path", hostPath, "type", header.Typeflag)
+			header.Uid = attrs.uid
+			header.Gid = attrs.gid
+			header.Mode = attrs.mode
+			header.ModTime = creationTime.Time
+			if err := l.tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", hostPath, err)
+			}
+			continue
+		}
+
+		// Skip files that are already in the base image.
+		if l.base != nil {
+			ok, err := l.base.unchangedFile(ctx, l.rootfs, evalPath, hostPath, info.Size(), attrs)
+			if err != nil {
+				return err
+			}
+			if ok {
+				log.V(4).Info("skipping file that is identical to the base", "path", hostPath)
+				l.skipped.files++
+				l.skipped.bytes += info.Size()
+				continue
+			}
+		}
+
+		// If we've already written this file, then it's
+		// a hard link, so we can point to it instead of
+		// writing the content again.
+		if id := fileID(info); id != nil {
+			if target, ok := l.links[id]; ok {
+				log.V(4).Info("adding hard link to tar", "path", hostPath, "target", target)
+				header := &tar.Header{
+					Name:     hostPath,
+					Typeflag: tar.TypeLink,
+					Linkname: target,
+					Uid:      attrs.uid,
+					Gid:      attrs.gid,
+					Mode:     attrs.mode,
+					ModTime:  creationTime.Time,
+				}
+				if err := l.tw.WriteHeader(header); err != nil {
+					return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", hostPath, err)
+				}
+				continue
+			}
+			l.links[id] = hostPath
+		}
+
 		// Open the file to copy it into the tarball.
 		log.V(4).Info("adding file to tar", "evalPath", evalPath, "hostPath", hostPath)
-		file, err := rootfs.Open(evalPath)
+		file, err := l.rootfs.Open(evalPath)
 		if err != nil {
 			return fmt.Errorf("os.Open(%q): %w", evalPath, err)
 		}
 
 		// Copy the file into the image tarball.
 		header := &tar.Header{
-			Name:     hostPath,
-			Size:     info.Size(),
-			Typeflag: tar.TypeReg,
-			Uid:      uid,
-			Gid:      0,
-			Mode:     int64(info.Mode()),
-			ModTime:  creationTime.Time,
-		}
-		if err := tw.WriteHeader(header); err != nil {
+			Name:       hostPath,
+			Size:       info.Size(),
+			Typeflag:   tar.TypeReg,
+			Uid:        attrs.uid,
+			Gid:        attrs.gid,
+			Mode:       attrs.mode,
+			ModTime:    creationTime.Time,
+			PAXRecords: xattrRecords(ctx, l.rootfs, evalPath),
+		}
+		if err := l.tw.WriteHeader(header); err != nil {
 			_ = file.Close()
 			return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", hostPath, err)
 		}
-		if _, err := io.Copy(tw, file); err != nil {
+		if _, err := io.Copy(l.tw, file); err != nil {
 			_ = file.Close()
 			return fmt.Errorf("io.Copy(%q, %q): %w", hostPath, evalPath, err)
 		}
@@ -148,3 +308,58 @@ func walkRecursive(ctx context.Context, rootfs fullfs.FullFS, tw *tar.Writer, ro
 	}
 	return nil
 }
+
+// paxSchilyXattr is the PAX record prefix used
+// by GNU tar and the OCI image spec for xattrs.
+const paxSchilyXattr = "SCHILY.xattr."
+
+// xattrRecords converts the extended attributes of a file
+// (e.g. security.capability) into PAX records.
+func xattrRecords(ctx context.Context, rootfs fullfs.FullFS, path string) map[string]string {
+	log := logr.FromContextOrDiscard(ctx)
+	attrs, err := rootfs.ListXattrs(path)
+	if err != nil {
+		log.V(5).Info("unable to list xattrs", "path", path, "error", err)
+		return nil
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	records := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		log.V(5).Info("adding xattr", "path", path, "attr", k)
+		records[paxSchilyXattr+k] = string(v)
+	}
+	return records
+}
+
+// specialFileHeader creates the tar header for FIFOs and device
+// nodes. It returns nil if the file type isn't supported
+// (e.g. sockets).
+func specialFileHeader(rootfs fullfs.FullFS, name string, info fs.FileInfo) (*tar.Header, error) {
+	mode := info.Mode()
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return &tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeFifo,
+		}, nil
+	case mode&fs.ModeDevice != 0:
+		dev, err := rootfs.Readnod(name)
+		if err != nil {
+			return nil, fmt.Errorf("fs.Readnod(%q): %w", name, err)
+		}
+		typeflag := byte(tar.TypeBlock)
+		if mode&fs.ModeCharDevice != 0 {
+			typeflag = tar.TypeChar
+		}
+		return &tar.Header{
+			Name:     name,
+			Typeflag: typeflag,
+			Devmajor: int64(files.Major(dev)),
+			Devminor: int64(files.Minor(dev)),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,127 @@
+package containers
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/fs"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLayer(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	rootfs := fs.NewMemFS()
+	require.NoError(t, rootfs.MkdirAll("/etc", 0755))
+	require.NoError(t, rootfs.WriteFile("/etc/hello.txt", []byte("hello world"), 0644))
+
+	tempDir := t.TempDir()
+	layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{TempDir: tempDir})
+	require.NoError(t, err)
+
+	// the layer should have been written to disk
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	t.Run("digest", func(t *testing.T) {
+		rc, err := layer.Compressed()
+		require.NoError(t, err)
+		defer rc.Close()
+		expected, size, err := v1.SHA256(rc)
+		require.NoError(t, err)
+
+		digest, err := layer.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expected, digest)
+
+		actualSize, err := layer.Size()
+		require.NoError(t, err)
+		assert.EqualValues(t, size, actualSize)
+	})
+	t.Run("diff id", func(t *testing.T) {
+		rc, err := layer.Uncompressed()
+		require.NoError(t, err)
+		defer rc.Close()
+		expected, _, err := v1.SHA256(rc)
+		require.NoError(t, err)
+
+		diffID, err := layer.DiffID()
+		require.NoError(t, err)
+		assert.Equal(t, expected, diffID)
+	})
+	t.Run("contents", func(t *testing.T) {
+		rc, err := layer.Uncompressed()
+		require.NoError(t, err)
+		defer rc.Close()
+
+		var names []string
+		tr := tar.NewReader(rc)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, header.Name)
+		}
+		assert.Contains(t, names, "/etc/hello.txt")
+	})
+	t.Run("in memory", func(t *testing.T) {
+		// without a TempDir, nothing should
+		// be left behind
+		tmp := t.TempDir()
+		t.Setenv("TMPDIR", tmp)
+		memLayer, err := NewLayer(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"})
+		require.NoError(t, err)
+		entries, err := os.ReadDir(tmp)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+
+		rc, err := memLayer.Compressed()
+		require.NoError(t, err)
+		defer rc.Close()
+		expected, _, err := v1.SHA256(rc)
+		require.NoError(t, err)
+		digest, err := memLayer.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expected, digest)
+	})
+}
+
+func TestNewLayer_Xattrs(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	rootfs := fs.NewMemFS()
+	require.NoError(t, rootfs.MkdirAll("/app", 0755))
+	require.NoError(t, rootfs.WriteFile("/app/server", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.SetXattr("/app/server", "security.capability", []byte{0x01, 0x00, 0x00, 0x02}))
+	require.NoError(t, rootfs.SetXattr("/app", "user.comment", []byte("hello")))
+
+	layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{TempDir: t.TempDir()})
+	require.NoError(t, err)
+
+	rc, err := layer.Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+
+	records := map[string]map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		records[header.Name] = header.PAXRecords
+	}
+	assert.EqualValues(t, string([]byte{0x01, 0x00, 0x00, 0x02}), records["/app/server"]["SCHILY.xattr.security.capability"])
+	assert.EqualValues(t, "hello", records["/app"]["SCHILY.xattr.user.comment"])
+}
@@ -0,0 +1,23 @@
+package containers
+
+import (
+	"io/fs"
+)
+
+// identifiable is implemented by fs.FileInfo values
+// that can tell us which underlying file they refer to
+// (e.g. vfs.VFS and vfs.LinkFS).
+type identifiable interface {
+	ID() any
+}
+
+// fileID returns a comparable value that identifies the file
+// behind the fs.FileInfo so that we can detect hard links. It
+// returns nil if the filesystem doesn't tell us, in which case
+// hard links are written as regular files.
+func fileID(info fs.FileInfo) any {
+	if v, ok := info.(identifiable); ok {
+		return v.ID()
+	}
+	return nil
+}
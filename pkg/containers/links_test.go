@@ -0,0 +1,88 @@
+package containers
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"testing"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+	"github.com/Snakdy/container-build-engine/pkg/files"
+	"github.com/Snakdy/container-build-engine/pkg/vfs"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readLayerHeaders(t *testing.T, layer v1.Layer) map[string]*tar.Header {
+	rc, err := layer.Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	return readTarHeaders(t, rc)
+}
+
+func readTarHeaders(t *testing.T, r io.Reader) map[string]*tar.Header {
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		headers[header.Name] = header
+	}
+	return headers
+}
+
+func TestNewLayer_SpecialFiles(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	var cases = []struct {
+		name   string
+		rootfs apkfs.FullFS
+		fifo   bool
+	}{
+		{"memfs", vfs.TrackLinks(apkfs.NewMemFS()), false},
+		{"dirfs", vfs.TrackLinks(apkfs.DirFS(ctx, t.TempDir())), false},
+		{"vfs", vfs.NewVFS(t.TempDir()), true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.rootfs.MkdirAll("/dev", 0755))
+			require.NoError(t, tt.rootfs.MkdirAll("/app", 0755))
+			require.NoError(t, tt.rootfs.WriteFile("/app/server", []byte("#!/bin/sh"), 0755))
+			require.NoError(t, tt.rootfs.Link("/app/server", "/app/server-link"))
+			require.NoError(t, tt.rootfs.Mknod("/dev/null", files.ModeChar|0666, files.Mkdev(1, 3)))
+			if tt.fifo {
+				require.NoError(t, tt.rootfs.Mknod("/app/pipe", files.ModeFifo|0600, 0))
+			}
+
+			layer, err := NewLayerWithOptions(ctx, tt.rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{TempDir: t.TempDir()})
+			require.NoError(t, err)
+			headers := readLayerHeaders(t, layer)
+
+			// the first file contains the content and
+			// the second links to it
+			require.Contains(t, headers, "/app/server")
+			assert.EqualValues(t, tar.TypeReg, headers["/app/server"].Typeflag)
+			require.Contains(t, headers, "/app/server-link")
+			assert.EqualValues(t, tar.TypeLink, headers["/app/server-link"].Typeflag)
+			assert.EqualValues(t, "/app/server", headers["/app/server-link"].Linkname)
+
+			require.Contains(t, headers, "/dev/null")
+			assert.EqualValues(t, tar.TypeChar, headers["/dev/null"].Typeflag)
+			assert.EqualValues(t, 1, headers["/dev/null"].Devmajor)
+			assert.EqualValues(t, 3, headers["/dev/null"].Devminor)
+			assert.EqualValues(t, 0666, headers["/dev/null"].Mode)
+
+			if tt.fifo {
+				require.Contains(t, headers, "/app/pipe")
+				assert.EqualValues(t, tar.TypeFifo, headers["/app/pipe"].Typeflag)
+				assert.EqualValues(t, 0600, headers["/app/pipe"].Mode)
+			}
+		})
+	}
+}
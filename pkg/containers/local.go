@@ -0,0 +1,98 @@
+package containers
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const (
+	SchemeOCILayout = "oci-layout://"
+	SchemeTarball   = "tarball://"
+)
+
+// AnnotationRefName is the annotation used by OCI image layouts
+// to record the tag of an image.
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
+// getLayout reads an image or index from an OCI image layout.
+// The reference may be suffixed with a tag (":tag") or
+// a digest ("@sha256:...") to select a specific entry.
+func getLayout(ctx context.Context, ref string) (Result, error) {
+	path, tag, digest := parseLayoutRef(ref)
+	log := logr.FromContextOrDiscard(ctx).WithValues("path", path, "tag", tag, "digest", digest)
+	log.V(3).Info("reading image from oci layout")
+
+	idx, err := layout.ImageIndexFromPath(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("reading oci layout %s: %w", path, err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("reading oci layout index: %w", err)
+	}
+
+	var match *v1.Descriptor
+	for _, desc := range im.Manifests {
+		switch {
+		case digest != "":
+			if desc.Digest.String() != digest {
+				continue
+			}
+		case tag != "":
+			name := desc.Annotations[AnnotationRefName]
+			if name != tag && !strings.HasSuffix(name, ":"+tag) {
+				continue
+			}
+		case len(im.Manifests) > 1:
+			// if nothing has been selected and there are many
+			// entries, then treat the layout itself as an index
+			log.V(4).Info("oci layout contains multiple entries, using it as an index")
+			return idx, nil
+		}
+		match = &desc
+		break
+	}
+	if match == nil {
+		return nil, fmt.Errorf("could not locate %s in oci layout %s", ref, path)
+	}
+
+	log.V(4).Info("found matching oci layout entry", "digest", match.Digest, "mediaType", match.MediaType)
+	if match.MediaType.IsIndex() {
+		return idx.ImageIndex(match.Digest)
+	}
+	return idx.Image(match.Digest)
+}
+
+// getTarball reads an image from a tarball created
+// by "docker save" or "crane save".
+func getTarball(ctx context.Context, path string) (Result, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("path", path)
+	log.V(3).Info("reading image from tarball")
+
+	img, err := tarball.ImageFromPath(filepath.Clean(path), nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading tarball %s: %w", path, err)
+	}
+	return img, nil
+}
+
+// parseLayoutRef splits an oci-layout reference into
+// the path, and the optional tag or digest.
+func parseLayoutRef(ref string) (path, tag, digest string) {
+	if before, after, ok := strings.Cut(ref, "@"); ok {
+		return before, "", after
+	}
+	// the tag must come after the last path element
+	// so that we don't split on colons in the directory names
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:], ""
+	}
+	return ref, "", ""
+}
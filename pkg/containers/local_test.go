@@ -0,0 +1,93 @@
+package containers
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLayoutRef(t *testing.T) {
+	var cases = []struct {
+		in     string
+		path   string
+		tag    string
+		digest string
+	}{
+		{"/path/to/dir", "/path/to/dir", "", ""},
+		{"/path/to/dir:v1", "/path/to/dir", "v1", ""},
+		{"/path/to:dir/image", "/path/to:dir/image", "", ""},
+		{"/path/to/dir@sha256:abc", "/path/to/dir", "", "sha256:abc"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			path, tag, digest := parseLayoutRef(tt.in)
+			assert.EqualValues(t, tt.path, path)
+			assert.EqualValues(t, tt.tag, tag)
+			assert.EqualValues(t, tt.digest, digest)
+		})
+	}
+}
+
+func TestGet_Local(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	img, err := random.Image(64, 1)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	// write an oci layout containing a tagged image
+	// and a multi-arch index
+	dir := filepath.Join(t.TempDir(), "layout")
+	p, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, p.AppendImage(img, layout.WithAnnotations(map[string]string{AnnotationRefName: "v1"})))
+	require.NoError(t, p.AppendIndex(newPlatformIndex(t, "linux/amd64", "linux/arm64"), layout.WithAnnotations(map[string]string{AnnotationRefName: "multi"})))
+
+	t.Run("layout by tag", func(t *testing.T) {
+		out, err := Get(ctx, SchemeOCILayout+dir+":v1")
+		require.NoError(t, err)
+		_, ok := out.(v1.Image)
+		assert.True(t, ok)
+	})
+	t.Run("layout by digest", func(t *testing.T) {
+		out, err := Get(ctx, SchemeOCILayout+dir+"@"+digest.String())
+		require.NoError(t, err)
+		_, ok := out.(v1.Image)
+		assert.True(t, ok)
+	})
+	t.Run("layout index for platform", func(t *testing.T) {
+		out, err := GetImage(ctx, SchemeOCILayout+dir+":multi", &v1.Platform{OS: "linux", Architecture: "arm64"})
+		require.NoError(t, err)
+		cfg, err := out.ConfigFile()
+		require.NoError(t, err)
+		assert.EqualValues(t, "arm64", cfg.Architecture)
+	})
+	t.Run("layout missing tag", func(t *testing.T) {
+		_, err := Get(ctx, SchemeOCILayout+dir+":missing")
+		assert.Error(t, err)
+	})
+	t.Run("tarball", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "image.tar")
+		tag, err := name.NewTag("example.com/image:latest")
+		require.NoError(t, err)
+		require.NoError(t, tarball.WriteToFile(path, tag, img))
+
+		out, err := Get(ctx, SchemeTarball+path)
+		require.NoError(t, err)
+		_, ok := out.(v1.Image)
+		assert.True(t, ok)
+	})
+}
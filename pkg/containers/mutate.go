@@ -2,7 +2,11 @@ package containers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
 	"time"
 
 	"github.com/Snakdy/container-build-engine/pkg/containers/cache"
@@ -47,13 +51,27 @@ func toOCIV1ConfigFile(cf *v1.ConfigFile) *v1.ConfigFile {
 //
 // Check image-spec to see which properties are ported and which are dropped.
 // https://github.com/opencontainers/image-spec/blob/main/config.md
+//
+// The conversion is controlled by the NormaliseMode set by
+// WithNormaliseMode. If the image already uses OCI media types,
+// only the config is converted.
 func NormaliseImage(ctx context.Context, base v1.Image) (v1.Image, error) {
 	log := logr.FromContextOrDiscard(ctx)
-	log.V(2).Info("normalising base image - this may take a while if its the first time")
-	log.V(3).Info("we do this to make sure that media type between layers is consistent")
+	mode := NormaliseModeFromContext(ctx)
 
 	start := time.Now()
 
+	// remember where the image came from since
+	// normalising it changes the digest
+	source, err := SourceDigest(base)
+	if err != nil {
+		return nil, err
+	}
+	if mode == NormaliseNone {
+		log.V(2).Info("skipping base image normalisation")
+		return &normalisedImage{Image: base, source: source}, nil
+	}
+
 	// get the original manifest
 	m, err := base.Manifest()
 	if err != nil {
@@ -64,8 +82,38 @@ func NormaliseImage(ctx context.Context, base v1.Image) (v1.Image, error) {
 	if err != nil {
 		return nil, err
 	}
+	annotations := m.Annotations
+	if mode == NormaliseAnnotate {
+		annotations, err = dockerAnnotations(cfg.Config, m.Annotations)
+		if err != nil {
+			return nil, err
+		}
+	}
 	cfg = toOCIV1ConfigFile(cfg)
 
+	c := cache.FromContext(ctx)
+
+	// the layers are already OCI, so
+	// we only need to convert the config
+	if isOCIManifest(m) {
+		log.V(3).Info("base image is already in OCI format")
+		base, err = cacheLayers(ctx, c, base)
+		if err != nil {
+			return nil, err
+		}
+		base = mutate.ConfigMediaType(base, types.OCIConfigJSON)
+		base = mutate.Annotations(base, annotations).(v1.Image)
+		base, err = mutate.ConfigFile(base, cfg)
+		if err != nil {
+			return nil, err
+		}
+		log.V(3).Info("successfully normalised base image", "duration", time.Since(start))
+		return &normalisedImage{Image: base, source: source}, nil
+	}
+
+	log.V(2).Info("normalising base image - this may take a while if its the first time")
+	log.V(3).Info("we do this to make sure that media type between layers is consistent")
+
 	layers, err := base.Layers()
 	if err != nil {
 		return nil, err
@@ -74,8 +122,6 @@ func NormaliseImage(ctx context.Context, base v1.Image) (v1.Image, error) {
 	//goland:noinspection GoPreferNilSlice
 	newLayers := []v1.Layer{}
 
-	c := cache.NewFilesystemCache(cache.Dir())
-
 	// go through each layer and convert it to
 	// OCI format
 	for _, layer := range layers {
@@ -123,11 +169,214 @@ func NormaliseImage(ctx context.Context, base v1.Image) (v1.Image, error) {
 
 	base = mutate.MediaType(base, types.OCIManifestSchema1)
 	base = mutate.ConfigMediaType(base, types.OCIConfigJSON)
-	base = mutate.Annotations(base, m.Annotations).(v1.Image)
+	base = mutate.Annotations(base, annotations).(v1.Image)
 	base, err = mutate.ConfigFile(base, cfg)
 	if err != nil {
 		return nil, err
 	}
 	log.V(3).Info("successfully normalised base image", "duration", time.Since(start))
+	return &normalisedImage{Image: base, source: source}, nil
+}
+
+// cacheLayers stores the layers of an OCI image in the cache
+// (keyed by their diffID) and reads them back from it, so
+// that they don't need to be downloaded again and can be
+// shared with other runners.
+//
+// The manifest isn't changed, so cached layers are only
+// used if they're identical to the originals.
+func cacheLayers(ctx context.Context, c cache.Cache, base v1.Image) (v1.Image, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	layers, err := base.Layers()
+	if err != nil {
+		return nil, err
+	}
+	img := &cachedImage{Image: base, layers: make([]v1.Layer, 0, len(layers))}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("getting digest: %w", err)
+		}
+		diffId, err := layer.DiffID()
+		if err != nil {
+			return nil, fmt.Errorf("getting diff id: %w", err)
+		}
+		l, err := c.Get(diffId)
+		if err != nil {
+			mediaType, err := layer.MediaType()
+			if err != nil {
+				return nil, fmt.Errorf("getting media type: %w", err)
+			}
+			l = layer
+			// prefer the copy on disk so that we only
+			// download the layer once
+			if _, err := c.Put(diffId, layer, mediaType != types.OCIUncompressedLayer); err != nil {
+				log.V(4).Info("failed to cache layer", "diffId", diffId, "error", err)
+			} else if cl, err := c.Get(diffId); err == nil {
+				l = cl
+			}
+		}
+		// the same content may have been
+		// cached using a different compression
+		if d, err := l.Digest(); err != nil || d != digest {
+			log.V(4).Info("ignoring cached layer since it doesn't match the manifest", "diffId", diffId, "digest", digest)
+			l = layer
+		} else {
+			log.V(4).Info("using cached layer", "diffId", diffId)
+		}
+		img.layers = append(img.layers, l)
+	}
+	return img, nil
+}
+
+// cachedImage is an image whose layers
+// are read from the layer cache.
+type cachedImage struct {
+	v1.Image
+	layers []v1.Layer
+}
+
+func (i *cachedImage) Layers() ([]v1.Layer, error) {
+	return i.layers, nil
+}
+
+func (i *cachedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.Digest(); err == nil && d == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDigest(h)
+}
+
+func (i *cachedImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.DiffID(); err == nil && d == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDiffID(h)
+}
+
+// normalisedImage is an image that has been converted by
+// NormaliseImage and remembers the digest of the original.
+type normalisedImage struct {
+	v1.Image
+	source v1.Hash
+}
+
+// SourceDigest returns the digest of the image before it was
+// normalised, which is the one that can be found in the registry.
+// If the image wasn't normalised, its own digest is returned.
+func SourceDigest(img v1.Image) (v1.Hash, error) {
+	if n, ok := img.(*normalisedImage); ok {
+		return n.source, nil
+	}
+	return img.Digest()
+}
+
+// RecompressImage rewrites the layers of the provided v1.Image
+// so that they use the compression nominated in the LayerOptions.
+//
+// Layers that already have the correct media type are left as-is.
+// Recompressed layers are cached using a key derived from the
+// diffID and compression settings.
+func RecompressImage(ctx context.Context, base v1.Image, opts LayerOptions) (v1.Image, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	log.V(2).Info("recompressing base image", "compression", opts.GetCompression(), "level", opts.CompressionLevel)
+
+	start := time.Now()
+
+	m, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := base.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	//goland:noinspection GoPreferNilSlice
+	newLayers := []v1.Layer{}
+
+	c := cache.FromContext(ctx)
+
+	for _, layer := range layers {
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return nil, fmt.Errorf("getting media type: %w", err)
+		}
+		if mediaType == opts.GetCompression().MediaType() {
+			newLayers = append(newLayers, layer)
+			continue
+		}
+		diffId, err := layer.DiffID()
+		if err != nil {
+			return nil, fmt.Errorf("getting diff id: %w", err)
+		}
+		key := recompressKey(diffId, opts)
+		// check if we have a cached layer
+		if l, err := c.Get(key); err == nil {
+			log.V(4).Info("skipping layer recompression as we have a cached copy", "diffId", diffId)
+			newLayers = append(newLayers, l)
+			continue
+		}
+		log.V(4).Info("recompressing layer", "mediaType", mediaType, "diffId", diffId)
+		l, err := newFileLayer(ctx, opts, func(w io.Writer) error {
+			rc, err := layer.Uncompressed()
+			if err != nil {
+				return fmt.Errorf("reading layer: %w", err)
+			}
+			defer rc.Close()
+			if _, err := io.Copy(w, rc); err != nil {
+				return fmt.Errorf("copying layer: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("recompressing layer %s: %w", diffId, err)
+		}
+		if l.diffID != diffId {
+			return nil, fmt.Errorf("recompressing layer %s: diffID changed to %s", diffId, l.diffID)
+		}
+		// prefer the cached copy so that we don't
+		// leave temporary files lying around
+		if _, err := c.Put(key, l, true); err != nil {
+			log.V(4).Info("failed to cache recompressed layer", "diffId", diffId, "error", err)
+		} else if cl, err := c.Get(key); err == nil {
+			if l.path != "" {
+				_ = os.Remove(l.path)
+			}
+			newLayers = append(newLayers, cl)
+			continue
+		}
+		newLayers = append(newLayers, l)
+	}
+
+	base, err = mutate.AppendLayers(empty.Image, newLayers...)
+	if err != nil {
+		return nil, err
+	}
+
+	base = mutate.MediaType(base, types.OCIManifestSchema1)
+	base = mutate.ConfigMediaType(base, types.OCIConfigJSON)
+	base = mutate.Annotations(base, m.Annotations).(v1.Image)
+	base, err = mutate.ConfigFile(base, cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.V(3).Info("successfully recompressed base image", "duration", time.Since(start))
 	return base, nil
 }
+
+// recompressKey generates a cache key for a layer
+// that has been recompressed with the given options.
+func recompressKey(diffId v1.Hash, opts LayerOptions) v1.Hash {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%s", opts.GetCompression(), opts.CompressionLevel, diffId)))
+	return v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}
+}
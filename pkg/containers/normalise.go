@@ -0,0 +1,135 @@
+package containers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strconv"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// NormaliseMode controls how NormaliseImage
+// converts the base image.
+type NormaliseMode string
+
+const (
+	// NormaliseOCI converts the image to OCI format and
+	// drops the Docker specific config fields.
+	NormaliseOCI NormaliseMode = "oci"
+	// NormaliseAnnotate converts the image to OCI format
+	// and records the Docker specific config fields as
+	// manifest annotations.
+	NormaliseAnnotate NormaliseMode = "annotate"
+	// NormaliseNone leaves the image as-is, keeping its
+	// media types and config fields.
+	NormaliseNone NormaliseMode = "none"
+)
+
+// Annotations used by NormaliseAnnotate to record the
+// config fields that are dropped by the OCI conversion.
+// Values other than AnnotationDockerArgsEscaped are JSON.
+const (
+	AnnotationDockerHealthcheck = "dev.snakdy.cbe.docker.healthcheck"
+	AnnotationDockerShell       = "dev.snakdy.cbe.docker.shell"
+	AnnotationDockerOnBuild     = "dev.snakdy.cbe.docker.onbuild"
+	AnnotationDockerArgsEscaped = "dev.snakdy.cbe.docker.argsescaped"
+)
+
+// ParseNormaliseMode converts a string into a NormaliseMode
+// and returns an error if it's not supported.
+func ParseNormaliseMode(s string) (NormaliseMode, error) {
+	switch m := NormaliseMode(s); m {
+	case NormaliseOCI, NormaliseAnnotate, NormaliseNone:
+		return m, nil
+	case "":
+		return NormaliseOCI, nil
+	default:
+		return "", fmt.Errorf("unsupported normalisation mode: %s", s)
+	}
+}
+
+type normaliseModeKey struct{}
+
+// WithNormaliseMode returns a context that instructs
+// NormaliseImage to use the given mode.
+func WithNormaliseMode(ctx context.Context, mode NormaliseMode) context.Context {
+	return context.WithValue(ctx, normaliseModeKey{}, mode)
+}
+
+// NormaliseModeFromContext returns the NormaliseMode in
+// the context, or NormaliseOCI if there isn't one.
+func NormaliseModeFromContext(ctx context.Context) NormaliseMode {
+	if m, ok := ctx.Value(normaliseModeKey{}).(NormaliseMode); ok && m != "" {
+		return m
+	}
+	return NormaliseOCI
+}
+
+// dockerAnnotations returns a copy of the annotations with
+// the Docker specific config fields added.
+func dockerAnnotations(cfg v1.Config, annotations map[string]string) (map[string]string, error) {
+	out := maps.Clone(annotations)
+	if out == nil {
+		out = map[string]string{}
+	}
+	set := func(key string, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", key, err)
+		}
+		out[key] = string(data)
+		return nil
+	}
+	if cfg.Healthcheck != nil {
+		if err := set(AnnotationDockerHealthcheck, cfg.Healthcheck); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Shell) > 0 {
+		if err := set(AnnotationDockerShell, cfg.Shell); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.OnBuild) > 0 {
+		if err := set(AnnotationDockerOnBuild, cfg.OnBuild); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ArgsEscaped {
+		out[AnnotationDockerArgsEscaped] = strconv.FormatBool(cfg.ArgsEscaped)
+	}
+	return out, nil
+}
+
+// isOCIManifest returns true if the manifest and its
+// layers already use OCI media types, in which case
+// there's no need to rewrite the layers.
+func isOCIManifest(m *v1.Manifest) bool {
+	if m.MediaType != types.OCIManifestSchema1 {
+		return false
+	}
+	for _, l := range m.Layers {
+		switch l.MediaType {
+		case types.DockerLayer, types.DockerUncompressedLayer:
+			return false
+		}
+	}
+	return true
+}
+
+// DockerLayerMediaType returns the Docker equivalent of
+// an OCI layer media type so that layers can be appended
+// to an image that hasn't been normalised.
+func DockerLayerMediaType(mediaType types.MediaType) (types.MediaType, error) {
+	switch mediaType {
+	case types.OCILayer, types.DockerLayer:
+		return types.DockerLayer, nil
+	case types.OCIUncompressedLayer, types.DockerUncompressedLayer:
+		return types.DockerUncompressedLayer, nil
+	default:
+		return "", fmt.Errorf("%s layers can't be added to a Docker image", mediaType)
+	}
+}
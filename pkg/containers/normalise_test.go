@@ -0,0 +1,221 @@
+package containers
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers/cache"
+	"github.com/Snakdy/container-build-engine/pkg/oci/empty"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDockerTestImage(t *testing.T) v1.Image {
+	img, err := random.Image(64, 2)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.Config.Healthcheck = &v1.HealthConfig{Test: []string{"CMD", "true"}}
+	cfg.Config.Shell = []string{"/bin/bash", "-c"}
+	cfg.Config.OnBuild = []string{"RUN make"}
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	return img
+}
+
+func TestParseNormaliseMode(t *testing.T) {
+	var cases = []struct {
+		in       string
+		expected NormaliseMode
+		ok       bool
+	}{
+		{"", NormaliseOCI, true},
+		{"oci", NormaliseOCI, true},
+		{"annotate", NormaliseAnnotate, true},
+		{"none", NormaliseNone, true},
+		{"docker", "", false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := ParseNormaliseMode(tt.in)
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestNormaliseImage(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	img := newDockerTestImage(t)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	t.Run("oci", func(t *testing.T) {
+		out, err := NormaliseImage(ctx, img)
+		require.NoError(t, err)
+
+		m, err := out.Manifest()
+		require.NoError(t, err)
+		assert.EqualValues(t, types.OCIManifestSchema1, m.MediaType)
+		for _, l := range m.Layers {
+			assert.EqualValues(t, types.OCILayer, l.MediaType)
+		}
+		assert.NotContains(t, m.Annotations, AnnotationDockerHealthcheck)
+
+		cfg, err := out.ConfigFile()
+		require.NoError(t, err)
+		assert.Nil(t, cfg.Config.Healthcheck)
+		assert.Empty(t, cfg.Config.Shell)
+
+		source, err := SourceDigest(out)
+		require.NoError(t, err)
+		assert.Equal(t, digest, source)
+	})
+	t.Run("annotate", func(t *testing.T) {
+		out, err := NormaliseImage(WithNormaliseMode(ctx, NormaliseAnnotate), img)
+		require.NoError(t, err)
+
+		m, err := out.Manifest()
+		require.NoError(t, err)
+		assert.EqualValues(t, types.OCIManifestSchema1, m.MediaType)
+		assert.JSONEq(t, `{"Test":["CMD","true"]}`, m.Annotations[AnnotationDockerHealthcheck])
+		assert.JSONEq(t, `["/bin/bash","-c"]`, m.Annotations[AnnotationDockerShell])
+		assert.JSONEq(t, `["RUN make"]`, m.Annotations[AnnotationDockerOnBuild])
+		assert.NotContains(t, m.Annotations, AnnotationDockerArgsEscaped)
+
+		cfg, err := out.ConfigFile()
+		require.NoError(t, err)
+		assert.Nil(t, cfg.Config.Healthcheck)
+	})
+	t.Run("none", func(t *testing.T) {
+		out, err := NormaliseImage(WithNormaliseMode(ctx, NormaliseNone), img)
+		require.NoError(t, err)
+
+		actual, err := out.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, digest, actual)
+
+		cfg, err := out.ConfigFile()
+		require.NoError(t, err)
+		assert.NotNil(t, cfg.Config.Healthcheck)
+	})
+}
+
+func TestNormaliseImage_OCI(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	img, err := NormaliseImage(ctx, newDockerTestImage(t))
+	require.NoError(t, err)
+	layers, err := img.Layers()
+	require.NoError(t, err)
+
+	// normalising an OCI image shouldn't
+	// touch its layers
+	out, err := NormaliseImage(ctx, img)
+	require.NoError(t, err)
+	expected, err := img.Digest()
+	require.NoError(t, err)
+	actual, err := out.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	outLayers, err := out.Layers()
+	require.NoError(t, err)
+	require.Len(t, outLayers, len(layers))
+	for i := range layers {
+		expected, err := layers[i].Digest()
+		require.NoError(t, err)
+		actual, err := outLayers[i].Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestNormaliseImage_OCICacheTo(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	ref := u.Host + "/cache:main"
+
+	var layers []v1.Layer
+	for range 2 {
+		l, err := random.Layer(64, types.OCILayer)
+		require.NoError(t, err)
+		layers = append(layers, l)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	require.NoError(t, err)
+	img = mutate.MediaType(img, types.OCIManifestSchema1)
+	m, err := img.Manifest()
+	require.NoError(t, err)
+	require.True(t, isOCIManifest(m))
+
+	// the equivalent of --cache-to
+	to, err := cache.NewRegistryCache(ctx, ref)
+	require.NoError(t, err)
+	c := cache.NewTieredCache(cache.NewFilesystemCache(t.TempDir()), nil, []cache.Cache{to})
+	_, err = NormaliseImage(cache.WithCache(ctx, c), img)
+	require.NoError(t, err)
+	require.NoError(t, to.Export(ctx))
+
+	// every base layer has been exported
+	from, err := cache.NewRegistryCache(ctx, ref)
+	require.NoError(t, err)
+	for _, l := range layers {
+		diffId, err := l.DiffID()
+		require.NoError(t, err)
+		cached, err := from.Get(diffId)
+		require.NoError(t, err)
+		expected, err := l.Digest()
+		require.NoError(t, err)
+		actual, err := cached.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestDockerLayerMediaType(t *testing.T) {
+	var cases = []struct {
+		in       types.MediaType
+		expected types.MediaType
+		ok       bool
+	}{
+		{types.OCILayer, types.DockerLayer, true},
+		{types.OCIUncompressedLayer, types.DockerUncompressedLayer, true},
+		{types.DockerLayer, types.DockerLayer, true},
+		{types.OCILayerZStd, "", false},
+	}
+	for _, tt := range cases {
+		t.Run(string(tt.in), func(t *testing.T) {
+			out, err := DockerLayerMediaType(tt.in)
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
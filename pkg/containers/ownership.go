@@ -0,0 +1,141 @@
+package containers
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	fullfs "chainguard.dev/apko/pkg/apk/fs"
+	"github.com/go-logr/logr"
+)
+
+// OwnershipRule overrides the ownership and permissions of
+// any files in the generated layer that match the pattern.
+type OwnershipRule struct {
+	// Pattern is a glob (see path.Match) that is matched against
+	// the absolute path of each file. A "**" segment matches
+	// zero or more directories, e.g. "/app/**".
+	Pattern string
+	// Uid is the numerical owner of the file.
+	Uid *int
+	// Gid is the numerical group of the file.
+	Gid *int
+	// Mode is the permission bits of the file.
+	Mode *fs.FileMode
+}
+
+// Matches returns true if the rule applies
+// to the given path.
+func (r *OwnershipRule) Matches(name string) bool {
+	return matchGlob(strings.Split(strings.Trim(r.Pattern, "/"), "/"), strings.Split(strings.Trim(name, "/"), "/"))
+}
+
+func matchGlob(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try to match the rest of the pattern against
+			// every possible suffix of the name
+			for i := 0; i <= len(name); i++ {
+				if matchGlob(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// fileAttributes is the ownership and permissions
+// that a file has in the layer.
+type fileAttributes struct {
+	uid  int
+	gid  int
+	mode int64
+}
+
+// getAttributes works out the ownership and permissions of a file.
+//
+// We start with whatever is recorded by the virtual filesystem,
+// then apply the ownership rules in order. Filesystems report
+// the ownership that they've recorded as a *tar.Header from
+// fs.FileInfo.Sys.
+func getAttributes(ctx context.Context, rootfs fullfs.FullFS, name, username string, userId int, rules []OwnershipRule) (fileAttributes, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	var attrs fileAttributes
+	var mode fs.FileMode
+	var owned bool
+	info, err := rootfs.Lstat(name)
+	switch {
+	case err == nil:
+		mode = info.Mode()
+		if h, ok := info.Sys().(*tar.Header); ok {
+			attrs.uid = h.Uid
+			attrs.gid = h.Gid
+			owned = true
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		// we found the file by reading the directory, so it
+		// must be a dangling symbolic link that the memfs
+		// can't Lstat
+		log.V(5).Info("unable to stat file, assuming that it's a dangling symbolic link", "path", name)
+		mode = fs.ModeSymlink | fs.ModePerm
+	default:
+		return fileAttributes{}, fmt.Errorf("fs.Lstat(%q): %w", name, err)
+	}
+
+	// files in the user's home directory belong to them
+	// unless the filesystem has recorded an owner
+	home := filepath.Join("/home", username)
+	if !owned && (name == home || strings.HasPrefix(name, home+"/")) {
+		log.V(4).Info("adding user owned file", "path", name)
+		attrs.uid = userId
+	}
+
+	for _, r := range rules {
+		if !r.Matches(name) {
+			continue
+		}
+		log.V(5).Info("applying ownership rule", "path", name, "pattern", r.Pattern)
+		if r.Uid != nil {
+			attrs.uid = *r.Uid
+		}
+		if r.Gid != nil {
+			attrs.gid = *r.Gid
+		}
+		if r.Mode != nil {
+			mode = mode.Type() | *r.Mode
+		}
+	}
+	attrs.mode = tarMode(mode)
+	return attrs, nil
+}
+
+// tarMode converts fs.FileMode permissions into
+// the bits expected by a tar header.
+func tarMode(m fs.FileMode) int64 {
+	mode := int64(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return mode
+}
@@ -0,0 +1,97 @@
+package containers
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+	"github.com/Snakdy/container-build-engine/pkg/vfs"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwnershipRule_Matches(t *testing.T) {
+	var cases = []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"/app/server", "/app/server", true},
+		{"/app/*", "/app/server", true},
+		{"/app/*", "/app/bin/server", false},
+		{"/app/**", "/app", true},
+		{"/app/**", "/app/bin/server", true},
+		{"/app/**/*.sh", "/app/run.sh", true},
+		{"/app/**/*.sh", "/app/bin/run.sh", true},
+		{"/app/**/*.sh", "/app/bin/run.py", false},
+		{"**/*.sh", "/usr/local/bin/run.sh", true},
+		{"/etc/*", "/app/server", false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			r := OwnershipRule{Pattern: tt.pattern}
+			assert.EqualValues(t, tt.match, r.Matches(tt.name))
+		})
+	}
+}
+
+func TestNewLayer_Ownership(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	// the builder wraps the filesystem so that
+	// we know which files have an owner
+	rootfs := vfs.TrackLinks(apkfs.NewMemFS())
+	require.NoError(t, rootfs.MkdirAll("/app/bin", 0750))
+	require.NoError(t, rootfs.WriteFile("/app/bin/server", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.WriteFile("/app/config.yaml", []byte("foo: bar"), 0644))
+	require.NoError(t, rootfs.Chown("/app/config.yaml", 1002, 1003))
+	require.NoError(t, rootfs.MkdirAll("/home/somebody", 0700))
+	require.NoError(t, rootfs.WriteFile("/home/somebody/.profile", []byte(""), 0644))
+	require.NoError(t, rootfs.WriteFile("/home/somebody/.rootrc", []byte(""), 0644))
+	require.NoError(t, rootfs.Chown("/home/somebody/.rootrc", 0, 0))
+
+	uid := 1001
+	mode := fs.FileMode(0500)
+	layer, err := NewLayerWithOptions(ctx, rootfs, "somebody", 1001, &v1.Platform{OS: "linux", Architecture: "amd64"}, LayerOptions{
+		TempDir: t.TempDir(),
+		Ownership: []OwnershipRule{
+			{Pattern: "/app/bin/**", Uid: &uid},
+			{Pattern: "/app/bin/server", Mode: &mode},
+		},
+	})
+	require.NoError(t, err)
+
+	headers := readLayerHeaders(t, layer)
+
+	var cases = []struct {
+		name string
+		uid  int
+		gid  int
+		mode int64
+	}{
+		// ownership recorded in the filesystem
+		{"/app", 0, 0, 0750},
+		{"/app/config.yaml", 1002, 1003, 0644},
+		// files in the users home directory
+		{"/home/somebody", 1001, 0, 0700},
+		{"/home/somebody/.profile", 1001, 0, 0644},
+		// unless they've been given an owner
+		{"/home/somebody/.rootrc", 0, 0, 0644},
+		// rules
+		{"/app/bin", 1001, 0, 0750},
+		{"/app/bin/server", 1001, 0, 0500},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			header, ok := headers[tt.name]
+			require.True(t, ok)
+			assert.EqualValues(t, tt.uid, header.Uid)
+			assert.EqualValues(t, tt.gid, header.Gid)
+			assert.EqualValues(t, tt.mode, header.Mode)
+		})
+	}
+}
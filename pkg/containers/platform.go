@@ -0,0 +1,79 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var ErrPlatformNotFound = errors.New("base image does not provide the requested platform")
+
+// MatchPlatform locates the descriptor within an index
+// that satisfies the given platform.
+//
+// It's vaguely based on the Ko platformMatcher
+// logic, but not as in-depth since we don't care
+// about Windows.
+//
+// https://github.com/ko-build/ko/blob/main/pkg/build/gobuild.go#L1468
+func MatchPlatform(ctx context.Context, idx v1.ImageIndex, platform *v1.Platform) (*v1.Descriptor, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	simplePlatform := v1.Platform{
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		OSVersion:    platform.OSVersion,
+		Variant:      platform.Variant,
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range im.Manifests {
+		log.V(6).Info("checking descriptor", "platform", desc.Platform, "mediaType", desc.MediaType)
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.Satisfies(simplePlatform) {
+			log.V(3).Info("found matching platform", "platform", desc.Platform)
+			return &desc, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrPlatformNotFound, platform)
+}
+
+// ImageForPlatform returns the v1.Image that can be used to
+// build the given platform. If the Result is an index, the
+// matching child is extracted. If it's a standalone image,
+// its config is checked to make sure that it's compatible.
+func ImageForPlatform(ctx context.Context, base Result, platform *v1.Platform) (v1.Image, error) {
+	switch v := base.(type) {
+	case v1.ImageIndex:
+		desc, err := MatchPlatform(ctx, v, platform)
+		if err != nil {
+			return nil, err
+		}
+		img, err := v.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("extracting image from index: %w", err)
+		}
+		return img, nil
+	case v1.Image:
+		cfg, err := v.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("extracting config: %w", err)
+		}
+		// images without any platform information (e.g., scratch)
+		// can be used for any platform
+		if p := cfg.Platform(); p != nil && !p.Satisfies(v1.Platform{OS: platform.OS, Architecture: platform.Architecture, Variant: platform.Variant}) {
+			return nil, fmt.Errorf("%w: %s (image is %s)", ErrPlatformNotFound, platform, p)
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported image type: %T", base)
+	}
+}
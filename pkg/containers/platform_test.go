@@ -0,0 +1,89 @@
+package containers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Snakdy/container-build-engine/pkg/oci/empty"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	v1empty "github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPlatformImage(t *testing.T, platform string) v1.Image {
+	p, err := v1.ParsePlatform(platform)
+	require.NoError(t, err)
+
+	img, err := random.Image(64, 1)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.OS = p.OS
+	cfg.Architecture = p.Architecture
+	cfg.Variant = p.Variant
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	return img
+}
+
+func newPlatformIndex(t *testing.T, platforms ...string) v1.ImageIndex {
+	var adds []mutate.IndexAddendum
+	for _, platform := range platforms {
+		p, err := v1.ParsePlatform(platform)
+		require.NoError(t, err)
+		adds = append(adds, mutate.IndexAddendum{
+			Add: newPlatformImage(t, platform),
+			Descriptor: v1.Descriptor{
+				Platform: p,
+			},
+		})
+	}
+	return mutate.AppendManifests(v1empty.Index, adds...)
+}
+
+func TestMatchPlatform(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	idx := newPlatformIndex(t, "linux/amd64", "linux/arm64/v8")
+
+	t.Run("matching platform", func(t *testing.T) {
+		desc, err := MatchPlatform(ctx, idx, &v1.Platform{OS: "linux", Architecture: "arm64"})
+		require.NoError(t, err)
+		assert.EqualValues(t, "arm64", desc.Platform.Architecture)
+	})
+	t.Run("missing platform", func(t *testing.T) {
+		_, err := MatchPlatform(ctx, idx, &v1.Platform{OS: "linux", Architecture: "s390x"})
+		assert.ErrorIs(t, err, ErrPlatformNotFound)
+	})
+}
+
+func TestImageForPlatform(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	t.Run("index", func(t *testing.T) {
+		img, err := ImageForPlatform(ctx, newPlatformIndex(t, "linux/amd64", "linux/arm64"), &v1.Platform{OS: "linux", Architecture: "arm64"})
+		require.NoError(t, err)
+		cfg, err := img.ConfigFile()
+		require.NoError(t, err)
+		assert.EqualValues(t, "arm64", cfg.Architecture)
+	})
+	t.Run("image with matching platform", func(t *testing.T) {
+		_, err := ImageForPlatform(ctx, newPlatformImage(t, "linux/amd64"), &v1.Platform{OS: "linux", Architecture: "amd64"})
+		assert.NoError(t, err)
+	})
+	t.Run("image with different platform", func(t *testing.T) {
+		_, err := ImageForPlatform(ctx, newPlatformImage(t, "linux/amd64"), &v1.Platform{OS: "linux", Architecture: "arm64"})
+		assert.ErrorIs(t, err, ErrPlatformNotFound)
+	})
+	t.Run("scratch image", func(t *testing.T) {
+		img, err := ImageForPlatform(ctx, empty.Image, &v1.Platform{OS: "linux", Architecture: "arm64"})
+		assert.NoError(t, err)
+		assert.Equal(t, empty.Image, img)
+	})
+}
@@ -0,0 +1,219 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Snakdy/container-build-engine/pkg/oci/empty"
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Annotations used to record the base image.
+// See: https://github.com/opencontainers/image-spec/blob/main/annotations.md
+const (
+	AnnotationBaseImageName   = "org.opencontainers.image.base.name"
+	AnnotationBaseImageDigest = "org.opencontainers.image.base.digest"
+)
+
+var (
+	ErrNoBaseImage = errors.New("image does not record its base image")
+	ErrNotBasedOn  = errors.New("image is not based on the old base image")
+)
+
+// SetBaseAnnotations records the base image in the manifest
+// annotations so that the image can be rebased later on.
+func SetBaseAnnotations(img v1.Image, ref string, digest v1.Hash) (v1.Image, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	annotations := maps.Clone(m.Annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[AnnotationBaseImageName] = ref
+	annotations[AnnotationBaseImageDigest] = digest.String()
+	return mutate.Annotations(img, annotations).(v1.Image), nil
+}
+
+// BaseImageRef returns a reference to the exact base
+// image that was recorded by SetBaseAnnotations.
+func BaseImageRef(img v1.Image) (string, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return "", err
+	}
+	ref := m.Annotations[AnnotationBaseImageName]
+	digest := m.Annotations[AnnotationBaseImageDigest]
+	if ref == "" || digest == "" {
+		return "", ErrNoBaseImage
+	}
+	switch {
+	case strings.HasPrefix(ref, SchemeOCILayout):
+		// layout references can't have both a tag
+		// and a digest, so the tag is dropped
+		path, _, _ := parseLayoutRef(strings.TrimPrefix(ref, SchemeOCILayout))
+		return fmt.Sprintf("%s%s@%s", SchemeOCILayout, path, digest), nil
+	case strings.HasPrefix(ref, SchemeTarball):
+		// tarballs hold a single image, so
+		// there's nothing to select
+		return ref, nil
+	}
+	// the digest is more specific than the tag, but
+	// we keep the tag since it's useful in the logs
+	return fmt.Sprintf("%s@%s", strings.SplitN(ref, "@", 2)[0], digest), nil
+}
+
+// RebaseImage replaces the layers of oldBase at the bottom of
+// img with those of newBase, keeping the layers that were
+// added on top.
+//
+// The config is taken from img, with the platform coming from
+// newBase. Environment variables and labels that were
+// inherited from oldBase without changes are updated to match
+// newBase.
+func RebaseImage(ctx context.Context, img, oldBase, newBase v1.Image) (v1.Image, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("rebasing image")
+	start := time.Now()
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting image config: %w", err)
+	}
+	cfg = cfg.DeepCopy()
+	oldCfg, err := oldBase.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting old base config: %w", err)
+	}
+	newCfg, err := newBase.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting new base config: %w", err)
+	}
+
+	// make sure that the bottom layers
+	// are actually the old base
+	oldDiffIDs := oldCfg.RootFS.DiffIDs
+	if len(oldDiffIDs) > len(cfg.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("%w: image has %d layers but the base has %d", ErrNotBasedOn, len(cfg.RootFS.DiffIDs), len(oldDiffIDs))
+	}
+	for i := range oldDiffIDs {
+		if oldDiffIDs[i] != cfg.RootFS.DiffIDs[i] {
+			return nil, fmt.Errorf("%w: layer %d is %s but the base has %s", ErrNotBasedOn, i, cfg.RootFS.DiffIDs[i], oldDiffIDs[i])
+		}
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	newBaseLayers, err := newBase.Layers()
+	if err != nil {
+		return nil, err
+	}
+	ours := layers[len(oldDiffIDs):]
+	log.V(2).Info("replacing base layers", "old", len(oldDiffIDs), "new", len(newBaseLayers), "ours", len(ours))
+
+	out, err := mutate.AppendLayers(empty.Image, slices.Concat(newBaseLayers, ours)...)
+	if err != nil {
+		return nil, err
+	}
+	out = mutate.MediaType(out, types.OCIManifestSchema1)
+	out = mutate.ConfigMediaType(out, types.OCIConfigJSON)
+	out = mutate.Annotations(out, m.Annotations).(v1.Image)
+
+	cfg.RootFS.DiffIDs = slices.Concat(newCfg.RootFS.DiffIDs, cfg.RootFS.DiffIDs[len(oldDiffIDs):])
+	var history []v1.History
+	if len(cfg.History) >= len(oldCfg.History) {
+		history = cfg.History[len(oldCfg.History):]
+	}
+	cfg.History = slices.Concat(newCfg.History, history)
+	cfg.Architecture = newCfg.Architecture
+	cfg.OS = newCfg.OS
+	cfg.OSVersion = newCfg.OSVersion
+	cfg.OSFeatures = newCfg.OSFeatures
+	cfg.Variant = newCfg.Variant
+	cfg.Config.Env = rebaseEnv(oldCfg.Config.Env, cfg.Config.Env, newCfg.Config.Env)
+	cfg.Config.Labels = rebaseLabels(oldCfg.Config.Labels, cfg.Config.Labels, newCfg.Config.Labels)
+
+	out, err = mutate.ConfigFile(out, cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("rebased image", "duration", time.Since(start))
+	return out, nil
+}
+
+// rebaseEnv updates the environment variables that we
+// inherited from the old base image to match the new one.
+// Variables that we've changed or added are kept.
+func rebaseEnv(oldBase, ours, newBase []string) []string {
+	toMap := func(env []string) map[string]string {
+		m := make(map[string]string, len(env))
+		for _, e := range env {
+			k, v, _ := strings.Cut(e, "=")
+			m[k] = v
+		}
+		return m
+	}
+	merged := rebaseLabels(toMap(oldBase), toMap(ours), toMap(newBase))
+
+	// keep the order of our variables, adding
+	// any new ones from the base at the end
+	var out []string
+	seen := map[string]bool{}
+	for _, e := range slices.Concat(ours, newBase) {
+		k, _, _ := strings.Cut(e, "=")
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if v, ok := merged[k]; ok {
+			out = append(out, k+"="+v)
+		}
+	}
+	return out
+}
+
+// rebaseLabels performs a three-way merge so that values
+// inherited from the old base image are replaced by those
+// in the new one.
+func rebaseLabels(oldBase, ours, newBase map[string]string) map[string]string {
+	if ours == nil && newBase == nil {
+		return nil
+	}
+	out := map[string]string{}
+	for k, v := range ours {
+		ov, inherited := oldBase[k]
+		if !inherited || ov != v {
+			out[k] = v
+			continue
+		}
+		// we didn't change it, so use
+		// whatever the new base has
+		if nv, ok := newBase[k]; ok {
+			out[k] = nv
+		}
+	}
+	for k, v := range newBase {
+		if _, ok := oldBase[k]; ok {
+			continue
+		}
+		if _, ok := out[k]; !ok {
+			out[k] = v
+		}
+	}
+	return out
+}
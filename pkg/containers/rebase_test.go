@@ -0,0 +1,153 @@
+package containers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRebaseTestBase(t *testing.T, env []string, labels map[string]string) v1.Image {
+	img, err := random.Image(64, 2)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.OS = "linux"
+	cfg.Architecture = "amd64"
+	cfg.Config.Env = env
+	cfg.Config.Labels = labels
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	return img
+}
+
+func TestRebaseImage(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	oldBase := newRebaseTestBase(t, []string{"PATH=/bin", "VERSION=1"}, map[string]string{"version": "1", "vendor": "acme"})
+	newBase := newRebaseTestBase(t, []string{"PATH=/bin", "VERSION=2", "LANG=C"}, map[string]string{"version": "2", "vendor": "acme"})
+
+	// build our image on top of the old base
+	layer, err := random.Layer(64, "")
+	require.NoError(t, err)
+	img, err := mutate.Append(oldBase, mutate.Addendum{Layer: layer, History: v1.History{CreatedBy: "cbe"}})
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.Config.Env = []string{"PATH=/app:/bin", "VERSION=1", "HOME=/home/somebody"}
+	cfg.Config.Labels["vendor"] = "us"
+	cfg.Config.Entrypoint = []string{"/app/main"}
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+
+	rebased, err := RebaseImage(ctx, img, oldBase, newBase)
+	require.NoError(t, err)
+
+	// the base layers have been swapped, but ours are kept
+	layers, err := rebased.Layers()
+	require.NoError(t, err)
+	newLayers, err := newBase.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+	for i, l := range []v1.Layer{newLayers[0], newLayers[1], layer} {
+		expected, err := l.Digest()
+		require.NoError(t, err)
+		actual, err := layers[i].Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual, "layer %d", i)
+	}
+
+	out, err := rebased.ConfigFile()
+	require.NoError(t, err)
+	newCfg, err := newBase.ConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, append(newCfg.RootFS.DiffIDs, cfg.RootFS.DiffIDs[2]), out.RootFS.DiffIDs)
+	assert.Equal(t, []string{"/app/main"}, out.Config.Entrypoint)
+	assert.Equal(t, []string{"PATH=/app:/bin", "VERSION=2", "HOME=/home/somebody", "LANG=C"}, out.Config.Env)
+	assert.Equal(t, map[string]string{"version": "2", "vendor": "us"}, out.Config.Labels)
+	require.NotEmpty(t, out.History)
+	assert.Equal(t, "cbe", out.History[len(out.History)-1].CreatedBy)
+	assert.Len(t, out.History, len(newCfg.History)+1)
+}
+
+func TestRebaseImage_WrongBase(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := random.Image(64, 3)
+	require.NoError(t, err)
+	other, err := random.Image(64, 2)
+	require.NoError(t, err)
+
+	_, err = RebaseImage(ctx, img, other, other)
+	assert.ErrorIs(t, err, ErrNotBasedOn)
+
+	tooBig, err := random.Image(64, 4)
+	require.NoError(t, err)
+	_, err = RebaseImage(ctx, img, tooBig, other)
+	assert.ErrorIs(t, err, ErrNotBasedOn)
+}
+
+func TestBaseImageRef(t *testing.T) {
+	img, err := random.Image(64, 1)
+	require.NoError(t, err)
+
+	_, err = BaseImageRef(img)
+	assert.ErrorIs(t, err, ErrNoBaseImage)
+
+	digest := v1.Hash{Algorithm: "sha256", Hex: "6e9f67fa63b0323e9a1e587fd71c561ba48a034504fb804fd26fd8800039835d"}
+	img, err = SetBaseAnnotations(img, "registry.access.redhat.com/ubi9/ubi-minimal:latest", digest)
+	require.NoError(t, err)
+
+	ref, err := BaseImageRef(img)
+	require.NoError(t, err)
+	assert.Equal(t, "registry.access.redhat.com/ubi9/ubi-minimal:latest@"+digest.String(), ref)
+
+	var cases = []struct {
+		in  string
+		out string
+	}{
+		{
+			SchemeOCILayout + "/tmp/base:v1",
+			SchemeOCILayout + "/tmp/base@" + digest.String(),
+		},
+		{
+			SchemeOCILayout + "/tmp/base@sha256:0000",
+			SchemeOCILayout + "/tmp/base@" + digest.String(),
+		},
+		{
+			SchemeOCILayout + "/tmp/my:dir/base",
+			SchemeOCILayout + "/tmp/my:dir/base@" + digest.String(),
+		},
+		{
+			SchemeTarball + "/tmp/base.tar",
+			SchemeTarball + "/tmp/base.tar",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			img, err := SetBaseAnnotations(img, tt.in, digest)
+			require.NoError(t, err)
+
+			ref, err := BaseImageRef(img)
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, ref)
+
+			// the reference must be readable
+			path, tag, d := parseLayoutRef(strings.TrimPrefix(ref, SchemeOCILayout))
+			if strings.HasPrefix(ref, SchemeOCILayout) {
+				assert.Equal(t, strings.TrimPrefix(strings.Split(tt.out, "@")[0], SchemeOCILayout), path)
+				assert.Empty(t, tag)
+				assert.Equal(t, digest.String(), d)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package containers
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// ExportRootfs flattens all the layers of an image (applying
+// whiteouts) and writes the resulting root filesystem to the given path.
+// If the path ends in ".tar", a plain tar archive is written,
+// otherwise the filesystem is extracted into a directory.
+//
+// File ownership is only preserved when running as root, and
+// device nodes are skipped since creating them requires privileges.
+func ExportRootfs(ctx context.Context, img v1.Image, path string) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("path", path)
+	log.Info("exporting root filesystem")
+	start := time.Now()
+
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	if strings.HasSuffix(path, ".tar") {
+		if err := writeFile(rc, path); err != nil {
+			log.Error(err, "failed to write root filesystem")
+			return err
+		}
+	} else {
+		if err := extractTar(ctx, rc, path); err != nil {
+			log.Error(err, "failed to extract root filesystem")
+			return err
+		}
+	}
+
+	log.Info("exported root filesystem", "duration", time.Since(start))
+	return nil
+}
+
+// writeFile copies the stream into a new file, making
+// sure that everything has been written.
+func writeFile(r io.Reader, path string) error {
+	f, err := os.Create(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writing root filesystem: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+	return nil
+}
+
+// extractTar unpacks a tar stream into the given directory.
+// All operations go through an os.Root so that nothing
+// (e.g., a malicious symbolic link) can escape it.
+func extractTar(ctx context.Context, r io.Reader, dir string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return fmt.Errorf("opening directory: %w", err)
+	}
+	defer root.Close()
+
+	canChown := os.Geteuid() == 0
+
+	// directory permissions are applied at the end so that
+	// read-only directories can still be populated
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		target := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+		if target == "" {
+			continue
+		}
+		log.V(9).Info("extracting", "name", header.Name, "type", header.Typeflag)
+
+		if err := root.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("ensuring directory: %w", err)
+		}
+
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("creating directory: %w", err)
+			}
+			dirs = append(dirs, dirMode{path: target, mode: mode.Perm()})
+		case tar.TypeReg:
+			f, err := root.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+			if err != nil {
+				return fmt.Errorf("opening file for writing: %w", err)
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return fmt.Errorf("io.Copy(%q): %w", header.Name, err)
+			}
+			_ = f.Close()
+			// make sure that the umask doesn't change anything
+			if err := root.Chmod(target, mode.Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			_ = root.Remove(target)
+			if err := root.Symlink(header.Linkname, target); err != nil {
+				return fmt.Errorf("os.Symlink(%q): %w", header.Name, err)
+			}
+		case tar.TypeLink:
+			_ = root.Remove(target)
+			if err := root.Link(strings.TrimPrefix(filepath.Clean("/"+header.Linkname), "/"), target); err != nil {
+				return fmt.Errorf("os.Link(%q): %w", header.Name, err)
+			}
+		default:
+			log.V(4).Info("skipping unsupported file type", "name", header.Name, "type", header.Typeflag)
+			continue
+		}
+
+		if canChown {
+			if err := root.Lchown(target, header.Uid, header.Gid); err != nil {
+				return fmt.Errorf("os.Lchown(%q): %w", header.Name, err)
+			}
+		}
+	}
+
+	// apply the deepest directories first
+	slices.Reverse(dirs)
+	for _, d := range dirs {
+		if err := root.Chmod(d.path, d.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
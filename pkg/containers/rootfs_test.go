@@ -0,0 +1,113 @@
+package containers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Snakdy/container-build-engine/pkg/oci/empty"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func newTestLayer(t *testing.T, entries ...testEntry) v1.Layer {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Size:     int64(len(e.content)),
+			Linkname: e.linkname,
+			Mode:     0644,
+		}))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	b := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+	require.NoError(t, err)
+	return layer
+}
+
+func TestExportRootfs(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := mutate.AppendLayers(empty.Image,
+		newTestLayer(t,
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/a.txt", typeflag: tar.TypeReg, content: "a"},
+			testEntry{name: "etc/b.txt", typeflag: tar.TypeReg, content: "b"},
+		),
+		newTestLayer(t,
+			testEntry{name: "etc/.wh.b.txt", typeflag: tar.TypeReg},
+			testEntry{name: "etc/link", typeflag: tar.TypeSymlink, linkname: "a.txt"},
+		),
+	)
+	require.NoError(t, err)
+
+	t.Run("directory", func(t *testing.T) {
+		out := t.TempDir()
+		require.NoError(t, ExportRootfs(ctx, img, out))
+
+		data, err := os.ReadFile(filepath.Join(out, "etc", "a.txt"))
+		require.NoError(t, err)
+		assert.EqualValues(t, "a", string(data))
+
+		assert.NoFileExists(t, filepath.Join(out, "etc", "b.txt"))
+
+		target, err := os.Readlink(filepath.Join(out, "etc", "link"))
+		require.NoError(t, err)
+		assert.EqualValues(t, "a.txt", target)
+	})
+	t.Run("tar", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "rootfs.tar")
+		require.NoError(t, ExportRootfs(ctx, img, out))
+
+		f, err := os.Open(out)
+		require.NoError(t, err)
+		defer f.Close()
+
+		var names []string
+		tr := tar.NewReader(f)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, header.Name)
+		}
+		assert.ElementsMatch(t, []string{"etc", "etc/a.txt", "etc/link"}, names)
+	})
+	t.Run("escaping entries", func(t *testing.T) {
+		// mutate.Extract already filters these out, so
+		// we need to use the raw tar stream
+		rc, err := newTestLayer(t,
+			testEntry{name: "evil", typeflag: tar.TypeSymlink, linkname: "/"},
+			testEntry{name: "evil/file", typeflag: tar.TypeReg, content: "pwned"},
+		).Uncompressed()
+		require.NoError(t, err)
+		defer rc.Close()
+		assert.Error(t, extractTar(ctx, rc, t.TempDir()))
+	})
+}
@@ -1,12 +1,21 @@
 package containers
 
 import (
+	"archive/tar"
 	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/Snakdy/container-build-engine/pkg/oci/empty"
 	"github.com/go-logr/logr"
 	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 )
 
 func Save(ctx context.Context, img v1.Image, dst, path string) error {
@@ -20,3 +29,168 @@ func Save(ctx context.Context, img v1.Image, dst, path string) error {
 	log.Info("saved image to file", "duration", time.Since(start))
 	return nil
 }
+
+// SaveOCI writes a v1.Image or v1.ImageIndex as an OCI image layout.
+// If the path ends in ".tar", the layout is written as a tar archive,
+// otherwise it's written to a directory.
+//
+// Each tag is recorded using the "org.opencontainers.image.ref.name"
+// annotation.
+func SaveOCI(ctx context.Context, img Result, tags []string, path string) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("path", path, "tags", tags)
+	log.Info("saving image to oci layout")
+	start := time.Now()
+
+	dir := path
+	if strings.HasSuffix(path, ".tar") {
+		tmp, err := os.MkdirTemp("", "oci-layout-*")
+		if err != nil {
+			return fmt.Errorf("creating temp dir: %w", err)
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+
+	if err := writeLayout(img, tags, dir); err != nil {
+		log.Error(err, "failed to write oci layout")
+		return err
+	}
+
+	if dir != path {
+		if err := tarLayout(dir, path); err != nil {
+			log.Error(err, "failed to archive oci layout")
+			return err
+		}
+	}
+	log.Info("saved image to oci layout", "duration", time.Since(start))
+	return nil
+}
+
+// writeLayout adds the image to the layout in dir, replacing
+// any existing entries with the same tags so that each tag
+// only points at one image.
+func writeLayout(img Result, tags []string, dir string) error {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		p, err = layout.Write(dir, empty.Index)
+		if err != nil {
+			return fmt.Errorf("creating oci layout: %w", err)
+		}
+	}
+	digest, err := resultDigest(img)
+	if err != nil {
+		return err
+	}
+	// make sure we write the image at least once
+	// even if there are no tags
+	var annotations []map[string]string
+	for _, t := range tags {
+		annotations = append(annotations, map[string]string{AnnotationRefName: t})
+	}
+	if len(annotations) == 0 {
+		annotations = append(annotations, nil)
+	}
+	for _, a := range annotations {
+		var opts []layout.Option
+		if a != nil {
+			opts = append(opts, layout.WithAnnotations(a))
+		}
+		// untagged entries are only
+		// replaced by the same image
+		tag := a[AnnotationRefName]
+		matcher := func(desc v1.Descriptor) bool {
+			name := desc.Annotations[AnnotationRefName]
+			if tag == "" {
+				return name == "" && desc.Digest == digest
+			}
+			return name == tag
+		}
+		switch v := img.(type) {
+		case v1.Image:
+			err = p.ReplaceImage(v, matcher, opts...)
+		case v1.ImageIndex:
+			err = p.ReplaceIndex(v, matcher, opts...)
+		}
+		if err != nil {
+			return fmt.Errorf("writing to oci layout: %w", err)
+		}
+	}
+	return nil
+}
+
+// resultDigest returns the digest of
+// an image or index.
+func resultDigest(img Result) (v1.Hash, error) {
+	switch v := img.(type) {
+	case v1.Image:
+		return v.Digest()
+	case v1.ImageIndex:
+		return v.Digest()
+	default:
+		return v1.Hash{}, fmt.Errorf("unsupported image type: %T", img)
+	}
+}
+
+// tarLayout archives the contents of an OCI layout
+// directory into a tar file.
+func tarLayout(dir, dst string) error {
+	f, err := os.Create(filepath.Clean(dst))
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	// only used to clean up if we fail, the
+	// error is checked once we're done
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		// strip anything host-specific
+		header.Name = filepath.ToSlash(rel)
+		header.ModTime = creationTime.Time
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", rel, err)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		if _, err := io.Copy(tw, in); err != nil {
+			return fmt.Errorf("io.Copy(%q): %w", rel, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("writing tar: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+	return nil
+}
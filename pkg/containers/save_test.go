@@ -5,7 +5,10 @@ import (
 	"github.com/Snakdy/container-build-engine/pkg/oci/empty"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"path/filepath"
 	"testing"
 )
@@ -20,3 +23,69 @@ func TestSave(t *testing.T) {
 
 	assert.FileExists(t, out)
 }
+
+func TestSaveOCI(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	t.Run("image directory", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "layout")
+
+		err := SaveOCI(ctx, empty.Image, []string{"v1", "latest"}, out)
+		require.NoError(t, err)
+
+		idx, err := layout.ImageIndexFromPath(out)
+		require.NoError(t, err)
+		im, err := idx.IndexManifest()
+		require.NoError(t, err)
+		require.Len(t, im.Manifests, 2)
+		assert.EqualValues(t, "v1", im.Manifests[0].Annotations[AnnotationRefName])
+		assert.EqualValues(t, "latest", im.Manifests[1].Annotations[AnnotationRefName])
+	})
+	t.Run("index directory", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "layout")
+
+		err := SaveOCI(ctx, newPlatformIndex(t, "linux/amd64", "linux/arm64"), []string{"v1"}, out)
+		require.NoError(t, err)
+
+		// make sure we can read it back
+		img, err := GetImage(ctx, SchemeOCILayout+out+":v1", &v1.Platform{OS: "linux", Architecture: "arm64"})
+		require.NoError(t, err)
+		assert.NotNil(t, img)
+	})
+	t.Run("replace tags", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "layout")
+
+		require.NoError(t, SaveOCI(ctx, empty.Image, []string{"v1", "latest"}, out))
+		require.NoError(t, SaveOCI(ctx, empty.Image, nil, out))
+		require.NoError(t, SaveOCI(ctx, empty.Image, nil, out))
+		// saving a different image moves the tag
+		img := newPlatformIndex(t, "linux/amd64")
+		require.NoError(t, SaveOCI(ctx, img, []string{"latest"}, out))
+
+		idx, err := layout.ImageIndexFromPath(out)
+		require.NoError(t, err)
+		im, err := idx.IndexManifest()
+		require.NoError(t, err)
+		tags := map[string]v1.Hash{}
+		for _, desc := range im.Manifests {
+			name := desc.Annotations[AnnotationRefName]
+			_, ok := tags[name]
+			assert.False(t, ok, "duplicate entry for %q", name)
+			tags[name] = desc.Digest
+		}
+		scratch, err := empty.Image.Digest()
+		require.NoError(t, err)
+		digest, err := img.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]v1.Hash{"v1": scratch, "": scratch, "latest": digest}, tags)
+	})
+	t.Run("tar", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "layout.tar")
+
+		err := SaveOCI(ctx, empty.Image, nil, out)
+		require.NoError(t, err)
+
+		assert.FileExists(t, out)
+	})
+}
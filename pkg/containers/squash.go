@@ -0,0 +1,273 @@
+package containers
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Snakdy/container-build-engine/pkg/oci/empty"
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// SquashImage merges the layers of the image, starting at the
+// given index, into a single layer.
+//
+// When every layer is squashed (i.e. from is 0), whiteouts are
+// applied and then dropped since there's nothing left for them
+// to hide. Otherwise, they're kept so that they continue to hide
+// files in the layers below.
+func SquashImage(ctx context.Context, img v1.Image, from int, opts LayerOptions) (v1.Image, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("from", from)
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if from < 0 || from > len(layers) {
+		return nil, fmt.Errorf("cannot squash from layer %d of %d", from, len(layers))
+	}
+	if len(layers)-from < 2 {
+		log.V(2).Info("skipping squash as there aren't enough layers", "layers", len(layers))
+		return img, nil
+	}
+	log.Info("squashing layers", "count", len(layers)-from)
+	start := time.Now()
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+
+	squashed, err := newLayer(ctx, opts, func(w io.Writer) error {
+		return squashLayers(ctx, w, layers[from:], from > 0)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("squashing layers: %w", err)
+	}
+	diffID, err := squashed.DiffID()
+	if err != nil {
+		return nil, err
+	}
+
+	newLayers := append(layers[:from:from], squashed)
+	out, err := mutate.AppendLayers(empty.Image, newLayers...)
+	if err != nil {
+		return nil, err
+	}
+	out = mutate.MediaType(out, types.OCIManifestSchema1)
+	out = mutate.ConfigMediaType(out, types.OCIConfigJSON)
+	out = mutate.Annotations(out, m.Annotations).(v1.Image)
+
+	cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs[:from:from], diffID)
+	cfg.History = squashHistory(cfg.History, from, len(layers))
+	out, err = mutate.ConfigFile(out, cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.V(2).Info("successfully squashed layers", "duration", time.Since(start))
+	return out, nil
+}
+
+// squashHistory replaces the history of the squashed layers
+// with a single entry. Empty layers (e.g. those that only
+// changed the config) are kept since they're still useful
+// for understanding how the image was built.
+func squashHistory(history []v1.History, from, count int) []v1.History {
+	entry := v1.History{
+		CreatedBy: "cbe squash",
+		Comment:   fmt.Sprintf("squashed %d layers", count-from),
+	}
+	var out []v1.History
+	var i int
+	for _, h := range history {
+		if h.EmptyLayer {
+			out = append(out, h)
+			continue
+		}
+		if i < from {
+			out = append(out, h)
+		}
+		i++
+	}
+	// if the history doesn't line up with the layers,
+	// there's no way to know which entries we've replaced
+	if i != count {
+		return append(history, entry)
+	}
+	return append(out, entry)
+}
+
+// squashLayers writes the merged contents of the layers as a
+// single tar. Layers are read from the top down, so the first
+// time we see a path is the version that should be kept.
+//
+// Hard links may point to files in the layers below, which we
+// won't have written yet, so they're written at the end.
+func squashLayers(ctx context.Context, w io.Writer, layers []v1.Layer, keepWhiteouts bool) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	s := &squashState{
+		tw:            tar.NewWriter(w),
+		seen:          map[string]bool{},
+		opaque:        map[string]bool{},
+		files:         map[string]bool{},
+		keepWhiteouts: keepWhiteouts,
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := s.squashLayer(ctx, layers[i]); err != nil {
+			return fmt.Errorf("reading layer %d: %w", i, err)
+		}
+		for dir := range s.opaque {
+			s.seen[dir] = true
+		}
+		clear(s.opaque)
+	}
+	for _, header := range s.links {
+		// when only some of the layers are squashed,
+		// the target may be in one of the others
+		target := path.Clean("/" + header.Linkname)
+		if !s.keepWhiteouts && !s.files[target] {
+			return fmt.Errorf("hard link %q points to %q, which doesn't exist", header.Name, header.Linkname)
+		}
+		if err := s.tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", header.Name, err)
+		}
+	}
+	log.V(3).Info("squashed layers", "files", len(s.seen), "links", len(s.links))
+	return s.tw.Close()
+}
+
+type squashState struct {
+	tw *tar.Writer
+	// seen records every path that we've processed
+	// and whether it hides the paths beneath it
+	seen map[string]bool
+	// opaque directories hide the contents of the
+	// layers below, but not the layer they're in
+	opaque map[string]bool
+	// files records the paths that have been written
+	// so that we can check the targets of hard links
+	files map[string]bool
+	// links are the hard links that
+	// need to be written at the end
+	links         []*tar.Header
+	keepWhiteouts bool
+}
+
+func (s *squashState) squashLayer(ctx context.Context, layer v1.Layer) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + header.Name)
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+
+		if base == whiteoutOpaque {
+			if hidden(s.seen, dir) {
+				continue
+			}
+			log.V(5).Info("found opaque directory", "path", dir)
+			s.opaque[dir] = true
+			if s.keepWhiteouts {
+				if err := s.tw.WriteHeader(header); err != nil {
+					return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", name, err)
+				}
+			}
+			continue
+		}
+
+		whiteout := strings.HasPrefix(base, whiteoutPrefix)
+		if whiteout {
+			name = path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+		}
+		if hidden(s.seen, name) {
+			continue
+		}
+		if replaced, ok := s.seen[name]; ok {
+			// a directory that was deleted and then recreated
+			// must not expose anything from the layers below
+			if whiteout && !replaced {
+				s.seen[name] = true
+				if s.keepWhiteouts {
+					if err := s.tw.WriteHeader(&tar.Header{
+						Name:     path.Join(name, whiteoutOpaque),
+						Typeflag: tar.TypeReg,
+						ModTime:  header.ModTime,
+					}); err != nil {
+						return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", name, err)
+					}
+				}
+			}
+			continue
+		}
+		// anything that isn't a directory replaces
+		// the contents of the layers below
+		s.seen[name] = whiteout || header.Typeflag != tar.TypeDir
+		if whiteout {
+			log.V(5).Info("found whiteout", "path", name)
+			if s.keepWhiteouts {
+				if err := s.tw.WriteHeader(header); err != nil {
+					return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", name, err)
+				}
+			}
+			continue
+		}
+		if header.Typeflag == tar.TypeLink {
+			log.V(5).Info("deferring hard link", "path", name, "target", header.Linkname)
+			s.links = append(s.links, header)
+			continue
+		}
+		if err := s.tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", name, err)
+		}
+		if _, err := io.Copy(s.tw, tr); err != nil {
+			return fmt.Errorf("io.Copy(%q): %w", name, err)
+		}
+		s.files[name] = true
+	}
+}
+
+// hidden returns true if any of the parent
+// directories of the path have been replaced.
+func hidden(seen map[string]bool, name string) bool {
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if seen[dir] && dir != "/" {
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package containers
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSquashTestImage(t *testing.T) v1.Image {
+	img, err := mutate.AppendLayers(empty.Image,
+		newTestLayer(t,
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/passwd", typeflag: tar.TypeReg, content: "root"},
+			testEntry{name: "etc/shadow", typeflag: tar.TypeReg, content: "secret"},
+			testEntry{name: "var/", typeflag: tar.TypeDir},
+			testEntry{name: "var/cache/", typeflag: tar.TypeDir},
+			testEntry{name: "var/cache/apk", typeflag: tar.TypeReg, content: "index"},
+		),
+		newTestLayer(t,
+			testEntry{name: "etc/.wh.shadow", typeflag: tar.TypeReg},
+			testEntry{name: "etc/passwd", typeflag: tar.TypeReg, content: "root,somebody"},
+			testEntry{name: "var/cache/", typeflag: tar.TypeDir},
+			testEntry{name: "var/cache/.wh..wh..opq", typeflag: tar.TypeReg},
+			testEntry{name: "var/cache/new", typeflag: tar.TypeReg, content: "new"},
+		),
+		newTestLayer(t,
+			testEntry{name: "app/", typeflag: tar.TypeDir},
+			testEntry{name: "app/main", typeflag: tar.TypeReg, content: "main"},
+		),
+	)
+	require.NoError(t, err)
+	return img
+}
+
+func TestSquashImage(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := SquashImage(ctx, newSquashTestImage(t), 0, LayerOptions{TempDir: t.TempDir()})
+	require.NoError(t, err)
+
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	diffID, err := layers[0].DiffID()
+	require.NoError(t, err)
+	assert.Equal(t, []v1.Hash{diffID}, cfg.RootFS.DiffIDs)
+
+	headers := readLayerHeaders(t, layers[0])
+	assert.Contains(t, headers, "etc/passwd")
+	assert.EqualValues(t, len("root,somebody"), headers["etc/passwd"].Size)
+	assert.Contains(t, headers, "var/cache/new")
+	assert.Contains(t, headers, "app/main")
+	// whiteouts are applied and then dropped
+	assert.NotContains(t, headers, "etc/shadow")
+	assert.NotContains(t, headers, "etc/.wh.shadow")
+	assert.NotContains(t, headers, "var/cache/apk")
+	assert.NotContains(t, headers, "var/cache/.wh..wh..opq")
+}
+
+func TestSquashImage_New(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	base := newSquashTestImage(t)
+	baseLayers, err := base.Layers()
+	require.NoError(t, err)
+
+	img, err := SquashImage(ctx, base, 1, LayerOptions{TempDir: t.TempDir()})
+	require.NoError(t, err)
+
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 2)
+
+	// the base layer is untouched
+	expected, err := baseLayers[0].Digest()
+	require.NoError(t, err)
+	actual, err := layers[0].Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	// whiteouts are kept so that they continue
+	// to hide files in the base layer
+	headers := readLayerHeaders(t, layers[1])
+	assert.Contains(t, headers, "etc/.wh.shadow")
+	assert.Contains(t, headers, "var/cache/.wh..wh..opq")
+	assert.Contains(t, headers, "app/main")
+
+	// the final filesystem is the same
+	// as if we hadn't squashed anything
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	flat := readTarHeaders(t, rc)
+	assert.NotContains(t, flat, "etc/shadow")
+	assert.Contains(t, flat, "var/cache/new")
+}
+
+func TestSquashImage_HardLinks(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := mutate.AppendLayers(empty.Image,
+		newTestLayer(t,
+			testEntry{name: "bin/", typeflag: tar.TypeDir},
+			testEntry{name: "bin/busybox", typeflag: tar.TypeReg, content: "busybox"},
+		),
+		newTestLayer(t,
+			testEntry{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+		),
+	)
+	require.NoError(t, err)
+
+	out, err := SquashImage(ctx, img, 0, LayerOptions{TempDir: t.TempDir()})
+	require.NoError(t, err)
+	layers, err := out.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+
+	// the target must be written before
+	// the link so that it can be extracted
+	rc, err := layers[0].Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	var names []string
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+		if header.Name == "bin/sh" {
+			assert.EqualValues(t, tar.TypeLink, header.Typeflag)
+			assert.Equal(t, "bin/busybox", header.Linkname)
+		}
+	}
+	assert.Equal(t, []string{"bin/", "bin/busybox", "bin/sh"}, names)
+}
+
+func TestSquashImage_DanglingHardLink(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	img, err := mutate.AppendLayers(empty.Image,
+		newTestLayer(t,
+			testEntry{name: "bin/", typeflag: tar.TypeDir},
+			testEntry{name: "bin/busybox", typeflag: tar.TypeReg, content: "busybox"},
+		),
+		newTestLayer(t,
+			testEntry{name: "bin/.wh.busybox", typeflag: tar.TypeReg},
+			testEntry{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+		),
+	)
+	require.NoError(t, err)
+
+	_, err = SquashImage(ctx, img, 0, LayerOptions{TempDir: t.TempDir()})
+	assert.Error(t, err)
+}
+
+func TestSquashImage_SingleLayer(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	base := newSquashTestImage(t)
+	img, err := SquashImage(ctx, base, 2, LayerOptions{TempDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, base, img)
+
+	_, err = SquashImage(ctx, base, 4, LayerOptions{TempDir: t.TempDir()})
+	assert.Error(t, err)
+}
+
+func TestSquashHistory(t *testing.T) {
+	var cases = []struct {
+		name     string
+		history  []v1.History
+		from     int
+		count    int
+		expected []string
+	}{
+		{
+			"all",
+			[]v1.History{{CreatedBy: "a"}, {CreatedBy: "env", EmptyLayer: true}, {CreatedBy: "b"}},
+			0,
+			2,
+			[]string{"env", "cbe squash"},
+		},
+		{
+			"new",
+			[]v1.History{{CreatedBy: "a"}, {CreatedBy: "b"}, {CreatedBy: "c"}},
+			1,
+			3,
+			[]string{"a", "cbe squash"},
+		},
+		{
+			"mismatched",
+			[]v1.History{{CreatedBy: "a"}},
+			0,
+			2,
+			[]string{"a", "cbe squash"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual []string
+			for _, h := range squashHistory(tt.history, tt.from, tt.count) {
+				actual = append(actual, h.CreatedBy)
+			}
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package exporters
+
+import (
+	"context"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers"
+)
+
+// OCI writes the image or index as an OCI image layout.
+// See containers.SaveOCI for more information.
+type OCI struct {
+	Path string
+	Tags []string
+}
+
+func (e *OCI) Export(ctx context.Context, img containers.Result) error {
+	return containers.SaveOCI(ctx, img, e.Tags, e.Path)
+}
+
+func (*OCI) Type() string {
+	return TypeOCI
+}
@@ -0,0 +1,66 @@
+package exporters
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var ErrMissingDest = errors.New("output is missing a destination")
+
+// Parse converts a buildx-style output specification
+// (e.g., "type=oci,dest=./image,tag=v1") into an Exporter.
+//
+// Keys may be repeated (e.g., to push to multiple
+// references or record multiple tags).
+func Parse(spec string) (Exporter, error) {
+	values := map[string][]string{}
+	for _, field := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid output field '%s': expected key=value", field)
+		}
+		values[k] = append(values[k], v)
+	}
+
+	kind := first(values["type"])
+	// allow "name" as an alias of "dest" for compatibility
+	// with buildx
+	dest := slices.Concat(values["dest"], values["name"])
+	if len(dest) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMissingDest, spec)
+	}
+
+	switch kind {
+	case TypeRegistry:
+		return &Registry{Refs: dest}, nil
+	case TypeOCI:
+		return &OCI{Path: first(dest), Tags: values["tag"]}, nil
+	case TypeTarball:
+		return &Tarball{Path: first(dest), Tag: first(values["tag"])}, nil
+	case TypeRootfs:
+		e := &Rootfs{Path: first(dest)}
+		if p := first(values["platform"]); p != "" {
+			platform, err := v1.ParsePlatform(p)
+			if err != nil {
+				return nil, fmt.Errorf("parsing platform: %w", err)
+			}
+			e.Platform = platform
+		}
+		return e, nil
+	case "":
+		return nil, fmt.Errorf("output is missing a type: %s", spec)
+	default:
+		return nil, fmt.Errorf("unsupported output type: %s", kind)
+	}
+}
+
+func first(s []string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
@@ -0,0 +1,61 @@
+package exporters
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	var cases = []struct {
+		spec     string
+		expected Exporter
+	}{
+		{
+			"type=registry,dest=registry.example.com/foo:v1",
+			&Registry{Refs: []string{"registry.example.com/foo:v1"}},
+		},
+		{
+			"type=registry,name=registry.example.com/foo:v1,name=registry.example.com/foo:latest",
+			&Registry{Refs: []string{"registry.example.com/foo:v1", "registry.example.com/foo:latest"}},
+		},
+		{
+			"type=oci,dest=./image.tar,tag=v1,tag=latest",
+			&OCI{Path: "./image.tar", Tags: []string{"v1", "latest"}},
+		},
+		{
+			"type=tarball,dest=/tmp/image.tar",
+			&Tarball{Path: "/tmp/image.tar"},
+		},
+		{
+			"type=rootfs,dest=./rootfs",
+			&Rootfs{Path: "./rootfs"},
+		},
+		{
+			"type=rootfs,dest=./rootfs.tar,platform=linux/arm64",
+			&Rootfs{Path: "./rootfs.tar", Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.spec, func(t *testing.T) {
+			e, err := Parse(tt.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, e)
+		})
+	}
+
+	t.Run("missing dest", func(t *testing.T) {
+		_, err := Parse("type=oci")
+		assert.ErrorIs(t, err, ErrMissingDest)
+	})
+	t.Run("unknown type", func(t *testing.T) {
+		_, err := Parse("type=foo,dest=bar")
+		assert.Error(t, err)
+	})
+	t.Run("invalid field", func(t *testing.T) {
+		_, err := Parse("type=oci,dest")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,26 @@
+package exporters
+
+import (
+	"context"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers"
+)
+
+// Registry pushes the image or index to one
+// or more references in a container registry.
+type Registry struct {
+	Refs []string
+}
+
+func (e *Registry) Export(ctx context.Context, img containers.Result) error {
+	for _, ref := range e.Refs {
+		if err := containers.Push(ctx, img, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*Registry) Type() string {
+	return TypeRegistry
+}
@@ -0,0 +1,43 @@
+package exporters
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var ErrPlatformRequired = errors.New("a platform is required to export the root filesystem of an index")
+
+// Rootfs flattens the image and writes the root filesystem
+// to a directory or tar archive. See containers.ExportRootfs
+// for more information.
+//
+// If the result is an index, the Platform is used
+// to select which image to export, and must be set.
+type Rootfs struct {
+	Path     string
+	Platform *v1.Platform
+}
+
+func (e *Rootfs) Export(ctx context.Context, img containers.Result) error {
+	// picking an image from an index
+	// would be a guess
+	if e.Platform == nil {
+		image, ok := img.(v1.Image)
+		if !ok {
+			return ErrPlatformRequired
+		}
+		return containers.ExportRootfs(ctx, image, e.Path)
+	}
+	image, err := containers.ImageForPlatform(ctx, img, e.Platform)
+	if err != nil {
+		return err
+	}
+	return containers.ExportRootfs(ctx, image, e.Path)
+}
+
+func (*Rootfs) Type() string {
+	return TypeRootfs
+}
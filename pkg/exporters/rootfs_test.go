@@ -0,0 +1,36 @@
+package exporters
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootfs_Export(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	t.Run("image", func(t *testing.T) {
+		img, err := random.Image(64, 1)
+		require.NoError(t, err)
+
+		out := filepath.Join(t.TempDir(), "rootfs.tar")
+		e := &Rootfs{Path: out}
+		require.NoError(t, e.Export(ctx, img))
+		assert.FileExists(t, out)
+	})
+	t.Run("index without a platform", func(t *testing.T) {
+		idx, err := random.Index(64, 1, 2)
+		require.NoError(t, err)
+
+		out := filepath.Join(t.TempDir(), "rootfs.tar")
+		e := &Rootfs{Path: out}
+		assert.ErrorIs(t, e.Export(ctx, idx), ErrPlatformRequired)
+		assert.NoFileExists(t, out)
+	})
+}
@@ -0,0 +1,34 @@
+package exporters
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const DefaultTarballTag = "image"
+
+// Tarball writes the image as a tarball that can be
+// loaded using "docker load". Indexes are not supported.
+type Tarball struct {
+	Path string
+	Tag  string
+}
+
+func (e *Tarball) Export(ctx context.Context, img containers.Result) error {
+	image, ok := img.(v1.Image)
+	if !ok {
+		return fmt.Errorf("cannot save %T to a tarball, use the %s exporter instead", img, TypeOCI)
+	}
+	tag := e.Tag
+	if tag == "" {
+		tag = DefaultTarballTag
+	}
+	return containers.Save(ctx, image, tag, e.Path)
+}
+
+func (*Tarball) Type() string {
+	return TypeTarball
+}
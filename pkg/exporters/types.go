@@ -0,0 +1,21 @@
+package exporters
+
+import (
+	"context"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers"
+)
+
+// Exporter sends the result of a build somewhere
+// (e.g., a registry or the local filesystem).
+type Exporter interface {
+	Export(ctx context.Context, img containers.Result) error
+	Type() string
+}
+
+const (
+	TypeRegistry = "registry"
+	TypeOCI      = "oci"
+	TypeTarball  = "tarball"
+	TypeRootfs   = "rootfs"
+)
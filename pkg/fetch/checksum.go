@@ -0,0 +1,197 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/gosimple/hashdir"
+)
+
+// checksumAlgorithms maps the prefix of a
+// checksum (e.g., "sha512:") to its hash.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// digestAlgorithms maps the length of a hex encoded
+// digest to its algorithm, so that we can tell which
+// one a checksums file uses.
+var digestAlgorithms = map[int]string{
+	40:  "sha1",
+	64:  "sha256",
+	96:  "sha384",
+	128: "sha512",
+}
+
+// bsdChecksum matches a line in the output of "shasum --tag"
+// (e.g., "SHA256 (file.tar.gz) = 5067...").
+var bsdChecksum = regexp.MustCompile(`^(?i)(SHA1|SHA256|SHA384|SHA512) ?\((.+)\) ?= ?([0-9a-f]+)$`)
+
+// parseChecksum splits a checksum into its algorithm and
+// hex encoded digest. Checksums without a prefix are SHA-256.
+func parseChecksum(checksum string) (string, string, error) {
+	algorithm, digest, ok := strings.Cut(checksum, ":")
+	if !ok {
+		algorithm, digest = "sha256", checksum
+	}
+	algorithm = strings.ToLower(algorithm)
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+	digest = strings.ToLower(digest)
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != newHash().Size()*2 {
+		return "", "", fmt.Errorf("invalid %s checksum: %s", algorithm, digest)
+	}
+	return algorithm, digest, nil
+}
+
+// checksumFile verifies the checksum of a file or
+// directory.
+func checksumFile(src, checksum string) error {
+	algorithm, expected, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	// if the file is actually a directory, then get a
+	// checksum of the whole dir
+	if info, err := os.Stat(src); err == nil && info.IsDir() {
+		return checksumDir(src, algorithm, expected)
+	}
+	f, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+	h := checksumAlgorithms[algorithm]()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("generating sum: %w", err)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != expected {
+		return fmt.Errorf("%w: expected %s:%s, got %s:%s", ErrChecksum, algorithm, expected, algorithm, digest)
+	}
+	return nil
+}
+
+func checksumDir(src, algorithm, expected string) error {
+	// hashdir doesn't support SHA-384
+	if algorithm == "sha384" {
+		return fmt.Errorf("%s checksums aren't supported for directories", algorithm)
+	}
+	digest, err := hashdir.Make(src, algorithm)
+	if err != nil {
+		return fmt.Errorf("hashing file: %w", err)
+	}
+	if digest != expected {
+		return fmt.Errorf("%w: expected %s:%s, got %s:%s", ErrChecksum, algorithm, expected, algorithm, digest)
+	}
+	return nil
+}
+
+// LookupChecksum retrieves a checksums file (e.g., "SHA256SUMS")
+// and returns the checksum of the file at src, prefixed with
+// its algorithm (e.g., "sha512:...").
+//
+// Both the GNU ("<digest>  <name>") and BSD ("SHA256 (<name>) = <digest>")
+// formats are supported. Files that only contain a digest
+// (e.g., "file.tar.gz.sha256") are also supported.
+func LookupChecksum(ctx context.Context, checksumURL, src string) (string, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("checksumUrl", Redact(checksumURL))
+
+	srcURL, err := parseURL(src)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(srcURL.Path)
+
+	uri, err := parseURL(checksumURL)
+	if err != nil {
+		return "", fmt.Errorf("checksum url: %w", err)
+	}
+	out, _, err := retrieve(ctx, uri, "")
+	if err != nil {
+		return "", fmt.Errorf("retrieving checksums: %w", err)
+	}
+	data, err := os.ReadFile(filepath.Clean(out))
+	if err != nil {
+		return "", fmt.Errorf("reading checksums: %w", err)
+	}
+	checksum, err := parseChecksums(string(data), name)
+	if err != nil {
+		return "", err
+	}
+	log.V(3).Info("found checksum", "file", name, "checksum", checksum)
+	return checksum, nil
+}
+
+// parseChecksums finds the checksum of the named file. Entries are
+// matched using their full name first, and then their base name so
+// that "./dist/file.tar.gz" matches "file.tar.gz".
+func parseChecksums(data, name string) (string, error) {
+	type entry struct {
+		name, checksum string
+	}
+	var entries []entry
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var e entry
+		if m := bsdChecksum.FindStringSubmatch(line); m != nil {
+			e = entry{name: m[2], checksum: strings.ToLower(m[1]) + ":" + strings.ToLower(m[3])}
+		} else {
+			digest, file, _ := strings.Cut(line, " ")
+			algorithm, ok := digestAlgorithms[len(digest)]
+			if !ok {
+				continue
+			}
+			// "*" marks files that were read in binary mode
+			e = entry{name: strings.TrimPrefix(strings.TrimSpace(file), "*"), checksum: algorithm + ":" + strings.ToLower(digest)}
+		}
+		if _, _, err := parseChecksum(e.checksum); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	// a file that only contains a digest
+	if len(entries) == 1 && entries[0].name == "" {
+		return entries[0].checksum, nil
+	}
+	for _, e := range entries {
+		if strings.TrimPrefix(e.name, "./") == name {
+			return e.checksum, nil
+		}
+	}
+	var match string
+	for _, e := range entries {
+		if path.Base(e.name) != name || e.checksum == match {
+			continue
+		}
+		if match != "" {
+			return "", fmt.Errorf("found more than one checksum for %s", name)
+		}
+		match = e.checksum
+	}
+	if match == "" {
+		return "", fmt.Errorf("no checksum found for %s", name)
+	}
+	return match, nil
+}
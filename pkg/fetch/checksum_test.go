@@ -0,0 +1,135 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSha256 = "5067772cf39f7f42a7b5cd5d3b13da459fc9530b09722ae8fedc57dbbc0c50a3"
+	testSha512 = "597b4c2ee937b53e06e3c6a0fd36624e139a51b055e96e85727caef166f21361c4df90a12306f3ed78fbed3cc5009599c47f1d3b33b3f98b536c16109ebaa59b"
+)
+
+func TestParseChecksums(t *testing.T) {
+	var cases = []struct {
+		name     string
+		data     string
+		file     string
+		expected string
+		ok       bool
+	}{
+		{
+			"gnu",
+			"0000000000000000000000000000000000000000000000000000000000000000  other.txt\n" + testSha256 + "  test.txt\n",
+			"test.txt",
+			"sha256:" + testSha256,
+			true,
+		},
+		{
+			"gnu binary mode",
+			testSha512 + " *test.txt\n",
+			"test.txt",
+			"sha512:" + testSha512,
+			true,
+		},
+		{
+			"bsd",
+			"# comment\nSHA512 (test.txt) = " + testSha512 + "\n",
+			"test.txt",
+			"sha512:" + testSha512,
+			true,
+		},
+		{
+			"digest only",
+			testSha256 + "\n",
+			"test.txt",
+			"sha256:" + testSha256,
+			true,
+		},
+		{
+			"base name",
+			testSha256 + "  ./dist/test.txt\n",
+			"test.txt",
+			"sha256:" + testSha256,
+			true,
+		},
+		{
+			"full name is preferred",
+			"0000000000000000000000000000000000000000000000000000000000000000  dist/test.txt\n" + testSha256 + "  ./test.txt\n",
+			"test.txt",
+			"sha256:" + testSha256,
+			true,
+		},
+		{
+			"ambiguous",
+			"0000000000000000000000000000000000000000000000000000000000000000  linux/test.txt\n" + testSha256 + "  darwin/test.txt\n",
+			"test.txt",
+			"",
+			false,
+		},
+		{
+			"missing",
+			testSha256 + "  other.txt\n",
+			"test.txt",
+			"",
+			false,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			checksum, err := parseChecksums(tt.data, tt.file)
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, checksum)
+		})
+	}
+}
+
+func TestLookupChecksum(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	path := filepath.Join(t.TempDir(), "SHA512SUMS")
+	require.NoError(t, os.WriteFile(path, []byte(testSha512+"  test.txt\n"), 0644))
+
+	checksum, err := LookupChecksum(ctx, "file://"+path, "https://example.com/releases/test.txt?archive=false")
+	require.NoError(t, err)
+	assert.Equal(t, "sha512:"+testSha512, checksum)
+}
+
+func TestFetch_ChecksumURL(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/SHA256SUMS":
+			_, _ = fmt.Fprintf(w, "%x  test.txt\n", sha256.Sum256([]byte(testContent)))
+		case "/bad/SHA256SUMS":
+			_, _ = w.Write([]byte("0000000000000000000000000000000000000000000000000000000000000000  test.txt\n"))
+		default:
+			_, _ = w.Write([]byte(testContent))
+		}
+	}))
+	defer srv.Close()
+	ctx = WithOptions(ctx, Options{CacheDir: t.TempDir(), Client: srv.Client()})
+
+	path, err := Fetch(ctx, srv.URL+"/test.txt?archive=false&checksum-url="+srv.URL+"/SHA256SUMS", t.TempDir(), "")
+	require.NoError(t, err)
+	assert.FileExists(t, path)
+
+	_, err = Fetch(ctx, srv.URL+"/test.txt?archive=false&checksum-url="+srv.URL+"/bad/SHA256SUMS", t.TempDir(), "")
+	assert.ErrorIs(t, err, ErrChecksum)
+}
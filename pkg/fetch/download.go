@@ -0,0 +1,116 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// tempPrefix is used for files that are
+	// still being downloaded.
+	tempPrefix = ".tmp-"
+	// metadataSuffix is appended to the key of
+	// a download to get its metadata.
+	metadataSuffix = ".json"
+)
+
+// download is the metadata stored alongside each
+// file in the download cache.
+type download struct {
+	URL      string `json:"url"`
+	Checksum string `json:"checksum,omitempty"`
+	// ETag and LastModified are used to revalidate
+	// files that don't have a checksum.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// Digest is the sha256 of the file so that we
+	// can tell whether it has been corrupted.
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// downloadKey generates the cache key for a URL. The
+// checksum is included so that changing it results in
+// the file being downloaded again.
+func downloadKey(uri, checksum string) string {
+	sum := sha256.Sum256([]byte(uri + "\n" + checksum))
+	return hex.EncodeToString(sum[:])
+}
+
+// readDownload reads the metadata for the given key.
+func readDownload(dir, key string) (*download, error) {
+	data, err := os.ReadFile(filepath.Join(dir, key+metadataSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var d download
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	return &d, nil
+}
+
+// writeDownload atomically writes the
+// metadata for the given key.
+func writeDownload(dir, key string, d *download) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, key+metadataSuffix))
+}
+
+// verifyDownload checks that the file matches the
+// digest that was recorded when it was downloaded.
+func verifyDownload(path string, d *download) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if size != d.Size {
+		return fmt.Errorf("expected %d bytes but got %d", d.Size, size)
+	}
+	if digest := hex.EncodeToString(h.Sum(nil)); digest != d.Digest {
+		return fmt.Errorf("expected digest %s but got %s", d.Digest, digest)
+	}
+	return nil
+}
+
+// touchDownload records that the file has been used
+// so that it's the last to be evicted.
+func touchDownload(dir, key string) {
+	now := time.Now()
+	_ = os.Chtimes(filepath.Join(dir, key+metadataSuffix), now, now)
+}
+
+// removeDownload deletes a file and its metadata.
+func removeDownload(dir, key string) {
+	_ = os.RemoveAll(filepath.Join(dir, key))
+	_ = os.Remove(filepath.Join(dir, key+metadataSuffix))
+}
@@ -0,0 +1,240 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers/cache"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testContent = "hello world"
+
+func newTestServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte(testContent))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadURL(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	var requests atomic.Int32
+	srv := newTestServer(t, &requests)
+	src, err := url.Parse(srv.URL + "/files/test.txt")
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte(testContent))
+	checksum := hex.EncodeToString(sum[:])
+
+	t.Run("checksum", func(t *testing.T) {
+		requests.Store(0)
+		ctx := WithOptions(ctx, Options{CacheDir: t.TempDir(), Client: srv.Client()})
+
+		path, err := downloadURL(ctx, src, checksum)
+		require.NoError(t, err)
+		assert.Equal(t, "test.txt", filepath.Base(path))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.EqualValues(t, testContent, data)
+
+		// the second download should come
+		// straight from the cache
+		again, err := downloadURL(ctx, src, checksum)
+		require.NoError(t, err)
+		assert.Equal(t, path, again)
+		assert.EqualValues(t, 1, requests.Load())
+	})
+	t.Run("revalidate", func(t *testing.T) {
+		requests.Store(0)
+		ctx := WithOptions(ctx, Options{CacheDir: t.TempDir(), Client: srv.Client()})
+
+		path, err := downloadURL(ctx, src, "")
+		require.NoError(t, err)
+
+		// files without a checksum are revalidated
+		again, err := downloadURL(ctx, src, "")
+		require.NoError(t, err)
+		assert.Equal(t, path, again)
+		assert.EqualValues(t, 2, requests.Load())
+		assert.FileExists(t, again)
+	})
+	t.Run("wrong checksum", func(t *testing.T) {
+		dir := t.TempDir()
+		ctx := WithOptions(ctx, Options{CacheDir: dir, Client: srv.Client()})
+
+		_, err := downloadURL(ctx, src, "sha256:0000")
+		assert.Error(t, err)
+
+		// nothing should have been cached
+		_, err = readDownload(dir, downloadKey(srv.URL+"/files/test.txt", "sha256:0000"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("corrupt", func(t *testing.T) {
+		requests.Store(0)
+		ctx := WithOptions(ctx, Options{CacheDir: t.TempDir(), Client: srv.Client()})
+
+		path, err := downloadURL(ctx, src, checksum)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, []byte("goodbye world"), 0644))
+
+		// the corrupt file should be replaced
+		path, err = downloadURL(ctx, src, checksum)
+		require.NoError(t, err)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.EqualValues(t, testContent, data)
+		assert.EqualValues(t, 2, requests.Load())
+	})
+	t.Run("offline", func(t *testing.T) {
+		requests.Store(0)
+		dir := t.TempDir()
+
+		_, err := downloadURL(WithOptions(ctx, Options{CacheDir: dir, Client: srv.Client(), Offline: true}), src, "")
+		assert.ErrorIs(t, err, ErrOffline)
+
+		_, err = downloadURL(WithOptions(ctx, Options{CacheDir: dir, Client: srv.Client()}), src, "")
+		require.NoError(t, err)
+
+		// offline mode uses the cached copy
+		// without revalidating it
+		path, err := downloadURL(WithOptions(ctx, Options{CacheDir: dir, Client: srv.Client(), Offline: true}), src, "")
+		require.NoError(t, err)
+		assert.FileExists(t, path)
+		assert.EqualValues(t, 1, requests.Load())
+	})
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv(EnvOffline, "true")
+	opts, err := OptionsFromEnv()
+	require.NoError(t, err)
+	assert.True(t, opts.Offline)
+
+	t.Setenv(EnvOffline, "maybe")
+	_, err = OptionsFromEnv()
+	assert.Error(t, err)
+}
+
+func TestDownloadURL_Concurrent(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	// the server doesn't support revalidation,
+	// so every build downloads the file again
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testContent))
+	}))
+	defer srv.Close()
+	src, err := url.Parse(srv.URL + "/files/test.txt")
+	require.NoError(t, err)
+	ctx = WithOptions(ctx, Options{CacheDir: t.TempDir(), Client: srv.Client()})
+
+	path, err := downloadURL(ctx, src, "")
+	require.NoError(t, err)
+	// keep the file open so that its
+	// inode can't be reused
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	before, err := f.Stat()
+	require.NoError(t, err)
+
+	// every build should be able to read the
+	// file, even though the others are
+	// downloading it at the same time
+	var wg sync.WaitGroup
+	errs := make([]error, 32)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := downloadURL(ctx, src, "")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			data, err := os.ReadFile(path)
+			if err == nil && string(data) != testContent {
+				err = fmt.Errorf("unexpected content: %q", data)
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	// the file hasn't changed, so it
+	// shouldn't have been replaced
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(before, after))
+}
+
+func TestPruneDownloads(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	var requests atomic.Int32
+	srv := newTestServer(t, &requests)
+	dir := t.TempDir()
+	ctx = WithOptions(ctx, Options{CacheDir: dir, Client: srv.Client()})
+
+	// download two files and pretend that
+	// one of them was used a while ago
+	var keys []string
+	for _, name := range []string{"old.txt", "new.txt"} {
+		src, err := url.Parse(srv.URL + "/files/" + name)
+		require.NoError(t, err)
+		_, err = downloadURL(ctx, src, "")
+		require.NoError(t, err)
+		keys = append(keys, downloadKey(srv.URL+"/files/"+name, ""))
+	}
+	lastUsed := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, keys[0]+metadataSuffix), lastUsed, lastUsed))
+
+	entries, err := ListDownloads(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, keys[1], entries[0].Key.Hex)
+	assert.Equal(t, "new.txt", filepath.Base(entries[0].Path))
+	assert.EqualValues(t, len(testContent), entries[0].Size)
+
+	evicted, err := PruneDownloads(ctx, dir, cache.Limits{MaxAge: 24 * time.Hour})
+	require.NoError(t, err)
+	require.Len(t, evicted, 1)
+	assert.Equal(t, keys[0], evicted[0].Key.Hex)
+	assert.NoDirExists(t, filepath.Join(dir, keys[0]))
+
+	evicted, err = ClearDownloads(ctx, dir)
+	require.NoError(t, err)
+	assert.Len(t, evicted, 1)
+	entries, err = ListDownloads(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	locks, err := os.ReadDir(filepath.Join(dir, ".locks"))
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+}
@@ -0,0 +1,131 @@
+package fetch
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+)
+
+var (
+	ErrOffline = errors.New("offline mode is enabled")
+	// ErrInsecure is returned when downloading over
+	// plain HTTP from a host that doesn't allow it.
+	ErrInsecure = errors.New("plain HTTP is not allowed")
+	// ErrNotFound is returned when the server
+	// doesn't have the file.
+	ErrNotFound = errors.New("file not found")
+	// ErrUnauthorised is returned when the server
+	// rejects our credentials (or lack of them).
+	ErrUnauthorised = errors.New("access denied")
+	// ErrTransient is returned for failures that may
+	// succeed if the request is retried, such as 5xx
+	// responses, connection resets and timeouts.
+	ErrTransient = errors.New("temporary failure")
+	// ErrChecksum is returned when a file doesn't
+	// match its checksum.
+	ErrChecksum = errors.New("digests do not match")
+	// ErrSignature is returned when a file doesn't
+	// match its signature.
+	ErrSignature = errors.New("signature verification failed")
+)
+
+// writeError marks errors that happened while writing
+// to disk, which aren't worth retrying.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+// errWriter wraps any errors returned by
+// the underlying io.Writer in a writeError.
+type errWriter struct {
+	w io.Writer
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, &writeError{err: err}
+	}
+	return n, nil
+}
+
+// classify wraps an error returned by the requests
+// library with one of our sentinel errors so that
+// callers can tell what went wrong.
+func classify(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	// the build was cancelled, so
+	// there's no point retrying
+	if ctx.Err() != nil {
+		return err
+	}
+	var we *writeError
+	if errors.As(err, &we) {
+		return err
+	}
+	// retrying won't make a redirect
+	// to plain HTTP allowed
+	if errors.Is(err, ErrInsecure) {
+		return err
+	}
+	// retrying won't fix a certificate
+	// that we don't trust
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return err
+	}
+	if se := new(requests.ResponseError); errors.As(err, &se) {
+		switch {
+		case se.StatusCode == http.StatusNotFound || se.StatusCode == http.StatusGone:
+			return fmt.Errorf("%w: %w", ErrNotFound, err)
+		case se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusForbidden:
+			return fmt.Errorf("%w: %w", ErrUnauthorised, err)
+		case se.StatusCode == http.StatusRequestTimeout || se.StatusCode == http.StatusTooManyRequests || se.StatusCode >= 500:
+			return fmt.Errorf("%w: %w", ErrTransient, err)
+		}
+		return err
+	}
+	// connection failures, resets and
+	// timeouts while reading the body
+	if errors.Is(err, requests.ErrTransport) || errors.Is(err, requests.ErrHandler) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTransient, err)
+	}
+	return err
+}
+
+// retryAfter returns the delay requested by the
+// server using the Retry-After header, if any.
+func retryAfter(err error) time.Duration {
+	se := new(requests.ResponseError)
+	if !errors.As(err, &se) {
+		return 0
+	}
+	v := se.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -2,35 +2,24 @@ package fetch
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/Snakdy/container-build-engine/internal/decompress"
 	"github.com/Snakdy/container-build-engine/pkg/fileutils"
 	"github.com/go-logr/logr"
-	"github.com/gosimple/hashdir"
-	"io"
 	"net/url"
 	"os"
-	"path/filepath"
-	"strings"
 )
 
-func Fetch(ctx context.Context, src, dst, checksum string) (string, error) {
+// Fetch retrieves the file at src and extracts it into dst (unless
+// the "archive" query parameter is false). The file is verified
+// using the checksum and each of the signatures (if any) before
+// it's extracted.
+func Fetch(ctx context.Context, src, dst, checksum string, signatures ...Signature) (string, error) {
 	log := logr.FromContextOrDiscard(ctx)
-	log.V(6).Info("fetching file", "src", src, "dst", dst)
+	log.V(6).Info("fetching file", "src", Redact(src), "dst", dst)
 
-	uri, err := url.Parse(src)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse url: %w", err)
-	}
-
-	var out string
-	if uri.Scheme == "https" {
-		out, err = URL(ctx, uri)
-	} else {
-		out, err = File(ctx, uri)
-	}
+	uri, err := parseURL(src)
 	if err != nil {
 		return "", err
 	}
@@ -40,15 +29,32 @@ func Fetch(ctx context.Context, src, dst, checksum string) (string, error) {
 	if checksum == "" {
 		checksum = uri.Query().Get("checksum")
 	}
+	if checksumURL := uri.Query().Get("checksum-url"); checksum == "" && checksumURL != "" {
+		checksum, err = LookupChecksum(ctx, checksumURL, src)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	out, remote, err := retrieve(ctx, uri, checksum)
+	if err != nil {
+		return "", err
+	}
 
 	// verify the checksum of the file
-	if checksum != "" {
+	if checksum != "" && !remote {
 		log.V(3).Info("verifying checksum", "checksum", checksum, "file", out)
 		if err := checksumFile(out, checksum); err != nil {
 			return "", err
 		}
 	}
 
+	for _, sig := range signatures {
+		if err := verifySignature(ctx, out, sig); err != nil {
+			return "", err
+		}
+	}
+
 	dontArchive := uri.Query().Get("archive") == "false"
 	if dontArchive {
 		log.V(3).Info("skipping un-archival process")
@@ -73,39 +79,34 @@ func Fetch(ctx context.Context, src, dst, checksum string) (string, error) {
 	return out, nil
 }
 
-// checksumFile verifies the checksum of a file or
-// directory.
-func checksumFile(src, checksum string) error {
-	// if the file is actually a directory, then get a
-	// checksum of the whole dir
-	checksum = strings.TrimPrefix(checksum, "sha256:")
-	if info, err := os.Stat(src); err == nil && info.IsDir() {
-		return checksumDir(src, checksum)
-	}
-	f, err := os.Open(filepath.Clean(src))
+// parseURL parses the url without
+// including it in the error, since it
+// may contain credentials.
+func parseURL(s string) (*url.URL, error) {
+	uri, err := url.Parse(s)
 	if err != nil {
-		return fmt.Errorf("opening file: %w", err)
-	}
-	defer f.Close()
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return fmt.Errorf("generating sum: %w", err)
-	}
-	digest := hex.EncodeToString(h.Sum(nil))
-	if digest != checksum {
-		return fmt.Errorf("digests do not match: expected %s, got %s", checksum, digest)
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("failed to parse url: %w", err)
 	}
-	return nil
+	return uri, nil
 }
 
-func checksumDir(src, checksum string) error {
-	checksum = strings.TrimPrefix(checksum, "sha256:")
-	digest, err := hashdir.Make(src, "sha256")
-	if err != nil {
-		return fmt.Errorf("hashing file: %w", err)
-	}
-	if digest != checksum {
-		return fmt.Errorf("digests do not match: expected %s, got %s", checksum, digest)
+// retrieve returns the path of a local copy of the file at uri,
+// and whether it was downloaded. Downloads are verified using the
+// checksum before they're added to the cache.
+func retrieve(ctx context.Context, uri *url.URL, checksum string) (string, bool, error) {
+	switch {
+	case uri.Scheme == "https" || uri.Scheme == "http":
+		out, err := downloadURL(ctx, uri, checksum)
+		return out, true, err
+	// single letters are Windows drive letters
+	case uri.Scheme == "file" || uri.Scheme == "" || len(uri.Scheme) == 1:
+		out, err := File(ctx, uri)
+		return out, false, err
+	default:
+		return "", false, fmt.Errorf("unsupported scheme: %s", uri.Scheme)
 	}
-	return nil
 }
@@ -17,6 +17,34 @@ func TestChecksumFile(t *testing.T) {
 		err := checksumFile("./testdata/test.txt", "sha256:5067772cf39f7f42a7b5cd5d3b13da459fc9530b09722ae8fedc57dbbc0c50a3")
 		assert.NoError(t, err)
 	})
+	t.Run("other algorithms", func(t *testing.T) {
+		for _, checksum := range []string{
+			"sha1:3b15595924c869696a45a8dc28e9f70d7b3b521d",
+			"sha384:ba3ac43cd1fa5493a5223f7789c8afd1cc226842f4f3f3ae4825cc4ca7b2405337ad1abf9f391c08443ba4ded154dc8e",
+			"SHA512:597B4C2EE937B53E06E3C6A0FD36624E139A51B055E96E85727CAEF166F21361C4DF90A12306F3ED78FBED3CC5009599C47F1D3B33B3F98B536C16109EBAA59B",
+		} {
+			assert.NoError(t, checksumFile("./testdata/test.txt", checksum))
+		}
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		err := checksumFile("./testdata/test.txt", "sha1:0000000000000000000000000000000000000000")
+		assert.ErrorIs(t, err, ErrChecksum)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, checksum := range []string{
+			"md5:d41d8cd98f00b204e9800998ecf8427e",
+			"sha512:5067772cf39f7f42a7b5cd5d3b13da459fc9530b09722ae8fedc57dbbc0c50a3",
+			"not-hex",
+		} {
+			err := checksumFile("./testdata/test.txt", checksum)
+			assert.Error(t, err)
+			assert.NotErrorIs(t, err, ErrChecksum)
+		}
+	})
+	t.Run("sha384 directory", func(t *testing.T) {
+		err := checksumFile("./testdata", "sha384:ba3ac43cd1fa5493a5223f7789c8afd1cc226842f4f3f3ae4825cc4ca7b2405337ad1abf9f391c08443ba4ded154dc8e")
+		assert.Error(t, err)
+	})
 }
 
 func TestFetch(t *testing.T) {
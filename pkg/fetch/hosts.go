@@ -0,0 +1,233 @@
+package fetch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// HostConfig controls how we connect to a host.
+type HostConfig struct {
+	// AllowHTTP allows files to be downloaded
+	// over plain HTTP.
+	AllowHTTP bool `json:"allowHTTP,omitempty"`
+	// InsecureSkipVerify disables TLS
+	// certificate verification.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// CAFile is a PEM bundle of root CAs that are trusted
+	// in addition to the system roots.
+	CAFile string `json:"ca,omitempty"`
+	// CertFile and KeyFile are the PEM encoded client
+	// certificate and key used for mutual TLS.
+	CertFile string `json:"cert,omitempty"`
+	KeyFile  string `json:"key,omitempty"`
+	// Proxy is the URL of the proxy server. If not set,
+	// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+	// variables are used.
+	Proxy string `json:"proxy,omitempty"`
+	// Auth configures the credentials
+	// that are sent to the host.
+	Auth Auth `json:"auth,omitempty"`
+}
+
+// transportConfig holds the parts of a HostConfig
+// that need a custom http.Transport.
+type transportConfig struct {
+	insecureSkipVerify bool
+	caFile             string
+	certFile           string
+	keyFile            string
+	proxy              string
+}
+
+func (h HostConfig) transportConfig() transportConfig {
+	return transportConfig{
+		insecureSkipVerify: h.InsecureSkipVerify,
+		caFile:             h.CAFile,
+		certFile:           h.CertFile,
+		keyFile:            h.KeyFile,
+		proxy:              h.Proxy,
+	}
+}
+
+// Config is the file format used to configure downloads.
+type Config struct {
+	// Hosts is keyed by the host (e.g., "example.com"
+	// or "example.com:8080"). Wildcards (e.g.,
+	// "*.example.com") match any subdomain.
+	Hosts map[string]HostConfig `json:"hosts,omitempty"`
+}
+
+// ReadConfig reads a YAML or JSON Config file. Relative
+// paths in the file are resolved against its directory.
+func ReadConfig(path string) (*Config, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config Config
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4).Decode(&config); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for k, h := range config.Hosts {
+		h.CAFile = resolve(h.CAFile)
+		h.CertFile = resolve(h.CertFile)
+		h.KeyFile = resolve(h.KeyFile)
+		h.Auth.TokenFile = resolve(h.Auth.TokenFile)
+		h.Auth.PasswordFile = resolve(h.Auth.PasswordFile)
+		config.Hosts[k] = h
+	}
+	return &config, nil
+}
+
+// Host returns the configuration for the host in the url.
+// An exact match (including the port) is preferred,
+// followed by the hostname and then wildcards.
+func (o Options) Host(u *url.URL) HostConfig {
+	if len(o.Hosts) == 0 {
+		return HostConfig{}
+	}
+	if h, ok := o.Hosts[u.Host]; ok {
+		return h
+	}
+	hostname := u.Hostname()
+	if h, ok := o.Hosts[hostname]; ok {
+		return h
+	}
+	// try each parent domain, starting
+	// with the most specific
+	for domain := hostname; ; {
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			break
+		}
+		if h, ok := o.Hosts["*."+parent]; ok {
+			return h
+		}
+		domain = parent
+	}
+	return HostConfig{}
+}
+
+// client returns the http.Client used to
+// download the file at the given url.
+//
+// Each request (including redirects) uses the
+// transport of the host that it's sent to, so the
+// settings of one host never apply to another.
+func (o Options) client(u *url.URL) (*http.Client, error) {
+	if o.Client != nil {
+		return o.Client, nil
+	}
+	// make sure that the host is configured
+	// properly before we start
+	if _, err := o.Host(u).transport(); err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &hostTransport{opts: o}}, nil
+}
+
+// hostTransport sends each request using the
+// transport configured for its host.
+type hostTransport struct {
+	opts Options
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := t.opts.Host(req.URL)
+	// a redirect could take us
+	// to a plain HTTP url
+	if req.URL.Scheme == "http" && !h.AllowHTTP {
+		return nil, fmt.Errorf("%w: %s must allow HTTP to download %s", ErrInsecure, req.URL.Host, Redact(req.URL.String()))
+	}
+	rt, err := h.transport()
+	if err != nil {
+		return nil, fmt.Errorf("configuring transport for %s: %w", req.URL.Host, err)
+	}
+	return rt.RoundTrip(req)
+}
+
+// transports holds a transport for each
+// transportConfig so that connections are
+// reused between downloads.
+var transports sync.Map
+
+// transport returns the http.RoundTripper used to
+// connect to the host. Transports are cached for the
+// lifetime of the process.
+func (h HostConfig) transport() (http.RoundTripper, error) {
+	key := h.transportConfig()
+	if key == (transportConfig{}) {
+		return http.DefaultTransport, nil
+	}
+	if rt, ok := transports.Load(key); ok {
+		return rt.(http.RoundTripper), nil
+	}
+	rt, err := key.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	// another download may have beaten us to it
+	actual, loaded := transports.LoadOrStore(key, rt)
+	if loaded {
+		rt.CloseIdleConnections()
+	}
+	return actual.(http.RoundTripper), nil
+}
+
+func (c transportConfig) newTransport() (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.insecureSkipVerify, //nolint:gosec
+	}
+	if c.caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", c.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.certFile != "" || c.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = http.ProxyFromEnvironment
+	if c.proxy != "" {
+		proxy, err := url.Parse(c.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return transport, nil
+}
@@ -0,0 +1,249 @@
+package fetch
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions_Host(t *testing.T) {
+	opts := Options{Hosts: map[string]HostConfig{
+		"example.com:8080":   {AllowHTTP: true},
+		"example.com":        {CAFile: "exact"},
+		"*.example.com":      {CAFile: "wildcard"},
+		"*.deep.example.com": {CAFile: "deep"},
+	}}
+
+	var cases = []struct {
+		in       string
+		expected HostConfig
+	}{
+		{"https://example.com:8080/file", HostConfig{AllowHTTP: true}},
+		{"https://example.com/file", HostConfig{CAFile: "exact"}},
+		{"https://example.com:8443/file", HostConfig{CAFile: "exact"}},
+		{"https://files.example.com/file", HostConfig{CAFile: "wildcard"}},
+		{"https://a.deep.example.com/file", HostConfig{CAFile: "deep"}},
+		{"https://example.org/file", HostConfig{}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			u, err := url.Parse(tt.in)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, opts.Host(u))
+		})
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fetch.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`hosts:
+  artifacts.internal:8080:
+    allowHTTP: true
+    insecureSkipVerify: true
+  files.example.com:
+    ca: certs/ca.pem
+    cert: /etc/ssl/client.pem
+    key: /etc/ssl/client-key.pem
+    proxy: http://proxy.example.com:3128
+`), 0644))
+
+	config, err := ReadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]HostConfig{
+		"artifacts.internal:8080": {AllowHTTP: true, InsecureSkipVerify: true},
+		"files.example.com": {
+			CAFile:   filepath.Join(dir, "certs/ca.pem"),
+			CertFile: "/etc/ssl/client.pem",
+			KeyFile:  "/etc/ssl/client-key.pem",
+			Proxy:    "http://proxy.example.com:3128",
+		},
+	}, config.Hosts)
+}
+
+// writePEM writes the DER encoded block to a file.
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+func TestDownloadURL_TLS(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	// generate a client certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cbe"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(certDER)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile := writePEM(t, "client.pem", "CERTIFICATE", certDER)
+	keyFile := writePEM(t, "client-key.pem", "EC PRIVATE KEY", keyDER)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testContent))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	src, err := url.Parse(srv.URL + "/test.txt")
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name string
+		host HostConfig
+		ok   bool
+	}{
+		{"untrusted", HostConfig{}, false},
+		{"no client certificate", HostConfig{CAFile: caFile}, false},
+		{"mutual tls", HostConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{
+				CacheDir: t.TempDir(),
+				Retries:  -1,
+				Hosts:    map[string]HostConfig{src.Host: tt.host},
+			}
+			path, err := downloadURL(WithOptions(ctx, opts), src, "")
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.EqualValues(t, testContent, data)
+		})
+	}
+}
+
+func TestDownloadURL_Insecure(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testContent))
+	}))
+	defer srv.Close()
+
+	src, err := url.Parse(srv.URL + "/test.txt")
+	require.NoError(t, err)
+
+	_, err = downloadURL(WithOptions(ctx, Options{CacheDir: t.TempDir()}), src, "")
+	assert.ErrorIs(t, err, ErrInsecure)
+
+	path, err := downloadURL(WithOptions(ctx, Options{
+		CacheDir: t.TempDir(),
+		Hosts:    map[string]HostConfig{src.Host: {AllowHTTP: true}},
+	}), src, "")
+	require.NoError(t, err)
+	assert.FileExists(t, path)
+}
+
+func TestDownloadURL_Proxy(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	// the proxy receives the absolute
+	// url of the file that we want
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		_, _ = w.Write([]byte(testContent))
+	}))
+	defer proxy.Close()
+
+	src, err := url.Parse("http://artifacts.invalid/test.txt")
+	require.NoError(t, err)
+	path, err := downloadURL(WithOptions(ctx, Options{
+		CacheDir: t.TempDir(),
+		Hosts:    map[string]HostConfig{"*.invalid": {AllowHTTP: true, Proxy: proxy.URL}},
+	}), src, "")
+	require.NoError(t, err)
+	assert.FileExists(t, path)
+	assert.Equal(t, "http://artifacts.invalid/test.txt", requested)
+}
+
+func TestDownloadURL_Redirect(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testContent))
+	})
+	untrusted := httptest.NewTLSServer(handler)
+	defer untrusted.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	// download redirects to the target from a host
+	// that allows HTTP and skips verification. Those
+	// settings must not apply to the target.
+	download := func(t *testing.T, target string) error {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, target+r.URL.Path, http.StatusFound)
+		}))
+		defer srv.Close()
+		src, err := url.Parse(srv.URL + "/test.txt")
+		require.NoError(t, err)
+
+		_, err = downloadURL(WithOptions(ctx, Options{
+			CacheDir: t.TempDir(),
+			Retries:  -1,
+			Hosts:    map[string]HostConfig{src.Host: {AllowHTTP: true, InsecureSkipVerify: true}},
+		}), src, "")
+		return err
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		var certErr *tls.CertificateVerificationError
+		assert.ErrorAs(t, download(t, untrusted.URL), &certErr)
+	})
+	t.Run("plain http", func(t *testing.T) {
+		assert.ErrorIs(t, download(t, plain.URL), ErrInsecure)
+	})
+}
+
+func TestHostConfig_Transport(t *testing.T) {
+	rt, err := HostConfig{}.transport()
+	require.NoError(t, err)
+	assert.Same(t, http.DefaultTransport, rt)
+
+	// hosts with the same settings
+	// share a transport
+	rt, err = HostConfig{InsecureSkipVerify: true}.transport()
+	require.NoError(t, err)
+	again, err := HostConfig{InsecureSkipVerify: true, AllowHTTP: true}.transport()
+	require.NoError(t, err)
+	assert.Same(t, rt, again)
+}
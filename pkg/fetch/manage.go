@@ -0,0 +1,125 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers/cache"
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ListDownloads returns the files in the download cache,
+// with the most recently used first. The Key of each entry
+// is the cache key of the download, and the Path is the
+// downloaded file.
+func ListDownloads(dir string) ([]cache.Entry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []cache.Entry
+	for _, f := range files {
+		key, ok := strings.CutSuffix(f.Name(), metadataSuffix)
+		if !ok || strings.HasPrefix(key, tempPrefix) || !f.Type().IsRegular() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			// it was probably removed by
+			// another process
+			continue
+		}
+		e := cache.Entry{
+			Key:      v1.Hash{Algorithm: "sha256", Hex: key},
+			LastUsed: info.ModTime(),
+		}
+		// each key has a directory holding
+		// the file with its original name
+		names, _ := os.ReadDir(filepath.Join(dir, key))
+		for _, n := range names {
+			if info, err := n.Info(); err == nil && n.Type().IsRegular() {
+				e.Path = filepath.Join(dir, key, n.Name())
+				e.Size = info.Size()
+				break
+			}
+		}
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b cache.Entry) int {
+		return b.LastUsed.Compare(a.LastUsed)
+	})
+	return entries, nil
+}
+
+// PruneDownloads evicts files from the download cache
+// until it satisfies the limits, and returns the
+// evicted entries.
+func PruneDownloads(ctx context.Context, dir string, limits cache.Limits) ([]cache.Entry, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("dir", dir)
+
+	entries, err := ListDownloads(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var evicted []cache.Entry
+	var total int64
+	now := time.Now()
+	for _, e := range entries {
+		expired := limits.MaxAge > 0 && now.Sub(e.LastUsed) > limits.MaxAge
+		tooBig := limits.MaxSize > 0 && total+e.Size > limits.MaxSize
+		if !expired && !tooBig {
+			total += e.Size
+			continue
+		}
+		log.V(3).Info("evicting download", "key", e.Key, "size", e.Size, "lastUsed", e.LastUsed, "expired", expired)
+		if err := evictDownload(dir, e.Key.Hex); err != nil {
+			return evicted, fmt.Errorf("removing %s: %w", e.Key, err)
+		}
+		evicted = append(evicted, e)
+	}
+	cache.RemoveStaleFiles(ctx, dir)
+	log.V(1).Info("pruned download cache", "evicted", len(evicted), "remaining", len(entries)-len(evicted), "size", total)
+	return evicted, nil
+}
+
+// ClearDownloads evicts every file from the download cache.
+func ClearDownloads(ctx context.Context, dir string) ([]cache.Entry, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("dir", dir)
+
+	entries, err := ListDownloads(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if err := evictDownload(dir, e.Key.Hex); err != nil {
+			return entries[:i], fmt.Errorf("removing %s: %w", e.Key, err)
+		}
+	}
+	cache.RemoveStaleFiles(ctx, dir)
+	log.V(1).Info("cleared download cache", "evicted", len(entries))
+	return entries, nil
+}
+
+// evictDownload removes a download while holding its
+// lock, so that it isn't removed while a build is
+// replacing it.
+func evictDownload(dir, key string) error {
+	unlock, err := cache.Lock(dir, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	removeDownload(dir, key)
+	return nil
+}
@@ -0,0 +1,151 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Snakdy/container-build-engine/pkg/containers/cache"
+)
+
+// Environment variables used to configure
+// how files are downloaded.
+const (
+	// EnvOffline enables offline mode when set to "true".
+	EnvOffline = "CBE_OFFLINE"
+	EnvRetries = "CBE_FETCH_RETRIES"
+	EnvTimeout = "CBE_FETCH_TIMEOUT"
+	// EnvConfig is the path to a Config file.
+	EnvConfig = "CBE_FETCH_CONFIG"
+)
+
+const (
+	DefaultRetries = 3
+	DefaultBackoff = time.Second
+	// maxBackoff caps the delay between retries.
+	maxBackoff = 30 * time.Second
+)
+
+// Options controls how files are downloaded.
+type Options struct {
+	// CacheDir is where downloaded files are cached.
+	// If not set, cache.DownloadDir is used.
+	CacheDir string
+	// Offline prevents any requests from being made.
+	// Files must already be in the download cache.
+	Offline bool
+	// Client is used to make requests. If not set, a
+	// client is created using the HostConfig for each
+	// request, falling back to http.DefaultClient.
+	Client *http.Client
+	// Hosts configures how we connect to specific
+	// hosts. See Config.Hosts.
+	Hosts map[string]HostConfig
+	// Retries is the number of times that a request is
+	// retried after a transient failure. If not set,
+	// DefaultRetries is used. Negative values disable
+	// retries.
+	Retries int
+	// Backoff is the delay before the first retry, which
+	// doubles after each attempt. If not set,
+	// DefaultBackoff is used.
+	Backoff time.Duration
+	// Timeout limits how long each request can take,
+	// including reading the response. Zero means that
+	// there is no limit.
+	Timeout time.Duration
+}
+
+// GetCacheDir returns the nominated cache
+// directory or cache.DownloadDir.
+func (o Options) GetCacheDir() string {
+	if o.CacheDir == "" {
+		return cache.DownloadDir()
+	}
+	return o.CacheDir
+}
+
+// GetRetries returns the nominated number
+// of retries or DefaultRetries.
+func (o Options) GetRetries() int {
+	switch {
+	case o.Retries < 0:
+		return 0
+	case o.Retries == 0:
+		return DefaultRetries
+	default:
+		return o.Retries
+	}
+}
+
+// GetBackoff returns the delay before the given
+// retry (starting at zero), which grows exponentially
+// up to a limit.
+func (o Options) GetBackoff(attempt int) time.Duration {
+	d := o.Backoff
+	if d <= 0 {
+		d = DefaultBackoff
+	}
+	for range attempt {
+		d *= 2
+		if d >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return d
+}
+
+// OptionsFromEnv reads the download options
+// from the environment.
+func OptionsFromEnv() (Options, error) {
+	var opts Options
+	if v := os.Getenv(EnvOffline); v != "" {
+		offline, err := strconv.ParseBool(v)
+		if err != nil {
+			return Options{}, fmt.Errorf("parsing %s: %w", EnvOffline, err)
+		}
+		opts.Offline = offline
+	}
+	if v := os.Getenv(EnvRetries); v != "" {
+		retries, err := strconv.Atoi(v)
+		if err != nil {
+			return Options{}, fmt.Errorf("parsing %s: %w", EnvRetries, err)
+		}
+		opts.Retries = retries
+	}
+	if v := os.Getenv(EnvTimeout); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return Options{}, fmt.Errorf("parsing %s: %w", EnvTimeout, err)
+		}
+		opts.Timeout = timeout
+	}
+	if v := os.Getenv(EnvConfig); v != "" {
+		config, err := ReadConfig(v)
+		if err != nil {
+			return Options{}, fmt.Errorf("parsing %s: %w", EnvConfig, err)
+		}
+		opts.Hosts = config.Hosts
+	}
+	return opts, nil
+}
+
+type contextKey struct{}
+
+// WithOptions returns a context that
+// carries the given Options.
+func WithOptions(ctx context.Context, opts Options) context.Context {
+	return context.WithValue(ctx, contextKey{}, opts)
+}
+
+// OptionsFromContext returns the Options in the
+// context, or the defaults if there aren't any.
+func OptionsFromContext(ctx context.Context) Options {
+	if opts, ok := ctx.Value(contextKey{}).(Options); ok {
+		return opts
+	}
+	return Options{}
+}
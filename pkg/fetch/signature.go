@@ -0,0 +1,287 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-logr/logr"
+	"github.com/jedisct1/go-minisign"
+	"golang.org/x/crypto/blake2b"
+)
+
+// SignatureType is the format of a detached signature.
+type SignatureType string
+
+const (
+	// SignaturePGP is an OpenPGP detached signature (e.g., ".asc"
+	// or ".sig"), which is verified using a keyring.
+	SignaturePGP SignatureType = "pgp"
+	// SignatureMinisign is a minisign signature (".minisig").
+	SignatureMinisign SignatureType = "minisign"
+	// SignatureCosign is a signature created by "cosign sign-blob"
+	// using a key pair. Keyless signatures aren't supported.
+	SignatureCosign SignatureType = "cosign"
+)
+
+// ParseSignatureType parses the type of signature. An empty
+// string means that the type is detected from the public key.
+func ParseSignatureType(s string) (SignatureType, error) {
+	switch t := SignatureType(s); t {
+	case SignaturePGP, SignatureMinisign, SignatureCosign, "":
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported signature type: %s", s)
+	}
+}
+
+// Signature is a detached signature used to verify a file.
+type Signature struct {
+	// URI of the signature (e.g., "https://example.com/file.tar.gz.asc").
+	URI string
+	// PublicKey is the URI of the public key, or
+	// the keyring for OpenPGP signatures.
+	PublicKey string
+	// Type of the signature. If not set, it's
+	// detected from the public key.
+	Type SignatureType
+}
+
+// verifySignature checks that the file at path
+// was signed by the owner of the public key.
+func verifySignature(ctx context.Context, path string, sig Signature) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("signature", Redact(sig.URI), "publicKey", Redact(sig.PublicKey))
+
+	if sig.URI == "" || sig.PublicKey == "" {
+		return errors.New("verifying signatures requires a signature and a public key")
+	}
+	signature, err := retrieveData(ctx, sig.URI)
+	if err != nil {
+		return fmt.Errorf("retrieving signature: %w", err)
+	}
+	publicKey, err := retrieveData(ctx, sig.PublicKey)
+	if err != nil {
+		return fmt.Errorf("retrieving public key: %w", err)
+	}
+
+	t := sig.Type
+	if t == "" {
+		t, err = detectSignatureType(publicKey)
+		if err != nil {
+			return err
+		}
+	}
+	log.V(3).Info("verifying signature", "type", t, "file", path)
+
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+
+	switch t {
+	case SignaturePGP:
+		return verifyPGP(f, signature, publicKey)
+	case SignatureMinisign:
+		return verifyMinisign(f, signature, publicKey)
+	case SignatureCosign:
+		return verifyCosign(f, signature, publicKey)
+	default:
+		return fmt.Errorf("unsupported signature type: %s", t)
+	}
+}
+
+// retrieveData returns the contents of the file at the uri.
+func retrieveData(ctx context.Context, s string) ([]byte, error) {
+	uri, err := parseURL(s)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := retrieve(ctx, uri, "")
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Clean(out))
+}
+
+// detectSignatureType guesses the type of
+// signature based on the format of the public key.
+func detectSignatureType(publicKey []byte) (SignatureType, error) {
+	switch {
+	case bytes.Contains(publicKey, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")):
+		return SignaturePGP, nil
+	case bytes.Contains(publicKey, []byte("-----BEGIN PUBLIC KEY-----")):
+		return SignatureCosign, nil
+	case bytes.HasPrefix(publicKey, []byte("untrusted comment:")):
+		return SignatureMinisign, nil
+	}
+	if _, err := minisign.NewPublicKey(string(bytes.TrimSpace(publicKey))); err == nil {
+		return SignatureMinisign, nil
+	}
+	// binary OpenPGP packets always
+	// have the high bit set
+	if len(publicKey) > 0 && publicKey[0]&0x80 != 0 {
+		return SignaturePGP, nil
+	}
+	return "", errors.New("unable to detect the type of signature from the public key")
+}
+
+func verifyPGP(f io.Reader, signature, publicKey []byte) error {
+	var keyring openpgp.EntityList
+	var err error
+	if bytes.Contains(publicKey, []byte("-----BEGIN PGP")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(publicKey))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(publicKey))
+	}
+	if err != nil {
+		return fmt.Errorf("reading keyring: %w", err)
+	}
+	if bytes.Contains(signature, []byte("-----BEGIN PGP SIGNATURE-----")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, f, bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, f, bytes.NewReader(signature), nil)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSignature, err)
+	}
+	return nil
+}
+
+func verifyMinisign(f io.Reader, signature, publicKey []byte) error {
+	var key minisign.PublicKey
+	var err error
+	// the key may either be a file (including the
+	// comment) or just the base64 encoded key
+	if bytes.HasPrefix(publicKey, []byte("untrusted comment:")) {
+		key, err = minisign.DecodePublicKey(string(publicKey))
+	} else {
+		key, err = minisign.NewPublicKey(string(bytes.TrimSpace(publicKey)))
+	}
+	if err != nil {
+		return fmt.Errorf("reading public key: %w", err)
+	}
+	sig, err := minisign.DecodeSignature(string(signature))
+	if err != nil {
+		return fmt.Errorf("reading signature: %w", err)
+	}
+	var data []byte
+	switch sig.SignatureAlgorithm {
+	case minisignPrehashed:
+		// prehashed signatures (the default since minisign
+		// 0.8) sign the BLAKE2b-512 digest of the file, so
+		// we hash it ourselves rather than reading it into
+		// memory and verify the digest as if it were the
+		// whole file. The algorithm isn't covered by the
+		// global signature, so changing it is safe.
+		h, err := blake2b.New512(nil)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(h, f); err != nil {
+			return fmt.Errorf("reading file: %w", err)
+		}
+		data = h.Sum(nil)
+		sig.SignatureAlgorithm = minisignLegacy
+	default:
+		// legacy signatures sign the whole file, which
+		// the library needs to have in memory
+		data, err = io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("reading file: %w", err)
+		}
+	}
+	if _, err := key.Verify(data, sig); err != nil {
+		return fmt.Errorf("%w: %w", ErrSignature, err)
+	}
+	return nil
+}
+
+// Minisign signature algorithms.
+var (
+	minisignLegacy    = [2]byte{'E', 'd'}
+	minisignPrehashed = [2]byte{'E', 'D'}
+)
+
+func verifyCosign(f io.Reader, signature, publicKey []byte) error {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return errors.New("reading public key: no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("reading public key: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("reading signature: %w", err)
+	}
+
+	// Ed25519 signs the whole file, so it has to be read into
+	// memory. The others sign its digest, using the same hash
+	// as cosign for the type of key.
+	var ok bool
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("reading file: %w", err)
+		}
+		ok = ed25519.Verify(key, data, sig)
+	case *ecdsa.PublicKey:
+		digest, err := hashFile(f, ecdsaHash(key))
+		if err != nil {
+			return err
+		}
+		ok = ecdsa.VerifyASN1(key, digest, sig)
+	case *rsa.PublicKey:
+		digest, err := hashFile(f, crypto.SHA256)
+		if err != nil {
+			return err
+		}
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) == nil
+	default:
+		return fmt.Errorf("unsupported public key type: %T", key)
+	}
+	if !ok {
+		return fmt.Errorf("%w: invalid signature", ErrSignature)
+	}
+	return nil
+}
+
+// ecdsaHash returns the hash that cosign
+// uses for the size of the curve.
+func ecdsaHash(key *ecdsa.PublicKey) crypto.Hash {
+	switch key.Curve {
+	case elliptic.P384():
+		return crypto.SHA384
+	case elliptic.P521():
+		return crypto.SHA512
+	default:
+		return crypto.SHA256
+	}
+}
+
+func hashFile(f io.Reader, hash crypto.Hash) ([]byte, error) {
+	h := hash.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+	return h.Sum(nil), nil
+}
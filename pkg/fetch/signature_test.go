@@ -0,0 +1,180 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+// signer creates a public key and a signature for
+// the data in the format used by a signature type.
+type signer func(t *testing.T, data []byte) (publicKey, signature []byte)
+
+func pgpSigner(armored bool) signer {
+	return func(t *testing.T, data []byte) ([]byte, []byte) {
+		entity, err := openpgp.NewEntity("cbe", "", "cbe@example.com", nil)
+		require.NoError(t, err)
+
+		var key bytes.Buffer
+		w, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+		require.NoError(t, err)
+		require.NoError(t, entity.Serialize(w))
+		require.NoError(t, w.Close())
+
+		var sig bytes.Buffer
+		if armored {
+			require.NoError(t, openpgp.ArmoredDetachSign(&sig, entity, bytes.NewReader(data), nil))
+		} else {
+			require.NoError(t, openpgp.DetachSign(&sig, entity, bytes.NewReader(data), nil))
+		}
+		return key.Bytes(), sig.Bytes()
+	}
+}
+
+func minisignSigner(prehashed bool) signer {
+	return func(t *testing.T, data []byte) ([]byte, []byte) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		keyID := []byte("cbe-test")
+
+		algorithm := []byte("Ed")
+		if prehashed {
+			algorithm = []byte("ED")
+			digest := blake2b.Sum512(data)
+			data = digest[:]
+		}
+		key := append(append([]byte("Ed"), keyID...), pub...)
+		sig := ed25519.Sign(priv, data)
+		trustedComment := "timestamp:0\tfile:test.txt"
+		globalSig := ed25519.Sign(priv, append(sig, trustedComment...))
+
+		publicKey := "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(key) + "\n"
+		signature := "untrusted comment: signature from minisign secret key\n" +
+			base64.StdEncoding.EncodeToString(append(append(algorithm, keyID...), sig...)) + "\n" +
+			"trusted comment: " + trustedComment + "\n" +
+			base64.StdEncoding.EncodeToString(globalSig) + "\n"
+		return []byte(publicKey), []byte(signature)
+	}
+}
+
+func cosignSigner(curve elliptic.Curve, hash crypto.Hash) signer {
+	return func(t *testing.T, data []byte) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+
+		h := hash.New()
+		h.Write(data)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, h.Sum(nil))
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), []byte(base64.StdEncoding.EncodeToString(sig))
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	data, err := os.ReadFile("./testdata/test.txt")
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name     string
+		sign     signer
+		expected SignatureType
+	}{
+		{"pgp armored", pgpSigner(true), SignaturePGP},
+		{"pgp binary", pgpSigner(false), SignaturePGP},
+		{"minisign", minisignSigner(false), SignatureMinisign},
+		{"minisign prehashed", minisignSigner(true), SignatureMinisign},
+		{"cosign", cosignSigner(elliptic.P256(), crypto.SHA256), SignatureCosign},
+		{"cosign p384", cosignSigner(elliptic.P384(), crypto.SHA384), SignatureCosign},
+		{"cosign p521", cosignSigner(elliptic.P521(), crypto.SHA512), SignatureCosign},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			publicKey, signature := tt.sign(t, data)
+			keyPath := filepath.Join(dir, "key")
+			sigPath := filepath.Join(dir, "sig")
+			require.NoError(t, os.WriteFile(keyPath, publicKey, 0644))
+			require.NoError(t, os.WriteFile(sigPath, signature, 0644))
+
+			detected, err := detectSignatureType(publicKey)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, detected)
+
+			sig := Signature{URI: "file://" + sigPath, PublicKey: "file://" + keyPath}
+			assert.NoError(t, verifySignature(ctx, "./testdata/test.txt", sig))
+
+			// the signature doesn't match a different file
+			tampered := filepath.Join(dir, "tampered.txt")
+			require.NoError(t, os.WriteFile(tampered, append(data, '!'), 0644))
+			assert.ErrorIs(t, verifySignature(ctx, tampered, sig), ErrSignature)
+
+			// or a different key
+			otherKey, _ := tt.sign(t, data)
+			require.NoError(t, os.WriteFile(keyPath, otherKey, 0644))
+			assert.Error(t, verifySignature(ctx, "./testdata/test.txt", sig))
+		})
+	}
+}
+
+func TestFetch_Signature(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	data, err := os.ReadFile("./testdata/test.txt")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	publicKey, signature := cosignSigner(elliptic.P256(), crypto.SHA256)(t, data)
+	keyPath := filepath.Join(dir, "cosign.pub")
+	sigPath := filepath.Join(dir, "test.txt.sig")
+	require.NoError(t, os.WriteFile(keyPath, publicKey, 0644))
+	require.NoError(t, os.WriteFile(sigPath, signature, 0644))
+
+	path, err := Fetch(ctx, "file://./testdata/test.txt?archive=false", t.TempDir(), "", Signature{
+		URI:       "file://" + sigPath,
+		PublicKey: "file://" + keyPath,
+		Type:      SignatureCosign,
+	})
+	require.NoError(t, err)
+	assert.FileExists(t, path)
+
+	// the wrong type of signature
+	_, err = Fetch(ctx, "file://./testdata/test.txt?archive=false", t.TempDir(), "", Signature{
+		URI:       "file://" + sigPath,
+		PublicKey: "file://" + keyPath,
+		Type:      SignatureMinisign,
+	})
+	assert.Error(t, err)
+}
+
+func TestParseSignatureType(t *testing.T) {
+	for _, s := range []string{"", "pgp", "minisign", "cosign"} {
+		v, err := ParseSignatureType(s)
+		assert.NoError(t, err)
+		assert.EqualValues(t, s, v)
+	}
+	_, err := ParseSignatureType("x509")
+	assert.Error(t, err)
+}
@@ -0,0 +1,166 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+	"github.com/go-logr/logr"
+)
+
+// transfer downloads a file, retrying transient failures
+// and resuming partial downloads using Range requests.
+type transfer struct {
+	uri     string
+	client  *http.Client
+	headers http.Header
+	f       *os.File
+	h       hash.Hash
+	// written is the number of bytes that
+	// have been written to f
+	written int64
+	// cached is the copy that we already have (if any),
+	// which is revalidated using its ETag or
+	// Last-Modified headers.
+	cached *download
+	// etag and lastModified are the headers
+	// returned by the server.
+	etag         string
+	lastModified string
+	// notModified is set if the server
+	// told us that the cached copy is fine.
+	notModified bool
+}
+
+// run makes requests until the file has been downloaded,
+// a permanent error occurs or we run out of retries.
+func (t *transfer) run(ctx context.Context, opts Options) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("src", t.uri)
+
+	retries := opts.GetRetries()
+	for attempt := 0; ; attempt++ {
+		err := classify(ctx, t.attempt(ctx, opts))
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrTransient) || attempt >= retries {
+			return err
+		}
+		wait := min(max(opts.GetBackoff(attempt), retryAfter(err)), maxBackoff)
+		log.Info("retrying download after a temporary failure", "attempt", attempt+1, "retries", retries, "wait", wait, "written", t.written, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (t *transfer) attempt(ctx context.Context, opts Options) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("src", t.uri)
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	rb := requests.URL(t.uri).
+		Client(t.client).
+		Headers(t.headers).
+		CheckStatus(http.StatusOK, http.StatusPartialContent, http.StatusNotModified)
+
+	ifRange := t.ifRange()
+	switch {
+	case t.written > 0 && ifRange != "":
+		log.V(3).Info("resuming download", "offset", t.written)
+		rb.Header("Range", fmt.Sprintf("bytes=%d-", t.written)).
+			Header("If-Range", ifRange)
+	case t.written > 0:
+		// we can't tell whether the file has
+		// changed, so we need to start again
+		if err := t.reset(); err != nil {
+			return err
+		}
+	case t.cached != nil:
+		rb.HeaderOptional("If-None-Match", t.cached.ETag).
+			HeaderOptional("If-Modified-Since", t.cached.LastModified)
+	}
+
+	err := rb.Handle(func(res *http.Response) error {
+		switch res.StatusCode {
+		case http.StatusNotModified:
+			t.notModified = true
+			return nil
+		case http.StatusPartialContent:
+			if start, expected := contentRangeStart(res.Header.Get("Content-Range")), t.written; start != expected {
+				if err := t.reset(); err != nil {
+					return err
+				}
+				return fmt.Errorf("%w: expected content from byte %d but got %d", ErrTransient, expected, start)
+			}
+		default:
+			// the server ignored our range request
+			// (e.g., because the file has changed)
+			if err := t.reset(); err != nil {
+				return err
+			}
+			t.etag = res.Header.Get("ETag")
+			t.lastModified = res.Header.Get("Last-Modified")
+		}
+		n, err := io.Copy(&errWriter{w: io.MultiWriter(t.f, t.h)}, res.Body)
+		t.written += n
+		return err
+	}).Fetch(ctx)
+	if requests.HasStatusErr(err, http.StatusRequestedRangeNotSatisfiable) {
+		if err := t.reset(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %w", ErrTransient, err)
+	}
+	return err
+}
+
+// ifRange returns the value of the If-Range header, which
+// makes sure that we only resume if the file hasn't changed.
+// Weak ETags can't be used.
+func (t *transfer) ifRange() string {
+	if t.etag != "" && !strings.HasPrefix(t.etag, "W/") {
+		return t.etag
+	}
+	return t.lastModified
+}
+
+// reset discards anything that we've downloaded so far.
+func (t *transfer) reset() error {
+	if t.written == 0 {
+		return nil
+	}
+	if err := t.f.Truncate(0); err != nil {
+		return &writeError{err: err}
+	}
+	if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+		return &writeError{err: err}
+	}
+	t.h.Reset()
+	t.written = 0
+	return nil
+}
+
+// contentRangeStart returns the first byte in a
+// Content-Range header (e.g., "bytes 100-199/200"),
+// or -1 if it can't be parsed.
+func contentRangeStart(v string) int64 {
+	var start, end int64
+	if _, err := fmt.Sscanf(v, "bytes %d-%d/", &start, &end); err != nil {
+		return -1
+	}
+	return start
+}
@@ -0,0 +1,131 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadURL_Retry(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	var requests atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky.txt":
+			if requests.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(testContent))
+		case "/denied.txt":
+			requests.Add(1)
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			requests.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	opts := Options{Client: srv.Client(), Backoff: time.Millisecond}
+
+	var cases = []struct {
+		name     string
+		path     string
+		retries  int
+		err      error
+		requests int32
+	}{
+		{"recovers", "/flaky.txt", 0, nil, 3},
+		{"gives up", "/flaky.txt", 1, ErrTransient, 2},
+		{"no retries", "/flaky.txt", -1, ErrTransient, 1},
+		{"not found", "/missing.txt", 0, ErrNotFound, 1},
+		{"denied", "/denied.txt", 0, ErrUnauthorised, 1},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			opts := opts
+			opts.CacheDir = t.TempDir()
+			opts.Retries = tt.retries
+
+			src, err := url.Parse(srv.URL + tt.path)
+			require.NoError(t, err)
+			path, err := downloadURL(WithOptions(ctx, opts), src, "")
+			assert.EqualValues(t, tt.requests, requests.Load())
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.EqualValues(t, testContent, data)
+		})
+	}
+}
+
+func TestDownloadURL_Resume(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	content := bytes.Repeat([]byte("0123456789"), 1024)
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var requests atomic.Int32
+	var ranges []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		// drop the connection halfway
+		// through the first response
+		if requests.Add(1) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "test.txt", modTime, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	src, err := url.Parse(srv.URL + "/test.txt")
+	require.NoError(t, err)
+	path, err := downloadURL(WithOptions(ctx, Options{CacheDir: t.TempDir(), Client: srv.Client(), Backoff: time.Millisecond}), src, "")
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// the second request should only
+	// ask for the rest of the file
+	require.Len(t, ranges, 2)
+	assert.Empty(t, ranges[0])
+	assert.Equal(t, "bytes="+strconv.Itoa(len(content)/2)+"-", ranges[1])
+}
+
+func TestOptions_GetBackoff(t *testing.T) {
+	opts := Options{Backoff: time.Second}
+	assert.Equal(t, time.Second, opts.GetBackoff(0))
+	assert.Equal(t, 4*time.Second, opts.GetBackoff(2))
+	assert.Equal(t, maxBackoff, opts.GetBackoff(10))
+}
+
+func TestContentRangeStart(t *testing.T) {
+	assert.EqualValues(t, 100, contentRangeStart("bytes 100-199/200"))
+	assert.EqualValues(t, 0, contentRangeStart("bytes 0-10/*"))
+	assert.EqualValues(t, -1, contentRangeStart("items 0-10/20"))
+}
@@ -3,6 +3,8 @@ package fetch
 import (
 	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -11,30 +13,169 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/carlmjohnson/requests"
+	"github.com/Snakdy/container-build-engine/pkg/containers/cache"
 	"github.com/go-logr/logr"
 )
 
+// URL downloads the file into the download cache and
+// returns its path. The checksum in the url query (if any)
+// is used to verify the file.
+//
+// The returned file is shared between builds,
+// so it must not be modified.
 func URL(ctx context.Context, src *url.URL) (string, error) {
-	log := logr.FromContextOrDiscard(ctx)
+	return downloadURL(ctx, src, src.Query().Get("checksum"))
+}
+
+// downloadURL returns the path of the file in the download
+// cache, downloading it if we don't have a copy.
+//
+// Files with a checksum never change, so they're only
+// downloaded once. Files without one are revalidated using
+// their ETag or Last-Modified headers.
+//
+// Transient failures are retried according to the Options,
+// and the error is wrapped with one of the sentinel errors
+// (e.g., ErrNotFound) so that callers can tell what went wrong.
+func downloadURL(ctx context.Context, src *url.URL, checksum string) (string, error) {
+	opts := OptionsFromContext(ctx)
+	uri := fmt.Sprintf("%s://%s%s", src.Scheme, src.Host, src.EscapedPath())
+	log := logr.FromContextOrDiscard(ctx).WithValues("src", uri)
+
+	if src.Scheme == "http" && !opts.Host(src).AllowHTTP {
+		return "", fmt.Errorf("%w: %s must allow HTTP to download %s", ErrInsecure, src.Host, uri)
+	}
 
-	tmp, err := os.MkdirTemp("", "temp-download-*")
+	if checksum != "" {
+		if _, _, err := parseChecksum(checksum); err != nil {
+			return "", err
+		}
+	}
+
+	dir := opts.GetCacheDir()
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", fmt.Errorf("preparing download cache: %w", err)
+	}
+	key := downloadKey(uri, checksum)
+	// keep the original name so that we
+	// can tell what type of archive it is
+	name := path.Base(src.Path)
+	if name == "." || name == "/" {
+		name = "download"
+	}
+	dst := filepath.Join(dir, key, name)
+
+	// serialise builds that download the same
+	// file so that they don't replace it while
+	// the other is reading it
+	unlock, err := cache.Lock(dir, key)
 	if err != nil {
-		return "", fmt.Errorf("creating temp dir: %w", err)
+		return "", fmt.Errorf("locking download cache: %w", err)
+	}
+	defer unlock()
+
+	cached, err := readDownload(dir, key)
+	if err == nil {
+		if err := verifyDownload(dst, cached); err != nil {
+			log.V(3).Info("removing corrupt download", "error", err)
+			removeDownload(dir, key)
+			cached = nil
+		}
+	}
+	if cached != nil {
+		switch {
+		case checksum != "":
+			log.V(4).Info("using cached download", "dst", dst)
+			touchDownload(dir, key)
+			return dst, nil
+		case opts.Offline:
+			log.V(4).Info("using cached download without revalidating it since we're offline", "dst", dst)
+			touchDownload(dir, key)
+			return dst, nil
+		}
+	}
+	if opts.Offline {
+		return "", fmt.Errorf("%w: %s has not been downloaded", ErrOffline, uri)
 	}
-	dst := filepath.Join(tmp, path.Base(src.Path))
 
-	log.V(6).Info("downloading file", "src", src, "dst", dst)
+	log.V(6).Info("downloading file", "dst", dst)
 
-	uri := fmt.Sprintf("%s://%s%s", src.Scheme, src.Host, src.EscapedPath())
-	err = requests.URL(uri).
-		Headers(ambientCredentials(uri)).
-		ToFile(dst).
-		Fetch(ctx)
+	f, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return "", fmt.Errorf("creating temp file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	client, err := opts.client(src)
+	if err != nil {
+		return "", fmt.Errorf("configuring client for %s: %w", src.Host, err)
+	}
+	headers, err := credentials(ctx, opts, src, uri)
 	if err != nil {
-		_ = os.Remove(dst)
+		return "", fmt.Errorf("getting credentials for %s: %w", src.Host, err)
+	}
+	client = withoutRedirectedCredentials(client, src.Host, headers)
+	t := &transfer{uri: uri, client: client, headers: headers, f: f, h: sha256.New(), cached: cached}
+	if err := t.run(ctx, opts); err != nil {
 		return "", fmt.Errorf("downloading file: %w", err)
 	}
+	if t.notModified && cached == nil {
+		return "", fmt.Errorf("downloading file: unexpected status %d", http.StatusNotModified)
+	}
+	if t.notModified {
+		log.V(4).Info("cached download has not been modified", "dst", dst)
+		touchDownload(dir, key)
+		return dst, nil
+	}
+	if err := f.Sync(); err != nil {
+		return "", fmt.Errorf("syncing file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("closing file: %w", err)
+	}
+	d := &download{
+		URL:          uri,
+		Checksum:     checksum,
+		ETag:         t.etag,
+		LastModified: t.lastModified,
+		Digest:       hex.EncodeToString(t.h.Sum(nil)),
+		Size:         t.written,
+	}
+
+	// don't cache files that don't match
+	if checksum != "" {
+		log.V(3).Info("verifying checksum", "checksum", checksum)
+		if err := checksumFile(f.Name(), checksum); err != nil {
+			return "", err
+		}
+	}
+
+	// the server may have sent the same file with a
+	// new ETag, in which case we keep the existing file
+	// so that anyone reading it isn't disturbed
+	if cached != nil && cached.Digest == d.Digest && cached.Size == d.Size {
+		log.V(4).Info("cached download has not changed", "dst", dst)
+		if err := writeDownload(dir, key, d); err != nil {
+			return "", fmt.Errorf("writing metadata: %w", err)
+		}
+		return dst, nil
+	}
+
+	// the metadata is written first and the file is
+	// renamed over the old one, so that it's never
+	// missing or visible without its metadata
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return "", fmt.Errorf("preparing download cache: %w", err)
+	}
+	if err := writeDownload(dir, key, d); err != nil {
+		return "", fmt.Errorf("writing metadata: %w", err)
+	}
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return "", fmt.Errorf("moving file into cache: %w", err)
+	}
 	return dst, nil
 }
 
@@ -0,0 +1,209 @@
+package files
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	fullfs "chainguard.dev/apko/pkg/apk/fs"
+)
+
+// XattrCapability is the extended attribute that
+// the kernel reads file capabilities from.
+const XattrCapability = "security.capability"
+
+const (
+	vfsCapRevision2     = 0x02000000
+	vfsCapFlagEffective = 0x000001
+)
+
+// capabilities maps the names used by setcap(8) to the
+// capability number. The order must match linux/capability.h.
+var capabilities = []string{
+	"cap_chown",
+	"cap_dac_override",
+	"cap_dac_read_search",
+	"cap_fowner",
+	"cap_fsetid",
+	"cap_kill",
+	"cap_setgid",
+	"cap_setuid",
+	"cap_setpcap",
+	"cap_linux_immutable",
+	"cap_net_bind_service",
+	"cap_net_broadcast",
+	"cap_net_admin",
+	"cap_net_raw",
+	"cap_ipc_lock",
+	"cap_ipc_owner",
+	"cap_sys_module",
+	"cap_sys_rawio",
+	"cap_sys_chroot",
+	"cap_sys_ptrace",
+	"cap_sys_pacct",
+	"cap_sys_admin",
+	"cap_sys_boot",
+	"cap_sys_nice",
+	"cap_sys_resource",
+	"cap_sys_time",
+	"cap_sys_tty_config",
+	"cap_mknod",
+	"cap_lease",
+	"cap_audit_write",
+	"cap_audit_control",
+	"cap_setfcap",
+	"cap_mac_override",
+	"cap_mac_admin",
+	"cap_syslog",
+	"cap_wake_alarm",
+	"cap_block_suspend",
+	"cap_audit_read",
+	"cap_perfmon",
+	"cap_bpf",
+	"cap_checkpoint_restore",
+}
+
+// Capabilities is the parsed form of a file capability set.
+type Capabilities struct {
+	Effective   bool
+	Permitted   uint64
+	Inheritable uint64
+}
+
+// ParseCapabilities parses the textual representation used by
+// setcap(8), for example "cap_net_bind_service=+ep" or
+// "cap_chown,cap_fowner+ep cap_kill+i".
+//
+// See cap_from_text(3) for more information.
+func ParseCapabilities(s string) (*Capabilities, error) {
+	caps := &Capabilities{}
+	var effective uint64
+
+	clauses := strings.Fields(s)
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("no capabilities provided")
+	}
+	for _, clause := range clauses {
+		i := strings.IndexAny(clause, "=+-")
+		if i < 0 {
+			return nil, fmt.Errorf("capability clause is missing an operator: %q", clause)
+		}
+		var mask uint64
+		// "=ep" is shorthand for "all=ep"
+		if i == 0 {
+			mask = allCapabilities()
+		}
+		if i > 0 {
+			for _, name := range strings.Split(clause[:i], ",") {
+				if name == "all" {
+					mask |= allCapabilities()
+					continue
+				}
+				n, err := capabilityNumber(name)
+				if err != nil {
+					return nil, err
+				}
+				mask |= 1 << n
+			}
+		}
+
+		// read each operator and its flags,
+		// e.g. "=p+e"
+		ops := clause[i:]
+		for len(ops) > 0 {
+			op := ops[0]
+			j := strings.IndexAny(ops[1:], "=+-")
+			if j < 0 {
+				j = len(ops) - 1
+			}
+			flags := ops[1 : j+1]
+			ops = ops[j+1:]
+
+			if op == '=' {
+				caps.Permitted &^= mask
+				caps.Inheritable &^= mask
+				effective &^= mask
+			}
+			for _, f := range flags {
+				var target *uint64
+				switch f {
+				case 'e':
+					target = &effective
+				case 'p':
+					target = &caps.Permitted
+				case 'i':
+					target = &caps.Inheritable
+				default:
+					return nil, fmt.Errorf("unknown capability flag %q in %q", f, clause)
+				}
+				if op == '-' {
+					*target &^= mask
+				} else {
+					*target |= mask
+				}
+			}
+		}
+	}
+	// file capabilities only have a single effective
+	// bit, so any effective capability must also be
+	// permitted or inheritable.
+	if effective != 0 {
+		if effective&^(caps.Permitted|caps.Inheritable) != 0 {
+			return nil, fmt.Errorf("effective capabilities must also be permitted or inheritable: %q", s)
+		}
+		caps.Effective = true
+	}
+	return caps, nil
+}
+
+// Marshal encodes the capabilities in the VFS_CAP_REVISION_2
+// format used by the security.capability extended attribute.
+func (c *Capabilities) Marshal() []byte {
+	magic := uint32(vfsCapRevision2)
+	if c.Effective {
+		magic |= vfsCapFlagEffective
+	}
+	data := make([]byte, 20)
+	binary.LittleEndian.PutUint32(data[0:], magic)
+	binary.LittleEndian.PutUint32(data[4:], uint32(c.Permitted))
+	binary.LittleEndian.PutUint32(data[8:], uint32(c.Inheritable))
+	binary.LittleEndian.PutUint32(data[12:], uint32(c.Permitted>>32))
+	binary.LittleEndian.PutUint32(data[16:], uint32(c.Inheritable>>32))
+	return data
+}
+
+// SetCapabilities parses the given setcap(8) style capabilities
+// and writes them to the file.
+func SetCapabilities(rootfs fullfs.FullFS, path, s string) error {
+	caps, err := ParseCapabilities(s)
+	if err != nil {
+		return err
+	}
+	if err := rootfs.SetXattr(path, XattrCapability, caps.Marshal()); err != nil {
+		return fmt.Errorf("setting capabilities on %s: %w", path, err)
+	}
+	return nil
+}
+
+func capabilityNumber(name string) (int, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "cap_") {
+		name = "cap_" + name
+	}
+	for i, c := range capabilities {
+		if c == name {
+			return i, nil
+		}
+	}
+	// allow capabilities that we don't
+	// know the name of yet, e.g. "cap_41"
+	if n, err := strconv.Atoi(strings.TrimPrefix(name, "cap_")); err == nil && n >= 0 && n < 64 {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown capability: %s", name)
+}
+
+func allCapabilities() uint64 {
+	return 1<<len(capabilities) - 1
+}
@@ -0,0 +1,66 @@
+package files
+
+import (
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	var cases = []struct {
+		in          string
+		effective   bool
+		permitted   uint64
+		inheritable uint64
+	}{
+		{"cap_net_bind_service=+ep", true, 1 << 10, 0},
+		{"cap_net_bind_service+ep", true, 1 << 10, 0},
+		{"CAP_NET_RAW,cap_net_admin=p", false, 1<<13 | 1<<12, 0},
+		{"cap_chown+p cap_kill+i", false, 1 << 0, 1 << 5},
+		{"cap_chown,cap_kill=ep cap_kill-ep", true, 1 << 0, 0},
+		{"cap_bpf=ip", false, 1 << 39, 1 << 39},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			caps, err := ParseCapabilities(tt.in)
+			require.NoError(t, err)
+			assert.EqualValues(t, tt.effective, caps.Effective)
+			assert.EqualValues(t, tt.permitted, caps.Permitted)
+			assert.EqualValues(t, tt.inheritable, caps.Inheritable)
+		})
+	}
+
+	for _, in := range []string{"", "cap_net_bind_service", "cap_foo=ep", "cap_chown=x", "cap_chown=e"} {
+		t.Run("invalid "+in, func(t *testing.T) {
+			_, err := ParseCapabilities(in)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCapabilities_Marshal(t *testing.T) {
+	caps, err := ParseCapabilities("cap_net_bind_service=+ep")
+	require.NoError(t, err)
+	// matches the output of "getfattr -n security.capability"
+	// after "setcap cap_net_bind_service=+ep"
+	assert.EqualValues(t, []byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x04, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}, caps.Marshal())
+}
+
+func TestSetCapabilities(t *testing.T) {
+	rootfs := fs.NewMemFS()
+	require.NoError(t, rootfs.WriteFile("/server", []byte("#!/bin/sh"), 0755))
+
+	require.NoError(t, SetCapabilities(rootfs, "/server", "cap_net_bind_service=+ep"))
+
+	data, err := rootfs.GetXattr("/server", XattrCapability)
+	require.NoError(t, err)
+	assert.Len(t, data, 20)
+}
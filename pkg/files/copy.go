@@ -110,10 +110,6 @@ func Copy(ctx context.Context, srcFile, dstFile string, dstFS fs.FullFS) error {
 	if err := dstFS.Chmod(dstFile, info.Mode()); err != nil {
 		return fmt.Errorf("chmoding file: %w", err)
 	}
-	if err := dstFS.Chown(dstFile, 1001, 0); err != nil {
-		return fmt.Errorf("chowning file: %w", err)
-	}
-
 	return nil
 }
 
@@ -0,0 +1,54 @@
+package files
+
+import "io/fs"
+
+// File type bits as used by mknod(2). These are defined
+// here rather than using the unix package so that they're
+// available on every platform.
+const (
+	ModeTypeMask = 0o170000
+	ModeFifo     = 0o010000
+	ModeChar     = 0o020000
+	ModeBlock    = 0o060000
+)
+
+// FileMode converts a mode as used by mknod(2)
+// into an fs.FileMode.
+func FileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode) & fs.ModePerm
+	switch mode & ModeTypeMask {
+	case ModeFifo:
+		m |= fs.ModeNamedPipe
+	case ModeChar:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case ModeBlock:
+		m |= fs.ModeDevice
+	}
+	return m
+}
+
+// Mkdev returns a Linux device number generated
+// from the major and minor numbers.
+func Mkdev(major, minor uint32) int {
+	dev := (uint64(major) & 0x00000fff) << 8
+	dev |= (uint64(major) & 0xfffff000) << 32
+	dev |= (uint64(minor) & 0x000000ff) << 0
+	dev |= (uint64(minor) & 0xffffff00) << 12
+	return int(dev)
+}
+
+// Major returns the major component
+// of a Linux device number.
+func Major(dev int) uint32 {
+	major := uint32((uint64(dev) & 0x00000000000fff00) >> 8)
+	major |= uint32((uint64(dev) & 0xfffff00000000000) >> 32)
+	return major
+}
+
+// Minor returns the minor component
+// of a Linux device number.
+func Minor(dev int) uint32 {
+	minor := uint32((uint64(dev) & 0x00000000000000ff) >> 0)
+	minor |= uint32((uint64(dev) & 0x00000ffffff00000) >> 12)
+	return minor
+}
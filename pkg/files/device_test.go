@@ -0,0 +1,34 @@
+package files
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMkdev(t *testing.T) {
+	var cases = []struct {
+		major uint32
+		minor uint32
+		dev   int
+	}{
+		{1, 3, 0x103},
+		{8, 0, 0x800},
+		{4095, 255, 0xfffff},
+		{4096, 256, 0x100000100000},
+	}
+	for _, tt := range cases {
+		dev := Mkdev(tt.major, tt.minor)
+		assert.EqualValues(t, tt.dev, dev)
+		assert.EqualValues(t, tt.major, Major(dev))
+		assert.EqualValues(t, tt.minor, Minor(dev))
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	assert.EqualValues(t, fs.ModeNamedPipe|0644, FileMode(ModeFifo|0644))
+	assert.EqualValues(t, fs.ModeDevice|fs.ModeCharDevice|0666, FileMode(ModeChar|0666))
+	assert.EqualValues(t, fs.ModeDevice|0660, FileMode(ModeBlock|0660))
+	assert.EqualValues(t, 0644, FileMode(0644))
+}
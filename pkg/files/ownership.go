@@ -0,0 +1,73 @@
+package files
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	iofs "io/fs"
+
+	"chainguard.dev/apko/pkg/apk/fs"
+	"github.com/go-logr/logr"
+)
+
+// Ownership describes the owner, group and permissions
+// that should be applied to a file. Nil values are left
+// unchanged.
+type Ownership struct {
+	Uid  *int
+	Gid  *int
+	Mode *iofs.FileMode
+}
+
+// IsZero returns true if the Ownership
+// wouldn't change anything.
+func (o Ownership) IsZero() bool {
+	return o.Uid == nil && o.Gid == nil && o.Mode == nil
+}
+
+// ApplyOwnership recursively applies the Ownership to the given
+// path. The mode is only applied to files, since applying file
+// permissions to directories would make them unreadable.
+// Symbolic links are skipped.
+func ApplyOwnership(ctx context.Context, rootfs fs.FullFS, root string, o Ownership) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("root", root)
+	if o.IsZero() {
+		return nil
+	}
+	log.V(6).Info("applying ownership")
+	return iofs.WalkDir(rootfs, root, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := rootfs.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&iofs.ModeSymlink != 0 {
+			return nil
+		}
+		if o.Uid != nil || o.Gid != nil {
+			uid, gid := 0, 0
+			if h, ok := info.Sys().(*tar.Header); ok {
+				uid, gid = h.Uid, h.Gid
+			}
+			if o.Uid != nil {
+				uid = *o.Uid
+			}
+			if o.Gid != nil {
+				gid = *o.Gid
+			}
+			log.V(7).Info("chowning file", "path", path, "uid", uid, "gid", gid)
+			if err := rootfs.Chown(path, uid, gid); err != nil {
+				return fmt.Errorf("chowning file: %w", err)
+			}
+		}
+		if o.Mode != nil && !d.IsDir() {
+			log.V(7).Info("chmoding file", "path", path, "mode", *o.Mode)
+			if err := rootfs.Chmod(path, *o.Mode); err != nil {
+				return fmt.Errorf("chmoding file: %w", err)
+			}
+		}
+		return nil
+	})
+}
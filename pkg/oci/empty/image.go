@@ -18,12 +18,18 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 // Image is a singleton empty image, think: FROM scratch.
-var Image, _ = partial.UncompressedToImage(emptyImage{})
+var Image = newImage()
+
+func newImage() v1.Image {
+	img, _ := partial.UncompressedToImage(emptyImage{})
+	return mutate.ConfigMediaType(img, types.OCIConfigJSON)
+}
 
 type emptyImage struct{}
 
@@ -0,0 +1,10 @@
+package empty
+
+import (
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Index is a singleton empty OCI image index.
+var Index = mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
@@ -18,6 +18,12 @@ import (
 // 1. "src": where to retrieve the directory from
 //
 // 2. "dst": where to place the directory in the container
+//
+// 3. "ignore": names of files or directories to skip
+//
+// 4. "owner", "group": numerical uid and gid to assign to everything that is copied
+//
+// 5. "mode": permissions to assign to the copied files (e.g. "0644"). Directories are unchanged
 type Dir struct {
 	options cbev1.Options
 }
@@ -40,6 +46,10 @@ func (s *Dir) Run(ctx *BuildContext, runtimeOptions ...cbev1.Options) (cbev1.Opt
 	if err != nil && !errors.Is(err, cbev1.ErrNoValue) {
 		return cbev1.Options{}, err
 	}
+	ownership, err := getOwnership(options)
+	if err != nil {
+		return cbev1.Options{}, err
+	}
 
 	// expand paths
 	src = filepath.Clean(envs.ExpandEnvFunc(src, ExpandList(ctx.ConfigFile.Config.Env)))
@@ -55,6 +65,10 @@ func (s *Dir) Run(ctx *BuildContext, runtimeOptions ...cbev1.Options) (cbev1.Opt
 		log.Error(err, "failed to copy directory", "src", src, "dst", dst)
 		return cbev1.Options{}, err
 	}
+	if err := files.ApplyOwnership(ctx.Context, ctx.FS, dst, ownership); err != nil {
+		log.Error(err, "failed to set ownership", "dst", dst)
+		return cbev1.Options{}, err
+	}
 
 	return cbev1.Options{}, nil
 }
@@ -1,11 +1,13 @@
 package pipelines
 
 import (
+	"archive/tar"
 	"context"
 	"os"
 	"testing"
 
 	"chainguard.dev/apko/pkg/apk/fs"
+	cbev1 "github.com/Snakdy/container-build-engine/pkg/api/v1"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/logr/testr"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -86,3 +88,68 @@ func TestDir_RunIgnore(t *testing.T) {
 	_, err = rootfs.Stat("/tmp/testdata/config-file")
 	assert.ErrorIs(t, err, os.ErrNotExist)
 }
+
+func TestDir_RunOwnership(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	rootfs := fs.NewMemFS()
+	s := &Dir{options: map[string]any{
+		"src":   "testdata",
+		"dst":   "/tmp/",
+		"owner": float64(1001),
+		"group": "1002",
+		"mode":  "0600",
+	}}
+	_, err = s.Run(&BuildContext{
+		WorkingDirectory: wd,
+		Context:          ctx,
+		FS:               rootfs,
+		ConfigFile: &v1.ConfigFile{
+			Config: v1.Config{},
+		},
+	})
+	require.NoError(t, err)
+
+	info, err := rootfs.Stat("/tmp/testdata/text.txt")
+	require.NoError(t, err)
+	assert.EqualValues(t, 0600, info.Mode().Perm())
+	header := info.Sys().(*tar.Header)
+	assert.EqualValues(t, 1001, header.Uid)
+	assert.EqualValues(t, 1002, header.Gid)
+
+	// directories should keep their mode
+	info, err = rootfs.Stat("/tmp/testdata")
+	require.NoError(t, err)
+	assert.EqualValues(t, 0755, info.Mode().Perm())
+}
+
+func TestGetOwnership(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		o, err := getOwnership(cbev1.OptionsList{{}})
+		require.NoError(t, err)
+		assert.True(t, o.IsZero())
+	})
+	t.Run("numbers", func(t *testing.T) {
+		o, err := getOwnership(cbev1.OptionsList{{"owner": 1001, "mode": "0755"}})
+		require.NoError(t, err)
+		assert.EqualValues(t, 1001, *o.Uid)
+		assert.Nil(t, o.Gid)
+		assert.EqualValues(t, 0755, *o.Mode)
+	})
+	t.Run("unquoted mode", func(t *testing.T) {
+		_, err := getOwnership(cbev1.OptionsList{{"mode": 644}})
+		assert.ErrorIs(t, err, cbev1.ErrWrongType)
+		_, err = getOwnership(cbev1.OptionsList{{"mode": float64(644)}})
+		assert.ErrorIs(t, err, cbev1.ErrWrongType)
+	})
+	t.Run("invalid mode", func(t *testing.T) {
+		_, err := getOwnership(cbev1.OptionsList{{"mode": "rwxr-xr-x"}})
+		assert.ErrorIs(t, err, cbev1.ErrWrongType)
+	})
+	t.Run("negative owner", func(t *testing.T) {
+		_, err := getOwnership(cbev1.OptionsList{{"owner": -1}})
+		assert.ErrorIs(t, err, cbev1.ErrWrongType)
+	})
+}
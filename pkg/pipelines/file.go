@@ -1,6 +1,8 @@
 package pipelines
 
 import (
+	"errors"
+	"maps"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,21 +20,36 @@ import (
 //
 // 1. "path": where to place the file in the container
 //
-// 2. "uri": URI indicating where to get the file from. Supports https:// and file:// schemes and will
-// default to file:// if none is provided.
+// 2. "uri": URI indicating where to get the file from. Supports https://, http:// (for hosts that allow it)
+// and file:// schemes and will default to file:// if none is provided. Downloaded files are cached
+// (see fetch.URL).
 //
 // 3. "executable": make the file executable
 //
 // 4. "sub-path": if the file is an archive, extract a file from it
 //
-// 5. "checksum": hash of the file for checksum validation
+// 5. "checksum": hash of the file for checksum validation (e.g. "sha512:..."). Supports sha256 (the default
+// if there's no prefix), sha512, sha384 and sha1.
+//
+// 6. "checksum-url": URI of a checksums file (e.g. "SHA256SUMS") containing the checksum of the file.
+// Ignored if "checksum" is set.
+//
+// 7. "signature": URI of a detached signature that the file must match before it's extracted
+//
+// 8. "public-key": URI of the public key (or OpenPGP keyring) used to verify the "signature"
+//
+// 9. "signature-type": "pgp", "minisign" or "cosign". Detected from the public key if not set.
+//
+// 10. "owner", "group": numerical uid and gid to assign to the file
+//
+// 11. "mode": permissions to assign to the file (e.g. "0644")
 type File struct {
 	options cbev1.Options
 }
 
 func (s *File) Run(ctx *BuildContext, _ ...cbev1.Options) (cbev1.Options, error) {
 	log := logr.FromContextOrDiscard(ctx.Context)
-	log.V(7).Info("running statement", "options", s.options)
+	log.V(7).Info("running statement", "options", redactOptions(s.options))
 
 	rawPath, err := cbev1.GetRequired[string](s.options, "path")
 	if err != nil {
@@ -54,6 +71,18 @@ func (s *File) Run(ctx *BuildContext, _ ...cbev1.Options) (cbev1.Options, error)
 	if err != nil {
 		return cbev1.Options{}, err
 	}
+	checksumUrl, err := cbev1.GetOptional[string](s.options, "checksum-url")
+	if err != nil {
+		return cbev1.Options{}, err
+	}
+	signature, err := getSignature(s.options)
+	if err != nil {
+		return cbev1.Options{}, err
+	}
+	ownership, err := getOwnership(cbev1.OptionsList{s.options})
+	if err != nil {
+		return cbev1.Options{}, err
+	}
 
 	// expand paths using environment variables
 	path := filepath.Clean(envs.ExpandEnvFunc(rawPath, ExpandList(ctx.ConfigFile.Config.Env)))
@@ -64,11 +93,23 @@ func (s *File) Run(ctx *BuildContext, _ ...cbev1.Options) (cbev1.Options, error)
 	}
 	srcUri := envs.ExpandEnv(fileUri)
 
-	log.V(2).Info("retrieving file", "file", srcUri, "path", dst)
+	if checksum == "" && checksumUrl != "" {
+		checksum, err = fetch.LookupChecksum(ctx.Context, envs.ExpandEnv(checksumUrl), srcUri)
+		if err != nil {
+			log.Error(err, "failed to find checksum", "src", fetch.Redact(srcUri))
+			return cbev1.Options{}, err
+		}
+	}
+
+	log.V(2).Info("retrieving file", "file", fetch.Redact(srcUri), "path", dst)
 
-	dst, err = fetch.Fetch(ctx.Context, srcUri, dst, checksum)
+	var signatures []fetch.Signature
+	if signature != nil {
+		signatures = append(signatures, *signature)
+	}
+	dst, err = fetch.Fetch(ctx.Context, srcUri, dst, checksum, signatures...)
 	if err != nil {
-		log.Error(err, "failed to retrieve file", "src", srcUri, "dst", dst)
+		log.Error(err, "failed to retrieve file", "src", fetch.Redact(srcUri), "dst", dst)
 		return cbev1.Options{}, err
 	}
 	copySrc := dst
@@ -115,9 +156,56 @@ func (s *File) Run(ctx *BuildContext, _ ...cbev1.Options) (cbev1.Options, error)
 		log.Error(err, "failed to copy directory", "src", copySrc, "dst", path)
 		return cbev1.Options{}, err
 	}
+	if err := files.ApplyOwnership(ctx.Context, ctx.FS, path, ownership); err != nil {
+		log.Error(err, "failed to set ownership", "dst", path)
+		return cbev1.Options{}, err
+	}
 	return cbev1.Options{}, nil
 }
 
+// getSignature reads the signature options (if any).
+func getSignature(options cbev1.Options) (*fetch.Signature, error) {
+	uri, err := cbev1.GetOptional[string](options, "signature")
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := cbev1.GetOptional[string](options, "public-key")
+	if err != nil {
+		return nil, err
+	}
+	rawType, err := cbev1.GetOptional[string](options, "signature-type")
+	if err != nil {
+		return nil, err
+	}
+	if uri == "" && publicKey == "" {
+		return nil, nil
+	}
+	if uri == "" || publicKey == "" {
+		return nil, errors.New("signature and public-key must be used together")
+	}
+	signatureType, err := fetch.ParseSignatureType(rawType)
+	if err != nil {
+		return nil, err
+	}
+	return &fetch.Signature{
+		URI:       envs.ExpandEnv(uri),
+		PublicKey: envs.ExpandEnv(publicKey),
+		Type:      signatureType,
+	}, nil
+}
+
+// redactOptions removes credentials from the uris
+// so that the options can be logged.
+func redactOptions(options cbev1.Options) cbev1.Options {
+	out := maps.Clone(options)
+	for _, k := range []string{"uri", "checksum-url", "signature", "public-key"} {
+		if uri, ok := options[k].(string); ok {
+			out[k] = fetch.Redact(uri)
+		}
+	}
+	return out
+}
+
 func ExpandList(vs []string) func(s string) string {
 	return func(s string) string {
 		for _, e := range vs {
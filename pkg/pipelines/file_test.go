@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"chainguard.dev/apko/pkg/apk/fs"
+	"github.com/Snakdy/container-build-engine/pkg/fetch"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/logr/testr"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -188,3 +189,32 @@ func TestFile_Run(t *testing.T) {
 		})
 	}
 }
+
+func TestGetSignature(t *testing.T) {
+	t.Run("not set", func(t *testing.T) {
+		sig, err := getSignature(map[string]any{"uri": "testdata/text.txt"})
+		require.NoError(t, err)
+		assert.Nil(t, sig)
+	})
+	t.Run("detected type", func(t *testing.T) {
+		t.Setenv("VERSION", "1.0.0")
+		sig, err := getSignature(map[string]any{
+			"signature":  "https://example.com/${VERSION}/file.tar.gz.asc",
+			"public-key": "file://keys.asc",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, &fetch.Signature{URI: "https://example.com/1.0.0/file.tar.gz.asc", PublicKey: "file://keys.asc"}, sig)
+	})
+	t.Run("missing public key", func(t *testing.T) {
+		_, err := getSignature(map[string]any{"signature": "https://example.com/file.tar.gz.minisig"})
+		assert.Error(t, err)
+	})
+	t.Run("unsupported type", func(t *testing.T) {
+		_, err := getSignature(map[string]any{
+			"signature":      "https://example.com/file.tar.gz.sig",
+			"public-key":     "file://cosign.pub",
+			"signature-type": "x509",
+		})
+		assert.Error(t, err)
+	})
+}
@@ -17,6 +17,8 @@ func Find(name string, options cbev1.Options) PipelineStatement {
 		s = &Dir{}
 	case StatementScript:
 		s = &Script{}
+	case StatementSetCap:
+		s = &SetCap{}
 	default:
 		return nil
 	}
@@ -0,0 +1,76 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+
+	cbev1 "github.com/Snakdy/container-build-engine/pkg/api/v1"
+	"github.com/Snakdy/container-build-engine/pkg/files"
+)
+
+// getOwnership reads the optional "owner", "group"
+// and "mode" options that are shared by statements
+// which add files.
+func getOwnership(options cbev1.OptionsList) (files.Ownership, error) {
+	var o files.Ownership
+
+	uid, err := getNumber(options, "owner", 10)
+	if err != nil {
+		return o, err
+	}
+	o.Uid = uid
+	gid, err := getNumber(options, "group", 10)
+	if err != nil {
+		return o, err
+	}
+	o.Gid = gid
+	mode, err := getNumber(options, "mode", 8)
+	if err != nil {
+		return o, err
+	}
+	if mode != nil {
+		m := fs.FileMode(*mode) & fs.ModePerm
+		o.Mode = &m
+	}
+	return o, nil
+}
+
+// getNumber retrieves an optional number. Numbers may be provided
+// as strings (e.g. mode: "0755") in the given base, or as numbers.
+// Numbers in any base other than 10 must be strings, since YAML
+// reads an unquoted 644 as a decimal number.
+func getNumber(options cbev1.OptionsList, key string, base int) (*int, error) {
+	val, err := cbev1.GetAny[any](options, key)
+	if err != nil {
+		if errors.Is(err, cbev1.ErrNoValue) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if _, ok := val.(string); !ok && base != 10 {
+		return nil, fmt.Errorf("%w: '%s' must be quoted (e.g. %s: \"0644\")", cbev1.ErrWrongType, key, key)
+	}
+	var n int
+	switch v := val.(type) {
+	case int:
+		n = v
+	case int64:
+		n = int(v)
+	case float64:
+		n = int(v)
+	case string:
+		i, err := strconv.ParseInt(v, base, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: '%s' is not a valid number: %w", cbev1.ErrWrongType, key, err)
+		}
+		n = int(i)
+	default:
+		return nil, fmt.Errorf("%w: '%s' is not a '%T'", cbev1.ErrWrongType, key, val)
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("%w: '%s' must not be negative", cbev1.ErrWrongType, key)
+	}
+	return &n, nil
+}
@@ -0,0 +1,50 @@
+package pipelines
+
+import (
+	"fmt"
+	"path/filepath"
+
+	cbev1 "github.com/Snakdy/container-build-engine/pkg/api/v1"
+	"github.com/Snakdy/container-build-engine/pkg/envs"
+	"github.com/Snakdy/container-build-engine/pkg/files"
+	"github.com/Snakdy/container-build-engine/pkg/pipelines/utils"
+	"github.com/go-logr/logr"
+)
+
+// SetCap sets file capabilities in the same way as setcap(8).
+// Options should be a key-value map where the key is the path
+// to the file and the value is the capabilities to set
+// (e.g. "cap_net_bind_service=+ep").
+type SetCap struct {
+	options cbev1.Options
+}
+
+func (s *SetCap) Run(ctx *BuildContext, _ ...cbev1.Options) (cbev1.Options, error) {
+	log := logr.FromContextOrDiscard(ctx.Context)
+
+	for k, v := range s.options {
+		caps, ok := v.(string)
+		if !ok {
+			return cbev1.Options{}, fmt.Errorf("%w: '%s' is not a '%T'", cbev1.ErrWrongType, k, v)
+		}
+		path := filepath.Clean(envs.ExpandEnvFunc(k, ExpandList(ctx.ConfigFile.Config.Env)))
+
+		log.V(5).Info("setting capabilities", "path", path, "caps", caps)
+		if err := files.SetCapabilities(ctx.FS, path, caps); err != nil {
+			log.Error(err, "failed to set capabilities", "path", path, "caps", caps)
+			return cbev1.Options{}, err
+		}
+	}
+	return cbev1.Options{}, nil
+}
+
+func (*SetCap) Name() string {
+	return StatementSetCap
+}
+
+func (s *SetCap) SetOptions(options cbev1.Options) {
+	if s.options == nil {
+		s.options = map[string]any{}
+	}
+	utils.CopyMap(options, s.options)
+}
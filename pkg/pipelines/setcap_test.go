@@ -0,0 +1,62 @@
+package pipelines
+
+import (
+	"context"
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/fs"
+	cbev1 "github.com/Snakdy/container-build-engine/pkg/api/v1"
+	"github.com/Snakdy/container-build-engine/pkg/files"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// interface guard
+var _ PipelineStatement = &SetCap{}
+
+func TestSetCap_Run(t *testing.T) {
+	ctx := logr.NewContext(context.TODO(), testr.NewWithOptions(t, testr.Options{Verbosity: 10}))
+
+	rootfs := fs.NewMemFS()
+	require.NoError(t, rootfs.MkdirAll("/app", 0755))
+	require.NoError(t, rootfs.WriteFile("/app/server", []byte("#!/bin/sh"), 0755))
+
+	buildContext := &BuildContext{
+		Context: ctx,
+		FS:      rootfs,
+		ConfigFile: &v1.ConfigFile{
+			Config: v1.Config{
+				Env: []string{"APP_DIR=/app"},
+			},
+		},
+	}
+
+	t.Run("valid capabilities", func(t *testing.T) {
+		s := &SetCap{options: map[string]any{
+			"${APP_DIR}/server": "cap_net_bind_service=+ep",
+		}}
+		_, err := s.Run(buildContext)
+		require.NoError(t, err)
+
+		data, err := rootfs.GetXattr("/app/server", files.XattrCapability)
+		require.NoError(t, err)
+		assert.Len(t, data, 20)
+	})
+	t.Run("missing file", func(t *testing.T) {
+		s := &SetCap{options: map[string]any{
+			"/app/missing": "cap_net_bind_service=+ep",
+		}}
+		_, err := s.Run(buildContext)
+		assert.Error(t, err)
+	})
+	t.Run("wrong type", func(t *testing.T) {
+		s := &SetCap{options: map[string]any{
+			"/app/server": 1,
+		}}
+		_, err := s.Run(buildContext)
+		assert.ErrorIs(t, err, cbev1.ErrWrongType)
+	})
+}
@@ -33,4 +33,5 @@ const (
 	StatementEnv          = "env"
 	StatementScript       = "script"
 	StatementDir          = "dir"
+	StatementSetCap       = "setcap"
 )
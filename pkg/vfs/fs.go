@@ -1,7 +1,12 @@
 package vfs
 
 import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+
 	apkfs "chainguard.dev/apko/pkg/apk/fs"
+	"github.com/Snakdy/container-build-engine/pkg/files"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -22,6 +27,15 @@ type VFS struct {
 	permissions map[string]fs.FileMode
 	uid         map[string]int
 	gid         map[string]int
+	// xattrs are kept in memory as setting them on the
+	// underlying filesystem requires privileges
+	// (e.g. security.capability) or may not be supported.
+	xattrs map[string]map[string][]byte
+	// nodes are the FIFOs and devices that have been created.
+	// They're represented on disk by an empty file as creating
+	// them for real requires privileges.
+	nodes map[string]uint32
+	devs  map[string]int
 }
 
 func NewVFS(path string) *VFS {
@@ -30,6 +44,9 @@ func NewVFS(path string) *VFS {
 		permissions: map[string]fs.FileMode{},
 		uid:         map[string]int{},
 		gid:         map[string]int{},
+		xattrs:      map[string]map[string][]byte{},
+		nodes:       map[string]uint32{},
+		devs:        map[string]int{},
 	}
 }
 
@@ -38,12 +55,12 @@ func (V *VFS) Path(path string) string {
 }
 
 func (V *VFS) Mkdir(path string, perm fs.FileMode) error {
-	V.permissions[path] = perm
+	V.permissions[Clean(path)] = perm
 	return os.Mkdir(V.Path(path), DefaultDirectoryPermissions)
 }
 
 func (V *VFS) MkdirAll(path string, perm fs.FileMode) error {
-	V.permissions[path] = perm
+	V.permissions[Clean(path)] = perm
 	return os.MkdirAll(V.Path(path), DefaultDirectoryPermissions)
 }
 
@@ -65,7 +82,7 @@ func (V *VFS) ReadFile(name string) ([]byte, error) {
 }
 
 func (V *VFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
-	V.permissions[name] = mode
+	V.permissions[Clean(name)] = mode
 	return os.WriteFile(V.Path(name), b, DefaultFilePermissions)
 }
 
@@ -74,13 +91,28 @@ func (V *VFS) ReadDir(name string) ([]fs.DirEntry, error) {
 }
 
 func (V *VFS) Mknod(path string, mode uint32, dev int) error {
-	//TODO implement me
-	panic("implement me")
+	f, err := os.OpenFile(V.Path(path), os.O_CREATE|os.O_EXCL|os.O_WRONLY, DefaultFilePermissions)
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	key := Clean(path)
+	V.nodes[key] = mode
+	V.devs[key] = dev
+	V.permissions[key] = files.FileMode(mode).Perm()
+	return nil
 }
 
 func (V *VFS) Readnod(name string) (dev int, err error) {
-	//TODO implement me
-	panic("implement me")
+	if _, err := V.Lstat(name); err != nil {
+		return 0, err
+	}
+	key := Clean(name)
+	mode, ok := V.nodes[key]
+	if !ok || files.FileMode(mode)&fs.ModeDevice == 0 {
+		return 0, fmt.Errorf("not a device")
+	}
+	return V.devs[key], nil
 }
 
 func (V *VFS) Symlink(oldname, newname string) error {
@@ -88,7 +120,25 @@ func (V *VFS) Symlink(oldname, newname string) error {
 }
 
 func (V *VFS) Link(oldname, newname string) error {
-	return os.Link(filepath.Join(V.path, oldname), filepath.Join(V.path, newname))
+	if err := os.Link(filepath.Join(V.path, oldname), filepath.Join(V.path, newname)); err != nil {
+		return err
+	}
+	// hard links share everything
+	// with the original file
+	src, dst := Clean(oldname), Clean(newname)
+	if perm, ok := V.permissions[src]; ok {
+		V.permissions[dst] = perm
+	}
+	if uid, ok := V.uid[src]; ok {
+		V.uid[dst] = uid
+	}
+	if gid, ok := V.gid[src]; ok {
+		V.gid[dst] = gid
+	}
+	if attrs, ok := V.xattrs[src]; ok {
+		V.xattrs[dst] = attrs
+	}
+	return nil
 }
 
 func (V *VFS) Readlink(name string) (target string, err error) {
@@ -96,11 +146,19 @@ func (V *VFS) Readlink(name string) (target string, err error) {
 }
 
 func (V *VFS) Stat(path string) (fs.FileInfo, error) {
-	return os.Stat(V.Path(path))
+	info, err := os.Stat(V.Path(path))
+	if err != nil {
+		return nil, err
+	}
+	return V.fileInfo(path, info), nil
 }
 
 func (V *VFS) Lstat(path string) (fs.FileInfo, error) {
-	return os.Lstat(V.Path(path))
+	info, err := os.Lstat(V.Path(path))
+	if err != nil {
+		return nil, err
+	}
+	return V.fileInfo(path, info), nil
 }
 
 func (V *VFS) Create(name string) (apkfs.File, error) {
@@ -108,40 +166,88 @@ func (V *VFS) Create(name string) (apkfs.File, error) {
 }
 
 func (V *VFS) Remove(name string) error {
-	return os.Remove(V.Path(name))
+	if err := os.Remove(V.Path(name)); err != nil {
+		return err
+	}
+	key := Clean(name)
+	delete(V.permissions, key)
+	delete(V.uid, key)
+	delete(V.gid, key)
+	delete(V.xattrs, key)
+	delete(V.nodes, key)
+	delete(V.devs, key)
+	return nil
+}
+
+// Rename moves the file, along with the
+// attributes that we've recorded for it.
+func (V *VFS) Rename(oldname, newname string) error {
+	if err := os.Rename(V.Path(oldname), V.Path(newname)); err != nil {
+		return err
+	}
+	from, to := Clean(oldname), Clean(newname)
+	moveWithin(V.permissions, from, to)
+	moveWithin(V.uid, from, to)
+	moveWithin(V.gid, from, to)
+	moveWithin(V.xattrs, from, to)
+	moveWithin(V.nodes, from, to)
+	moveWithin(V.devs, from, to)
+	return nil
 }
 
 func (V *VFS) Chmod(path string, perm fs.FileMode) error {
-	V.permissions[path] = perm
+	V.permissions[Clean(path)] = perm
 	//return os.Chmod(V.Path(path), perm)
 	return nil
 }
 
 func (V *VFS) Chown(path string, uid int, gid int) error {
-	V.uid[path] = uid
-	V.gid[path] = gid
+	V.uid[Clean(path)] = uid
+	V.gid[Clean(path)] = gid
 	//return os.Chown(V.Path(path), uid, gid)
 	return nil
 }
 
 func (V *VFS) SetXattr(path string, attr string, data []byte) error {
-	//TODO implement me
-	panic("implement me")
+	if _, err := V.Lstat(path); err != nil {
+		return err
+	}
+	key := Clean(path)
+	if V.xattrs[key] == nil {
+		V.xattrs[key] = map[string][]byte{}
+	}
+	V.xattrs[key][attr] = bytes.Clone(data)
+	return nil
 }
 
 func (V *VFS) GetXattr(path string, attr string) ([]byte, error) {
-	//TODO implement me
-	panic("implement me")
+	if _, err := V.Lstat(path); err != nil {
+		return nil, err
+	}
+	data, ok := V.xattrs[Clean(path)][attr]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return bytes.Clone(data), nil
 }
 
 func (V *VFS) RemoveXattr(path string, attr string) error {
-	//TODO implement me
-	panic("implement me")
+	if _, err := V.Lstat(path); err != nil {
+		return err
+	}
+	delete(V.xattrs[Clean(path)], attr)
+	return nil
 }
 
 func (V *VFS) ListXattrs(path string) (map[string][]byte, error) {
-	//TODO implement me
-	panic("implement me")
+	if _, err := V.Lstat(path); err != nil {
+		return nil, err
+	}
+	attrs := map[string][]byte{}
+	for k, v := range V.xattrs[Clean(path)] {
+		attrs[k] = bytes.Clone(v)
+	}
+	return attrs, nil
 }
 
 func (V *VFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
@@ -152,3 +258,58 @@ func (V *VFS) Sub(path string) (apkfs.FullFS, error) {
 	//TODO implement me
 	panic("implement me")
 }
+
+// fileInfo overlays the permissions and ownership that
+// we've recorded on top of the real file.
+func (V *VFS) fileInfo(path string, info fs.FileInfo) fs.FileInfo {
+	key := Clean(path)
+	mode := info.Mode()
+	if node, ok := V.nodes[key]; ok {
+		mode = files.FileMode(node)
+	}
+	if perm, ok := V.permissions[key]; ok {
+		mode = mode.Type() | perm&^fs.ModeType
+	}
+	_, owned := V.uid[key]
+	return &fileInfo{
+		FileInfo: info,
+		mode:     mode,
+		owned:    owned,
+		uid:      V.uid[key],
+		gid:      V.gid[key],
+		id:       fileID(info),
+	}
+}
+
+// fileInfo follows the convention used by the apko filesystems
+// where Sys returns a *tar.Header containing the ownership. Sys
+// returns nil if the ownership hasn't been set by Chown.
+type fileInfo struct {
+	fs.FileInfo
+	mode  fs.FileMode
+	owned bool
+	uid   int
+	gid   int
+	id    any
+}
+
+// ID uniquely identifies the file on disk so
+// that hard links can be detected.
+func (f *fileInfo) ID() any {
+	return f.id
+}
+
+func (f *fileInfo) Mode() fs.FileMode {
+	return f.mode
+}
+
+func (f *fileInfo) Sys() any {
+	if !f.owned {
+		return nil
+	}
+	return &tar.Header{
+		Mode: int64(f.mode.Perm()),
+		Uid:  f.uid,
+		Gid:  f.gid,
+	}
+}
@@ -1,5 +1,101 @@
 package vfs
 
-import "chainguard.dev/apko/pkg/apk/fs"
+import (
+	"archive/tar"
+	"io/fs"
+	"os"
+	"testing"
 
-var _ fs.FullFS = &VFS{}
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+	"github.com/Snakdy/container-build-engine/pkg/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ apkfs.FullFS = &VFS{}
+
+func TestVFS_Xattr(t *testing.T) {
+	rootfs := NewVFS(t.TempDir())
+	require.NoError(t, rootfs.WriteFile("/server", []byte("#!/bin/sh"), 0755))
+
+	_, err := rootfs.GetXattr("/server", "user.foo")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, rootfs.SetXattr("/server", "user.foo", []byte("bar")))
+	data, err := rootfs.GetXattr("server", "user.foo")
+	require.NoError(t, err)
+	assert.EqualValues(t, "bar", string(data))
+
+	attrs, err := rootfs.ListXattrs("/server")
+	require.NoError(t, err)
+	assert.Len(t, attrs, 1)
+
+	require.NoError(t, rootfs.RemoveXattr("/server", "user.foo"))
+	attrs, err = rootfs.ListXattrs("/server")
+	require.NoError(t, err)
+	assert.Empty(t, attrs)
+
+	assert.ErrorIs(t, rootfs.SetXattr("/missing", "user.foo", nil), os.ErrNotExist)
+}
+
+func TestVFS_Ownership(t *testing.T) {
+	rootfs := NewVFS(t.TempDir())
+	require.NoError(t, rootfs.MkdirAll("/app", 0700))
+	require.NoError(t, rootfs.WriteFile("/app/server", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.Chown("app/server/", 1001, 1002))
+
+	info, err := rootfs.Stat("/app/server")
+	require.NoError(t, err)
+	assert.EqualValues(t, 0755, info.Mode().Perm())
+	header, ok := info.Sys().(*tar.Header)
+	require.True(t, ok)
+	assert.EqualValues(t, 1001, header.Uid)
+	assert.EqualValues(t, 1002, header.Gid)
+
+	info, err = rootfs.Lstat("/app")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.EqualValues(t, 0700, info.Mode().Perm())
+	// the owner hasn't been set
+	assert.Nil(t, info.Sys())
+}
+
+func TestVFS_Mknod(t *testing.T) {
+	rootfs := NewVFS(t.TempDir())
+	require.NoError(t, rootfs.MkdirAll("/dev", 0755))
+	require.NoError(t, rootfs.Mknod("/dev/sda", files.ModeBlock|0660, files.Mkdev(8, 0)))
+	require.NoError(t, rootfs.Mknod("/dev/pipe", files.ModeFifo|0600, 0))
+
+	info, err := rootfs.Lstat("/dev/sda")
+	require.NoError(t, err)
+	assert.EqualValues(t, fs.ModeDevice|0660, info.Mode())
+	dev, err := rootfs.Readnod("/dev/sda")
+	require.NoError(t, err)
+	assert.EqualValues(t, files.Mkdev(8, 0), dev)
+
+	info, err = rootfs.Lstat("/dev/pipe")
+	require.NoError(t, err)
+	assert.EqualValues(t, fs.ModeNamedPipe|0600, info.Mode())
+	_, err = rootfs.Readnod("/dev/pipe")
+	assert.Error(t, err)
+
+	assert.ErrorIs(t, rootfs.Mknod("/dev/sda", files.ModeBlock|0660, 0), os.ErrExist)
+}
+
+func TestVFS_Rename(t *testing.T) {
+	rootfs := NewVFS(t.TempDir())
+	require.NoError(t, rootfs.MkdirAll("/app", 0700))
+	require.NoError(t, rootfs.WriteFile("/app/server", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.Chown("/app/server", 1001, 1002))
+
+	require.NoError(t, rootfs.Rename("/app", "/opt"))
+	_, err := rootfs.Lstat("/app/server")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	info, err := rootfs.Lstat("/opt/server")
+	require.NoError(t, err)
+	assert.EqualValues(t, 0755, info.Mode().Perm())
+	header, ok := info.Sys().(*tar.Header)
+	require.True(t, ok)
+	assert.EqualValues(t, 1001, header.Uid)
+}
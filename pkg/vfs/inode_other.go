@@ -0,0 +1,11 @@
+//go:build !unix
+
+package vfs
+
+import "io/fs"
+
+// fileID is not supported on this platform, so
+// hard links will be treated as regular files.
+func fileID(fs.FileInfo) any {
+	return nil
+}
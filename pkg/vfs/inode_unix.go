@@ -0,0 +1,22 @@
+//go:build unix
+
+package vfs
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// fileID returns the device and inode of the file.
+func fileID(info fs.FileInfo) any {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return inode{dev: uint64(st.Dev), ino: st.Ino}
+}
@@ -0,0 +1,203 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+)
+
+// LinkFS records the hard links that are created in a
+// filesystem that doesn't otherwise expose them (e.g. the
+// apko memfs and dirFS), so that they can be detected when
+// the layer is written.
+//
+// Only links created through LinkFS.Link are tracked.
+// Similarly, the ownership of a file is only reported
+// by fs.FileInfo.Sys once it has been set through
+// LinkFS.Chown, since the apko filesystems can't tell
+// us whether a file is owned by root or nobody has set
+// its owner.
+type LinkFS struct {
+	apkfs.FullFS
+	mu sync.Mutex
+	// ids maps each path that has been linked
+	// to an ID shared by all of its links
+	ids map[string]*linkID
+	// owned is the set of paths whose
+	// ownership has been set
+	owned map[string]struct{}
+}
+
+// linkID identifies a group of hard links. It isn't
+// empty so that each allocation has a unique address.
+type linkID struct {
+	_ byte
+}
+
+// TrackLinks wraps the filesystem so that hard
+// links can be detected.
+func TrackLinks(fsys apkfs.FullFS) *LinkFS {
+	if l, ok := fsys.(*LinkFS); ok {
+		return l
+	}
+	return &LinkFS{
+		FullFS: fsys,
+		ids:    map[string]*linkID{},
+		owned:  map[string]struct{}{},
+	}
+}
+
+func (l *LinkFS) Link(oldname, newname string) error {
+	if err := l.FullFS.Link(oldname, newname); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	src := Clean(oldname)
+	id, ok := l.ids[src]
+	if !ok {
+		id = &linkID{}
+		l.ids[src] = id
+	}
+	l.ids[Clean(newname)] = id
+	return nil
+}
+
+func (l *LinkFS) Remove(name string) error {
+	if err := l.FullFS.Remove(name); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ids, Clean(name))
+	delete(l.owned, Clean(name))
+	return nil
+}
+
+// RemoveAll removes the path and anything inside of it,
+// along with the links and ownership that were recorded.
+func (l *LinkFS) RemoveAll(path string) error {
+	if v, ok := l.FullFS.(interface{ RemoveAll(string) error }); ok {
+		if err := v.RemoveAll(path); err != nil {
+			return err
+		}
+	} else if err := l.removeAll(path); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	deleteWithin(l.ids, Clean(path))
+	deleteWithin(l.owned, Clean(path))
+	return nil
+}
+
+// removeAll removes the children of a
+// directory before the directory itself.
+func (l *LinkFS) removeAll(path string) error {
+	var paths []string
+	err := fs.WalkDir(l.FullFS, path, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := l.FullFS.Remove(paths[i]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename moves the path, along with the links and ownership
+// that were recorded. It requires the underlying filesystem
+// to support renaming files.
+func (l *LinkFS) Rename(oldname, newname string) error {
+	v, ok := l.FullFS.(interface{ Rename(string, string) error })
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: errors.ErrUnsupported}
+	}
+	if err := v.Rename(oldname, newname); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	moveWithin(l.ids, Clean(oldname), Clean(newname))
+	moveWithin(l.owned, Clean(oldname), Clean(newname))
+	return nil
+}
+
+func (l *LinkFS) Chown(path string, uid, gid int) error {
+	if err := l.FullFS.Chown(path, uid, gid); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.owned[Clean(path)] = struct{}{}
+	return nil
+}
+
+func (l *LinkFS) Stat(path string) (fs.FileInfo, error) {
+	info, err := l.FullFS.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return l.fileInfo(path, info), nil
+}
+
+func (l *LinkFS) Lstat(path string) (fs.FileInfo, error) {
+	info, err := l.FullFS.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	return l.fileInfo(path, info), nil
+}
+
+// fileInfo attaches the ID of the links to
+// the file, if it has any, and hides its
+// ownership if it hasn't been set.
+func (l *LinkFS) fileInfo(path string, info fs.FileInfo) fs.FileInfo {
+	key := Clean(path)
+	l.mu.Lock()
+	id, linked := l.ids[key]
+	_, owned := l.owned[key]
+	l.mu.Unlock()
+	if owned && !linked {
+		return info
+	}
+	li := &linkInfo{FileInfo: info, owned: owned}
+	if linked {
+		li.id = id
+	} else if v, ok := info.(interface{ ID() any }); ok {
+		// keep the ID from the underlying filesystem
+		li.id = v.ID()
+	}
+	return li
+}
+
+type linkInfo struct {
+	fs.FileInfo
+	id    any
+	owned bool
+}
+
+// ID is shared by every link to the file.
+func (f *linkInfo) ID() any {
+	return f.id
+}
+
+func (f *linkInfo) Sys() any {
+	if !f.owned {
+		return nil
+	}
+	return f.FileInfo.Sys()
+}
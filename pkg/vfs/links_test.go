@@ -0,0 +1,150 @@
+package vfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io/fs"
+	"testing"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ apkfs.FullFS = &LinkFS{}
+
+func TestLinkFS(t *testing.T) {
+	rootfs := TrackLinks(apkfs.NewMemFS())
+	assert.Same(t, rootfs, TrackLinks(rootfs))
+
+	require.NoError(t, rootfs.WriteFile("/server", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.WriteFile("/other", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.Link("/server", "/server-link"))
+	require.NoError(t, rootfs.Link("server-link", "/server-link2"))
+
+	id := func(path string) any {
+		info, err := rootfs.Lstat(path)
+		require.NoError(t, err)
+		if v, ok := info.(interface{ ID() any }); ok {
+			return v.ID()
+		}
+		return nil
+	}
+	// every link shares the same ID
+	assert.NotNil(t, id("/server"))
+	assert.Equal(t, id("/server"), id("/server-link"))
+	assert.Equal(t, id("/server"), id("/server-link2"))
+	assert.Nil(t, id("/other"))
+
+	// removing a link doesn't affect the others
+	require.NoError(t, rootfs.Remove("/server"))
+	assert.Equal(t, id("/server-link"), id("/server-link2"))
+	require.NoError(t, rootfs.WriteFile("/server", []byte("#!/bin/bash"), 0755))
+	assert.Nil(t, id("/server"))
+}
+
+func TestLinkFS_Ownership(t *testing.T) {
+	rootfs := TrackLinks(apkfs.NewMemFS())
+	require.NoError(t, rootfs.WriteFile("/server", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.WriteFile("/other", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.Chown("/server", 0, 0))
+
+	// explicitly owned by root
+	info, err := rootfs.Lstat("/server")
+	require.NoError(t, err)
+	header, ok := info.Sys().(*tar.Header)
+	require.True(t, ok)
+	assert.EqualValues(t, 0, header.Uid)
+
+	// nobody has set the owner
+	info, err = rootfs.Lstat("/other")
+	require.NoError(t, err)
+	assert.Nil(t, info.Sys())
+
+	// the owner is forgotten when the file is removed
+	require.NoError(t, rootfs.Remove("/server"))
+	require.NoError(t, rootfs.WriteFile("/server", []byte("#!/bin/bash"), 0755))
+	info, err = rootfs.Lstat("/server")
+	require.NoError(t, err)
+	assert.Nil(t, info.Sys())
+}
+
+func TestLinkFS_RemoveAll(t *testing.T) {
+	rootfs := TrackLinks(apkfs.NewMemFS())
+	require.NoError(t, rootfs.MkdirAll("/app/bin", 0755))
+	require.NoError(t, rootfs.WriteFile("/app/bin/server", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.Link("/app/bin/server", "/server"))
+	require.NoError(t, rootfs.Chown("/app/bin/server", 1001, 0))
+	require.NoError(t, rootfs.WriteFile("/application", []byte(""), 0644))
+	require.NoError(t, rootfs.Link("/application", "/application-link"))
+
+	require.NoError(t, rootfs.RemoveAll("/app"))
+	_, err := rootfs.Lstat("/app")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.NotContains(t, rootfs.ids, "/app/bin/server")
+	assert.NotContains(t, rootfs.owned, "/app/bin/server")
+	// siblings that share the prefix are kept
+	assert.Contains(t, rootfs.ids, "/application")
+	assert.Contains(t, rootfs.ids, "/server")
+
+	// recreating the file doesn't resurrect the link
+	require.NoError(t, rootfs.MkdirAll("/app/bin", 0755))
+	require.NoError(t, rootfs.WriteFile("/app/bin/server", []byte("#!/bin/bash"), 0755))
+	info, err := rootfs.Lstat("/app/bin/server")
+	require.NoError(t, err)
+	assert.Nil(t, fileIDOf(info))
+	assert.Nil(t, info.Sys())
+
+	// removing something that doesn't exist is fine
+	assert.NoError(t, rootfs.RemoveAll("/missing"))
+}
+
+func TestLinkFS_Rename(t *testing.T) {
+	rootfs := TrackLinks(NewVFS(t.TempDir()))
+	require.NoError(t, rootfs.MkdirAll("/app/bin", 0755))
+	require.NoError(t, rootfs.WriteFile("/app/bin/server", []byte("#!/bin/sh"), 0755))
+	require.NoError(t, rootfs.Link("/app/bin/server", "/server"))
+	require.NoError(t, rootfs.Chown("/app/bin/server", 1001, 0))
+
+	t.Run("directory", func(t *testing.T) {
+		require.NoError(t, rootfs.Rename("/app", "/opt"))
+		assert.NotContains(t, rootfs.ids, "/app/bin/server")
+
+		info, err := rootfs.Lstat("/opt/bin/server")
+		require.NoError(t, err)
+		assert.NotNil(t, fileIDOf(info))
+		assert.Same(t, fileIDOf(info), fileIDOf(mustLstat(t, rootfs, "/server")))
+		header, ok := info.Sys().(*tar.Header)
+		require.True(t, ok)
+		assert.EqualValues(t, 1001, header.Uid)
+	})
+	t.Run("over an existing path", func(t *testing.T) {
+		require.NoError(t, rootfs.WriteFile("/other", []byte(""), 0644))
+		require.NoError(t, rootfs.Link("/other", "/other-link"))
+		require.NoError(t, rootfs.Rename("/other-link", "/server"))
+
+		// /server is now a link to /other
+		// rather than to the server
+		assert.Same(t, fileIDOf(mustLstat(t, rootfs, "/other")), fileIDOf(mustLstat(t, rootfs, "/server")))
+		assert.NotSame(t, fileIDOf(mustLstat(t, rootfs, "/opt/bin/server")), fileIDOf(mustLstat(t, rootfs, "/server")))
+		assert.Nil(t, mustLstat(t, rootfs, "/server").Sys())
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		memfs := TrackLinks(apkfs.NewMemFS())
+		require.NoError(t, memfs.WriteFile("/server", []byte("#!/bin/sh"), 0755))
+		assert.ErrorIs(t, memfs.Rename("/server", "/other"), errors.ErrUnsupported)
+	})
+}
+
+func fileIDOf(info fs.FileInfo) any {
+	if v, ok := info.(interface{ ID() any }); ok {
+		return v.ID()
+	}
+	return nil
+}
+
+func mustLstat(t *testing.T, rootfs apkfs.FullFS, path string) fs.FileInfo {
+	info, err := rootfs.Lstat(path)
+	require.NoError(t, err)
+	return info
+}
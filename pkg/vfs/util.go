@@ -9,3 +9,36 @@ import (
 func Clean(s string) string {
 	return filepath.FromSlash(path.Clean("/" + strings.Trim(s, "/")))
 }
+
+// within returns true if the cleaned name
+// is root or is inside of it.
+func within(name, root string) bool {
+	return name == root || root == string(filepath.Separator) || strings.HasPrefix(name, root+string(filepath.Separator))
+}
+
+// deleteWithin removes the entries for root
+// and everything inside of it.
+func deleteWithin[V any](m map[string]V, root string) {
+	for k := range m {
+		if within(k, root) {
+			delete(m, k)
+		}
+	}
+}
+
+// moveWithin moves the entries for oldname and everything
+// inside of it to newname, replacing anything that was
+// already there.
+func moveWithin[V any](m map[string]V, oldname, newname string) {
+	moved := map[string]V{}
+	for k, v := range m {
+		if within(k, oldname) {
+			moved[newname+strings.TrimPrefix(k, oldname)] = v
+			delete(m, k)
+		}
+	}
+	deleteWithin(m, newname)
+	for k, v := range moved {
+		m[k] = v
+	}
+}